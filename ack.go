@@ -0,0 +1,568 @@
+package main
+
+import (
+	"errors"
+	"log"
+	"net/http"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// At-least-once delivery. A client subscribing with "ack": true registers a
+// durable consumer (its JWT subject, or a "consumer" name signed by the app
+// backend) for the pattern.
+// Every stored notification published to a matching channel is then tracked
+// for that consumer until it sends {"action": "ack", "channel": ..., "id": ...},
+// and unacked notifications are sent again when the consumer subscribes after
+// a reconnect. Explicitly unsubscribing removes the consumer.
+var deliveries deliveryStore = newMemoryDeliveryStore()
+
+// How long acked deliveries are kept for the delivery status
+var ackRetention = 24 * time.Hour
+
+// deliveryRef identifies one stored notification.
+type deliveryRef struct {
+	Channel string
+	ID      int64
+}
+
+type deliveryStatus struct {
+	Channel     string   `json:"channel"`
+	ID          int64    `json:"id"`
+	Subscribers int      `json:"subscribers"`
+	Delivered   int      `json:"delivered"`
+	Pending     []string `json:"pending"`
+}
+
+type deliveryStore interface {
+	register(appID, consumer, pattern string) error
+	unregister(appID, consumer, pattern string) error
+	// consumers returns the registered patterns of each consumer of the app
+	consumers(appID string) (map[string][]string, error)
+	track(appID string, ref deliveryRef, expiresAt *time.Time, consumers []string, now time.Time) error
+	ack(appID, consumer string, ref deliveryRef, now time.Time) (bool, error)
+	pending(appID, consumer, pattern string, limit int) ([]deliveryRef, error)
+	status(appID string, ref deliveryRef) (deliveryStatus, error)
+	// forget removes the deliveries of a notification that is gone from storage
+	forget(appID string, ref deliveryRef) error
+	// purge removes expired deliveries and acked ones older than ackRetention
+	purge(now time.Time) (int64, error)
+	// pruneChannel removes the deliveries of a channel created before the time,
+	// whose notifications the retention policy deleted
+	pruneChannel(appID, channel string, before time.Time) (int64, error)
+}
+
+func loadDeliveryConfig() {
+	ackRetention = envDuration("ACK_RETENTION", ackRetention)
+	if useDB {
+		store, err := newDBDeliveryStore()
+		if err != nil {
+			log.Println("Failed to create delivery tables, tracking acks in memory:", err)
+			return
+		}
+		deliveries = store
+	}
+}
+
+// trackDeliveries records the notification as pending for every registered
+// consumer. Like the broadcast, a consumer matching several target channels
+// is tracked once, for the first of them.
+func trackDeliveries(appID string, notif Notification, channelIDs map[string]int64) {
+	registered, err := deliveries.consumers(appID)
+	if err != nil {
+		log.Println("Failed to load ack consumers:", err)
+		return
+	}
+	if len(registered) == 0 {
+		return
+	}
+
+	now := time.Now()
+	tracked := map[string]bool{}
+	for _, channel := range notificationTargets(notif) {
+		id := channelIDs[channel]
+		if id == 0 {
+			continue
+		}
+		consumers := []string{}
+		for consumer, patterns := range registered {
+			if tracked[consumer] {
+				continue
+			}
+			for _, pattern := range patterns {
+				if patternCovers(pattern, channel) {
+					tracked[consumer] = true
+					consumers = append(consumers, consumer)
+					break
+				}
+			}
+		}
+		if len(consumers) == 0 {
+			continue
+		}
+		if err := deliveries.track(appID, deliveryRef{channel, id}, notif.ExpiresAt, consumers, now); err != nil {
+			log.Println("Failed to track deliveries:", err)
+		}
+	}
+}
+
+// ackConsumer returns the consumer a subscribe frame asks to register. Other
+// connections must not act as the consumer, so a name other than the JWT
+// subject needs consumer_auth, signed like a private channel.
+func ackConsumer(client *Client, frame ControlFrame) (string, error) {
+	sub, _ := client.claims["sub"].(string)
+	if frame.Consumer == "" || frame.Consumer == sub {
+		if sub == "" {
+			return "", errors.New("Acknowledged subscriptions require a consumer")
+		}
+		return sub, nil
+	}
+	if !verifyChannelAuth(client.app, client.socketID, consumerSignatureSubject(frame.Consumer), "", frame.ConsumerAuth) {
+		return "", errors.New("Invalid consumer signature")
+	}
+	return frame.Consumer, nil
+}
+
+// consumerSignatureSubject is what a consumer_auth signature covers in place of
+// the channel, "<socket_id>:consumer:<name>". Channels never contain ':'.
+func consumerSignatureSubject(consumer string) string {
+	return "consumer:" + consumer
+}
+
+// redeliver sends the consumer's unacked notifications for the pattern again,
+// up to replayLimit. Deliveries of notifications that expired or were pruned
+// are forgotten, so they never hold back newer ones.
+func redeliver(client *Client, pattern string) {
+	sent := map[deliveryRef]bool{}
+	for {
+		refs, err := deliveries.pending(client.app.ID, client.consumer, pattern, replayLimit)
+		if err != nil {
+			log.Println("Failed to load pending deliveries:", err)
+			return
+		}
+
+		forgotten := 0
+		for _, ref := range refs {
+			if sent[ref] {
+				continue
+			}
+			if len(sent) >= replayLimit {
+				return
+			}
+			history, err := loadHistory(client.app.ID, ref.Channel, ref.ID-1, time.Time{}, 1)
+			if err != nil {
+				log.Println("Failed to load pending notification:", err)
+				return
+			}
+			if len(history) == 0 || history[0].ID != ref.ID {
+				// The notification is gone from storage, nothing left to retry
+				if err := deliveries.forget(client.app.ID, ref); err != nil {
+					log.Println("Failed to forget delivery:", err)
+					return
+				}
+				forgotten++
+				continue
+			}
+			sent[ref] = true
+			notif := history[0]
+			notif.Replayed = true
+			client.sendNotification(notif)
+		}
+		// Forgotten deliveries made room for more
+		if forgotten == 0 {
+			return
+		}
+	}
+}
+
+func handleAck(client *Client, frame ControlFrame) {
+	if client.consumer == "" {
+		client.sendJSON(gin.H{"error": "No acknowledged subscription", "channel": frame.Channel})
+		return
+	}
+	if frame.ID <= 0 || isPattern(frame.Channel) {
+		client.sendJSON(gin.H{"error": "Ack requires a channel and id", "channel": frame.Channel})
+		return
+	}
+
+	acked, err := deliveries.ack(client.app.ID, client.consumer, deliveryRef{frame.Channel, frame.ID}, time.Now())
+	if err != nil {
+		log.Println("Failed to record ack:", err)
+		client.sendJSON(gin.H{"error": "Failed to record ack", "channel": frame.Channel, "id": frame.ID})
+		return
+	}
+	if !acked {
+		client.sendJSON(gin.H{"error": "Unknown delivery", "channel": frame.Channel, "id": frame.ID})
+		return
+	}
+	client.sendJSON(gin.H{"message": "Acked", "channel": frame.Channel, "id": frame.ID})
+}
+
+// deliveryStatusHandler reports how many consumers acked a notification.
+func deliveryStatusHandler(c *gin.Context) {
+	app := appFromContext(c)
+
+	channel := c.Query("channel")
+	id, err := strconv.ParseInt(c.Query("id"), 10, 64)
+	if validateAppChannel(app.ID, channel) != nil || err != nil || id <= 0 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "channel and id are required"})
+		return
+	}
+	if !authorizeRequest(c, actionHistory, channel) {
+		return
+	}
+
+	status, err := deliveries.status(app.ID, deliveryRef{channel, id})
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to load delivery status", "detail": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, status)
+}
+
+// ------------------ Memory ------------------
+
+type memoryDeliveryStore struct {
+	mu       sync.Mutex
+	patterns map[string]map[string]map[string]bool // app -> consumer -> patterns
+	records  map[memoryDeliveryKey]*memoryDelivery
+}
+
+type memoryDeliveryKey struct {
+	appID string
+	ref   deliveryRef
+}
+
+type memoryDelivery struct {
+	createdAt time.Time
+	expiresAt *time.Time
+	acked     map[string]bool // consumer -> acked
+}
+
+func newMemoryDeliveryStore() *memoryDeliveryStore {
+	return &memoryDeliveryStore{
+		patterns: make(map[string]map[string]map[string]bool),
+		records:  make(map[memoryDeliveryKey]*memoryDelivery),
+	}
+}
+
+func (s *memoryDeliveryStore) register(appID, consumer, pattern string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.patterns[appID] == nil {
+		s.patterns[appID] = make(map[string]map[string]bool)
+	}
+	if s.patterns[appID][consumer] == nil {
+		s.patterns[appID][consumer] = make(map[string]bool)
+	}
+	s.patterns[appID][consumer][pattern] = true
+	return nil
+}
+
+func (s *memoryDeliveryStore) unregister(appID, consumer, pattern string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.patterns[appID][consumer], pattern)
+	if len(s.patterns[appID][consumer]) == 0 {
+		delete(s.patterns[appID], consumer)
+	}
+	for key, record := range s.records {
+		if key.appID == appID && patternCovers(pattern, key.ref.Channel) && !record.acked[consumer] {
+			delete(record.acked, consumer)
+		}
+	}
+	return nil
+}
+
+func (s *memoryDeliveryStore) consumers(appID string) (map[string][]string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	result := map[string][]string{}
+	for consumer, patterns := range s.patterns[appID] {
+		for pattern := range patterns {
+			result[consumer] = append(result[consumer], pattern)
+		}
+	}
+	return result, nil
+}
+
+func (s *memoryDeliveryStore) track(appID string, ref deliveryRef, expiresAt *time.Time, consumers []string, now time.Time) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	record := &memoryDelivery{createdAt: now, expiresAt: expiresAt, acked: make(map[string]bool)}
+	for _, consumer := range consumers {
+		record.acked[consumer] = false
+	}
+	s.records[memoryDeliveryKey{appID, ref}] = record
+	return nil
+}
+
+func (s *memoryDeliveryStore) ack(appID, consumer string, ref deliveryRef, now time.Time) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	record, ok := s.records[memoryDeliveryKey{appID, ref}]
+	if !ok {
+		return false, nil
+	}
+	if _, ok := record.acked[consumer]; !ok {
+		return false, nil
+	}
+	record.acked[consumer] = true
+	return true, nil
+}
+
+func (s *memoryDeliveryStore) pending(appID, consumer, pattern string, limit int) ([]deliveryRef, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	refs := []deliveryRef{}
+	for key, record := range s.records {
+		if acked, ok := record.acked[consumer]; ok && !acked && key.appID == appID && patternCovers(pattern, key.ref.Channel) {
+			refs = append(refs, key.ref)
+		}
+	}
+	sort.Slice(refs, func(i, j int) bool {
+		if refs[i].Channel != refs[j].Channel {
+			return refs[i].Channel < refs[j].Channel
+		}
+		return refs[i].ID < refs[j].ID
+	})
+	if len(refs) > limit {
+		refs = refs[:limit]
+	}
+	return refs, nil
+}
+
+func (s *memoryDeliveryStore) status(appID string, ref deliveryRef) (deliveryStatus, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	status := deliveryStatus{Channel: ref.Channel, ID: ref.ID, Pending: []string{}}
+	if record, ok := s.records[memoryDeliveryKey{appID, ref}]; ok {
+		for consumer, acked := range record.acked {
+			status.Subscribers++
+			if acked {
+				status.Delivered++
+			} else {
+				status.Pending = append(status.Pending, consumer)
+			}
+		}
+	}
+	sort.Strings(status.Pending)
+	return status, nil
+}
+
+func (s *memoryDeliveryStore) forget(appID string, ref deliveryRef) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.records, memoryDeliveryKey{appID, ref})
+	return nil
+}
+
+func (s *memoryDeliveryStore) purge(now time.Time) (int64, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	// Notifications in the memory buffer are gone after HISTORY_BUFFER_TTL; other
+	// stores keep them until they expire or retention prunes the channel
+	_, inMemory := storage.(*memoryStore)
+	var purged int64
+	for key, record := range s.records {
+		expired := record.expiresAt != nil && !now.Before(*record.expiresAt)
+		evicted := inMemory && memoryHistoryTTL > 0 && now.Sub(record.createdAt) > memoryHistoryTTL
+		if expired || evicted || (record.allAcked() && now.Sub(record.createdAt) > ackRetention) {
+			delete(s.records, key)
+			purged++
+		}
+	}
+	return purged, nil
+}
+
+func (s *memoryDeliveryStore) pruneChannel(appID, channel string, before time.Time) (int64, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var pruned int64
+	for key, record := range s.records {
+		if key.appID == appID && key.ref.Channel == channel && record.createdAt.Before(before) {
+			delete(s.records, key)
+			pruned++
+		}
+	}
+	return pruned, nil
+}
+
+func (record *memoryDelivery) allAcked() bool {
+	for _, acked := range record.acked {
+		if !acked {
+			return false
+		}
+	}
+	return true
+}
+
+// ------------------ Postgres ------------------
+
+type dbDeliveryStore struct{}
+
+func newDBDeliveryStore() (*dbDeliveryStore, error) {
+	_, err := dbConn.Exec(`CREATE TABLE IF NOT EXISTS ws_ack_consumers (
+		app_id TEXT NOT NULL,
+		consumer TEXT NOT NULL,
+		pattern TEXT NOT NULL,
+		PRIMARY KEY (app_id, consumer, pattern)
+	)`)
+	if err != nil {
+		return nil, err
+	}
+	_, err = dbConn.Exec(`CREATE TABLE IF NOT EXISTS ws_deliveries (
+		app_id TEXT NOT NULL,
+		channel TEXT NOT NULL,
+		notification_id BIGINT NOT NULL,
+		consumer TEXT NOT NULL,
+		created_at TIMESTAMP NOT NULL DEFAULT NOW(),
+		acked_at TIMESTAMP,
+		expires_at TIMESTAMP,
+		PRIMARY KEY (app_id, channel, notification_id, consumer)
+	)`)
+	if err != nil {
+		return nil, err
+	}
+	// Tables created before deliveries could expire
+	_, err = dbConn.Exec(`ALTER TABLE ws_deliveries ADD COLUMN IF NOT EXISTS expires_at TIMESTAMP`)
+	return &dbDeliveryStore{}, err
+}
+
+func (s *dbDeliveryStore) register(appID, consumer, pattern string) error {
+	_, err := dbConn.Exec(`INSERT INTO ws_ack_consumers (app_id, consumer, pattern) VALUES ($1, $2, $3)
+		ON CONFLICT DO NOTHING`, appID, consumer, pattern)
+	return err
+}
+
+func (s *dbDeliveryStore) unregister(appID, consumer, pattern string) error {
+	if _, err := dbConn.Exec(`DELETE FROM ws_ack_consumers WHERE app_id = $1 AND consumer = $2 AND pattern = $3`,
+		appID, consumer, pattern); err != nil {
+		return err
+	}
+	refs, err := s.pending(appID, consumer, pattern, -1)
+	if err != nil {
+		return err
+	}
+	for _, ref := range refs {
+		if _, err := dbConn.Exec(`DELETE FROM ws_deliveries WHERE app_id = $1 AND channel = $2 AND notification_id = $3 AND consumer = $4`,
+			appID, ref.Channel, ref.ID, consumer); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *dbDeliveryStore) consumers(appID string) (map[string][]string, error) {
+	rows, err := dbConn.Query(`SELECT consumer, pattern FROM ws_ack_consumers WHERE app_id = $1`, appID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	result := map[string][]string{}
+	for rows.Next() {
+		var consumer, pattern string
+		if err := rows.Scan(&consumer, &pattern); err != nil {
+			return nil, err
+		}
+		result[consumer] = append(result[consumer], pattern)
+	}
+	return result, rows.Err()
+}
+
+func (s *dbDeliveryStore) track(appID string, ref deliveryRef, expiresAt *time.Time, consumers []string, now time.Time) error {
+	for _, consumer := range consumers {
+		_, err := dbConn.Exec(`INSERT INTO ws_deliveries (app_id, channel, notification_id, consumer, created_at, expires_at)
+			VALUES ($1, $2, $3, $4, $5, $6) ON CONFLICT DO NOTHING`, appID, ref.Channel, ref.ID, consumer, now, expiresAt)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *dbDeliveryStore) ack(appID, consumer string, ref deliveryRef, now time.Time) (bool, error) {
+	result, err := dbConn.Exec(`UPDATE ws_deliveries SET acked_at = COALESCE(acked_at, $5)
+		WHERE app_id = $1 AND channel = $2 AND notification_id = $3 AND consumer = $4`,
+		appID, ref.Channel, ref.ID, consumer, now)
+	if err != nil {
+		return false, err
+	}
+	updated, _ := result.RowsAffected()
+	return updated > 0, nil
+}
+
+// pending returns up to limit unacked deliveries, or all of them when limit is negative.
+func (s *dbDeliveryStore) pending(appID, consumer, pattern string, limit int) ([]deliveryRef, error) {
+	rows, err := dbConn.Query(`SELECT channel, notification_id FROM ws_deliveries
+		WHERE app_id = $1 AND consumer = $2 AND acked_at IS NULL ORDER BY channel, notification_id`, appID, consumer)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	refs := []deliveryRef{}
+	for rows.Next() && (limit < 0 || len(refs) < limit) {
+		var ref deliveryRef
+		if err := rows.Scan(&ref.Channel, &ref.ID); err != nil {
+			return nil, err
+		}
+		if patternCovers(pattern, ref.Channel) {
+			refs = append(refs, ref)
+		}
+	}
+	return refs, rows.Err()
+}
+
+func (s *dbDeliveryStore) status(appID string, ref deliveryRef) (deliveryStatus, error) {
+	status := deliveryStatus{Channel: ref.Channel, ID: ref.ID, Pending: []string{}}
+	rows, err := dbConn.Query(`SELECT consumer, acked_at IS NOT NULL FROM ws_deliveries
+		WHERE app_id = $1 AND channel = $2 AND notification_id = $3 ORDER BY consumer`, appID, ref.Channel, ref.ID)
+	if err != nil {
+		return status, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var consumer string
+		var acked bool
+		if err := rows.Scan(&consumer, &acked); err != nil {
+			return status, err
+		}
+		status.Subscribers++
+		if acked {
+			status.Delivered++
+		} else {
+			status.Pending = append(status.Pending, consumer)
+		}
+	}
+	return status, rows.Err()
+}
+
+func (s *dbDeliveryStore) forget(appID string, ref deliveryRef) error {
+	_, err := dbConn.Exec(`DELETE FROM ws_deliveries WHERE app_id = $1 AND channel = $2 AND notification_id = $3`,
+		appID, ref.Channel, ref.ID)
+	return err
+}
+
+func (s *dbDeliveryStore) purge(now time.Time) (int64, error) {
+	result, err := dbConn.Exec(`DELETE FROM ws_deliveries WHERE expires_at <= $1 OR acked_at < $2`, now, now.Add(-ackRetention))
+	if err != nil {
+		return 0, err
+	}
+	return result.RowsAffected()
+}
+
+func (s *dbDeliveryStore) pruneChannel(appID, channel string, before time.Time) (int64, error) {
+	result, err := dbConn.Exec(`DELETE FROM ws_deliveries WHERE app_id = $1 AND channel = $2 AND created_at < $3`,
+		appID, channel, before)
+	if err != nil {
+		return 0, err
+	}
+	return result.RowsAffected()
+}
@@ -0,0 +1,240 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/stretchr/testify/assert"
+)
+
+func withDeliveryStore(t *testing.T) {
+	previous := deliveries
+	deliveries = newMemoryDeliveryStore()
+	t.Cleanup(func() { deliveries = previous })
+}
+
+func getDeliveryStatus(t *testing.T, router http.Handler, channel string, id int64) deliveryStatus {
+	req, _ := http.NewRequest("GET", "/notifications/delivery?channel="+channel+"&id="+strconv.FormatInt(id, 10), nil)
+	req.Header.Set("key", "key")
+	req.Header.Set("secret", "secret")
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusOK, w.Code)
+
+	var status deliveryStatus
+	assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &status))
+	return status
+}
+
+func consumerAuth(socketID, consumer string) string {
+	return "key:" + channelSignature("secret", socketID, consumerSignatureSubject(consumer), "")
+}
+
+func subscribeAck(t *testing.T, conn *websocket.Conn, socketID, channel, consumer string) {
+	var ack map[string]interface{}
+	frame := ControlFrame{Action: "subscribe", Channel: channel, Ack: true, Consumer: consumer, ConsumerAuth: consumerAuth(socketID, consumer)}
+	assert.NoError(t, conn.WriteJSON(frame))
+	assert.NoError(t, conn.ReadJSON(&ack))
+	assert.Equal(t, "Subscribed to channel", ack["message"])
+}
+
+// Test acks, delivery status and redelivery after a reconnect
+func TestAckDelivery(t *testing.T) {
+	withDeliveryStore(t)
+	router := setupTestRouter()
+	server := httptest.NewServer(router)
+	defer server.Close()
+
+	conn, socketID := dialTestWebSocket(t, server)
+	subscribeAck(t, conn, socketID, "ack_payments", "billing-svc")
+
+	assert.Equal(t, http.StatusOK, publishAs(router, "key", "secret", Notification{Channel: "ack_payments", Event: "paid"}))
+	var first Notification
+	assert.NoError(t, conn.ReadJSON(&first))
+
+	status := getDeliveryStatus(t, router, "ack_payments", first.ID)
+	assert.Equal(t, 1, status.Subscribers)
+	assert.Equal(t, 0, status.Delivered)
+	assert.Equal(t, []string{"billing-svc"}, status.Pending)
+
+	var reply map[string]interface{}
+	assert.NoError(t, conn.WriteJSON(ControlFrame{Action: "ack", Channel: "ack_payments", ID: first.ID}))
+	assert.NoError(t, conn.ReadJSON(&reply))
+	assert.Equal(t, "Acked", reply["message"])
+
+	status = getDeliveryStatus(t, router, "ack_payments", first.ID)
+	assert.Equal(t, 1, status.Delivered)
+	assert.Empty(t, status.Pending)
+
+	// Disconnect before acking the second notification
+	assert.Equal(t, http.StatusOK, publishAs(router, "key", "secret", Notification{Channel: "ack_payments", Event: "refunded"}))
+	var second Notification
+	assert.NoError(t, conn.ReadJSON(&second))
+	conn.Close()
+
+	conn, socketID = dialTestWebSocket(t, server)
+	defer conn.Close()
+	subscribeAck(t, conn, socketID, "ack_payments", "billing-svc")
+
+	var redelivered Notification
+	assert.NoError(t, conn.ReadJSON(&redelivered))
+	assert.Equal(t, second.ID, redelivered.ID)
+	assert.True(t, redelivered.Replayed)
+
+	// Unsubscribing removes the consumer
+	assert.NoError(t, conn.WriteJSON(ControlFrame{Action: "unsubscribe", Channel: "ack_payments"}))
+	assert.NoError(t, conn.ReadJSON(&reply))
+	assert.Equal(t, 0, getDeliveryStatus(t, router, "ack_payments", second.ID).Subscribers)
+}
+
+// Test invalid ack frames
+func TestAckErrors(t *testing.T) {
+	withDeliveryStore(t)
+	server := httptest.NewServer(setupTestRouter())
+	defer server.Close()
+
+	conn, socketID := dialTestWebSocket(t, server)
+	defer conn.Close()
+
+	var reply map[string]interface{}
+	assert.NoError(t, conn.WriteJSON(ControlFrame{Action: "ack", Channel: "ack_errors", ID: 1}))
+	assert.NoError(t, conn.ReadJSON(&reply))
+	assert.Equal(t, "No acknowledged subscription", reply["error"])
+
+	// Without a token there is no subject to default to
+	reply = nil
+	assert.NoError(t, conn.WriteJSON(ControlFrame{Action: "subscribe", Channel: "ack_errors", Ack: true}))
+	assert.NoError(t, conn.ReadJSON(&reply))
+	assert.Equal(t, "Acknowledged subscriptions require a consumer", reply["error"])
+
+	// Another connection cannot pose as a named consumer without its signature
+	for _, auth := range []string{"", consumerAuth("1.2", "worker-1"), consumerAuth(socketID, "worker-2")} {
+		reply = nil
+		assert.NoError(t, conn.WriteJSON(ControlFrame{Action: "subscribe", Channel: "ack_errors", Ack: true, Consumer: "worker-1", ConsumerAuth: auth}))
+		assert.NoError(t, conn.ReadJSON(&reply))
+		assert.Equal(t, "Invalid consumer signature", reply["error"])
+	}
+
+	subscribeAck(t, conn, socketID, "ack_errors", "worker-1")
+	reply = nil
+	assert.NoError(t, conn.WriteJSON(ControlFrame{Action: "ack", Channel: "ack_errors", ID: 12345}))
+	assert.NoError(t, conn.ReadJSON(&reply))
+	assert.Equal(t, "Unknown delivery", reply["error"])
+}
+
+// Test that the consumer defaults to the JWT subject
+func TestAckConsumerSubject(t *testing.T) {
+	withDeliveryStore(t)
+	withJWTSecret(t, "jwt-secret")
+	server := httptest.NewServer(setupTestRouter())
+	defer server.Close()
+
+	conn, _, err := dialJWT(server, "?token="+hs256Token("jwt-secret", map[string]interface{}{"sub": "billing-svc"}), nil)
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer conn.Close()
+
+	var reply map[string]interface{}
+	assert.NoError(t, conn.WriteJSON(ControlFrame{Action: "subscribe", Channel: "ack_subject", Ack: true, Consumer: "audit-svc"}))
+	assert.NoError(t, conn.ReadJSON(&reply))
+	assert.Equal(t, "Invalid consumer signature", reply["error"])
+
+	reply = nil
+	assert.NoError(t, conn.WriteJSON(ControlFrame{Action: "subscribe", Channel: "ack_subject", Ack: true}))
+	assert.NoError(t, conn.ReadJSON(&reply))
+	assert.Equal(t, "Subscribed to channel", reply["message"])
+	consumers, _ := deliveries.consumers(defaultAppID)
+	assert.Equal(t, map[string][]string{"billing-svc": {"ack_subject"}}, consumers)
+}
+
+// Test that a consumer matching several targets is tracked once
+func TestTrackDeliveriesMultipleChannels(t *testing.T) {
+	withDeliveryStore(t)
+	deliveries.register(defaultAppID, "audit-svc", "track_audit")
+	deliveries.register(defaultAppID, "audit-svc", "track_team.#")
+	deliveries.register(defaultAppID, "team-svc", "track_team.4")
+
+	notif := Notification{Channel: "track_team.4", Channels: []string{"track_team.4", "track_audit"}}
+	trackDeliveries(defaultAppID, notif, map[string]int64{"track_team.4": 7, "track_audit": 3})
+
+	status, _ := deliveries.status(defaultAppID, deliveryRef{"track_team.4", 7})
+	assert.Equal(t, []string{"audit-svc", "team-svc"}, status.Pending)
+	status, _ = deliveries.status(defaultAppID, deliveryRef{"track_audit", 3})
+	assert.Equal(t, 0, status.Subscribers)
+}
+
+// Test that deliveries of notifications gone from storage never block redelivery
+func TestRedeliverForgetsMissing(t *testing.T) {
+	withDeliveryStore(t)
+	defer func(limit int) { replayLimit = limit }(replayLimit)
+	replayLimit = 2
+	router := setupTestRouter()
+	server := httptest.NewServer(router)
+	defer server.Close()
+
+	deliveries.register(defaultAppID, "billing-svc", "ack_stale.*")
+	assert.Equal(t, http.StatusOK, publishAs(router, "key", "secret", Notification{Channel: "ack_stale.b", Event: "paid"}))
+	for id := int64(1); id <= 3; id++ {
+		deliveries.track(defaultAppID, deliveryRef{"ack_stale.a", id}, nil, []string{"billing-svc"}, time.Now())
+	}
+
+	conn, socketID := dialTestWebSocket(t, server)
+	defer conn.Close()
+	subscribeAck(t, conn, socketID, "ack_stale.*", "billing-svc")
+
+	var redelivered Notification
+	assert.NoError(t, conn.ReadJSON(&redelivered))
+	assert.Equal(t, "ack_stale.b", redelivered.Channel)
+	assert.True(t, redelivered.Replayed)
+
+	pending, _ := deliveries.pending(defaultAppID, "billing-svc", "ack_stale.*", 10)
+	assert.Equal(t, []deliveryRef{{"ack_stale.b", redelivered.ID}}, pending)
+}
+
+// Test that expired, old acked and pruned deliveries are removed
+func TestDeliveryPurge(t *testing.T) {
+	withDeliveryStore(t)
+	defer func(ttl time.Duration) { memoryHistoryTTL = ttl }(memoryHistoryTTL)
+	memoryHistoryTTL = 0
+	now := time.Now()
+	past := now.Add(-time.Second)
+	deliveries.track(defaultAppID, deliveryRef{"purge", 1}, &past, []string{"a"}, now)
+	deliveries.track(defaultAppID, deliveryRef{"purge", 2}, nil, []string{"a"}, now.Add(-2*ackRetention))
+	deliveries.track(defaultAppID, deliveryRef{"purge", 3}, nil, []string{"a"}, now.Add(-2*ackRetention))
+	deliveries.track(defaultAppID, deliveryRef{"purge", 4}, nil, []string{"a"}, now)
+	deliveries.ack(defaultAppID, "a", deliveryRef{"purge", 2}, now)
+
+	purged, err := deliveries.purge(now)
+	assert.NoError(t, err)
+	assert.Equal(t, int64(2), purged)
+	pending, _ := deliveries.pending(defaultAppID, "a", "purge", 10)
+	assert.Equal(t, []deliveryRef{{"purge", 3}, {"purge", 4}}, pending)
+
+	pruned, err := deliveries.pruneChannel(defaultAppID, "purge", now.Add(-time.Hour))
+	assert.NoError(t, err)
+	assert.Equal(t, int64(1), pruned)
+}
+
+// Test that pending deliveries outlive the memory buffer TTL when notifications are stored durably
+func TestDeliveryPurgeDurableStorage(t *testing.T) {
+	withDeliveryStore(t)
+	now := time.Now()
+	old := now.Add(-2 * memoryHistoryTTL)
+	deliveries.track(defaultAppID, deliveryRef{"durable", 1}, nil, []string{"a"}, old)
+
+	withSQLiteStorage(t)
+	purged, err := deliveries.purge(now)
+	assert.NoError(t, err)
+	assert.Zero(t, purged)
+
+	storage = memoryHistory
+	purged, err = deliveries.purge(now)
+	assert.NoError(t, err)
+	assert.Equal(t, int64(1), purged)
+}
@@ -0,0 +1,223 @@
+package main
+
+import (
+	"crypto/hmac"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Every connection, notification and stored channel belongs to an app. Without
+// an app registry there is a single default app using validCredentials, whose
+// channels keep their historical unprefixed table names.
+const defaultAppID = "default"
+
+// Close code sent when an app has reached its connection limit.
+const closeOverQuota = 4004
+
+// App is a tenant with its own credentials, channel namespace and limits.
+type App struct {
+	ID                  string   `json:"id"`
+	Key                 string   `json:"key"`
+	Secret              string   `json:"secret"`
+	AllowedOrigins      []string `json:"allowed_origins"`        // empty allows any origin
+	MaxConnections      int      `json:"max_connections"`        // 0 means unlimited
+	MaxPublishPerSecond int      `json:"max_publish_per_second"` // 0 means unlimited
+
+	publishLock   sync.Mutex
+	publishBucket tokenBucket
+}
+
+type appRegistry struct {
+	mu    sync.RWMutex
+	byID  map[string]*App
+	byKey map[string]*App
+}
+
+var (
+	apps = newAppRegistry([]*App{{
+		ID:     defaultAppID,
+		Key:    validCredentials["key"],
+		Secret: validCredentials["secret"],
+	}})
+
+	// Active connections per app ID, guarded by msgLock
+	appConnections = make(map[string]int)
+)
+
+func newAppRegistry(list []*App) *appRegistry {
+	r := &appRegistry{byID: make(map[string]*App), byKey: make(map[string]*App)}
+	for _, app := range list {
+		r.byID[app.ID] = app
+		r.byKey[app.Key] = app
+	}
+	return r
+}
+
+// loadApps replaces the default app with the apps from APPS_FILE (a JSON array)
+// or, with APPS_SOURCE=db, from the ws_apps table.
+func loadApps() {
+	var list []*App
+	var err error
+
+	switch {
+	case os.Getenv("APPS_FILE") != "":
+		list, err = loadAppsFile(os.Getenv("APPS_FILE"))
+	case os.Getenv("APPS_SOURCE") == "db" && useDB:
+		list, err = loadAppsDB()
+	default:
+		return
+	}
+
+	if err == nil {
+		err = validateApps(list)
+	}
+	if err != nil {
+		log.Fatal("Failed to load apps: ", err)
+	}
+	if len(list) == 0 {
+		log.Println("App registry is empty, keeping the default app")
+		return
+	}
+
+	apps = newAppRegistry(list)
+	log.Println("Loaded apps:", len(list))
+}
+
+func loadAppsFile(path string) ([]*App, error) {
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var list []*App
+	if err := json.Unmarshal(content, &list); err != nil {
+		return nil, err
+	}
+	return list, nil
+}
+
+func loadAppsDB() ([]*App, error) {
+	_, err := dbConn.Exec(`CREATE TABLE IF NOT EXISTS ws_apps (
+		id TEXT PRIMARY KEY,
+		key TEXT UNIQUE NOT NULL,
+		secret TEXT NOT NULL,
+		allowed_origins TEXT NOT NULL DEFAULT '',
+		max_connections INTEGER NOT NULL DEFAULT 0,
+		max_publish_per_second INTEGER NOT NULL DEFAULT 0
+	)`)
+	if err != nil {
+		return nil, err
+	}
+
+	rows, err := dbConn.Query(`SELECT id, key, secret, allowed_origins, max_connections, max_publish_per_second FROM ws_apps`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	list := []*App{}
+	for rows.Next() {
+		app := &App{}
+		var origins string
+		if err := rows.Scan(&app.ID, &app.Key, &app.Secret, &origins, &app.MaxConnections, &app.MaxPublishPerSecond); err != nil {
+			return nil, err
+		}
+		if origins != "" {
+			app.AllowedOrigins = strings.Split(origins, ",")
+		}
+		list = append(list, app)
+	}
+	return list, rows.Err()
+}
+
+func validateApps(list []*App) error {
+	ids, keys := map[string]bool{}, map[string]bool{}
+	for _, app := range list {
+		if app.ID == "" || app.Key == "" || app.Secret == "" {
+			return errors.New("apps need an id, key and secret")
+		}
+		if !validName.MatchString(app.ID) {
+			return errors.New("app id may only contain letters, digits, '_' and '-': " + app.ID)
+		}
+		if len(app.ID) > maxStorageName-2 {
+			return fmt.Errorf("app id cannot be longer than %d bytes: %s", maxStorageName-2, app.ID)
+		}
+		if ids[app.ID] || keys[app.Key] {
+			return errors.New("duplicate app id or key: " + app.ID)
+		}
+		ids[app.ID], keys[app.Key] = true, true
+	}
+	return nil
+}
+
+func (r *appRegistry) get(id string) *App {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return r.byID[id]
+}
+
+func (r *appRegistry) lookupKey(key string) *App {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return r.byKey[key]
+}
+
+// authenticateApp returns the app owning the key if the secret matches.
+func (r *appRegistry) authenticateApp(key, secret string) *App {
+	app := r.lookupKey(key)
+	if app == nil || !hmac.Equal([]byte(secret), []byte(app.Secret)) {
+		return nil
+	}
+	return app
+}
+
+// appFromContext returns the app set by authenticate.
+func appFromContext(c *gin.Context) *App {
+	return c.MustGet("app").(*App)
+}
+
+// storageName is the table, history buffer and metrics name of an app channel.
+func storageName(appID, channel string) string {
+	if appID == defaultAppID {
+		return channel
+	}
+	return appID + ":" + channel
+}
+
+// allowsOrigin reports whether pages of origin may use the app. An app's
+// allowed_origins are granted in addition to ALLOWED_ORIGINS.
+func (app *App) allowsOrigin(origin string) bool {
+	return originAllowed(allowedOrigins, origin) || originAllowed(app.AllowedOrigins, origin)
+}
+
+// anyAllowsOrigin reports whether some app allows origin. Preflight requests
+// carry no app key, so they are answered for every app.
+func (r *appRegistry) anyAllowsOrigin(origin string) bool {
+	if originAllowed(allowedOrigins, origin) {
+		return true
+	}
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	for _, app := range r.byID {
+		if originAllowed(app.AllowedOrigins, origin) {
+			return true
+		}
+	}
+	return false
+}
+
+func (app *App) allowPublish(now time.Time) bool {
+	if app.MaxPublishPerSecond <= 0 {
+		return true
+	}
+	app.publishLock.Lock()
+	defer app.publishLock.Unlock()
+	return app.publishBucket.allow(now, float64(app.MaxPublishPerSecond))
+}
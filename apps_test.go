@@ -0,0 +1,153 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/stretchr/testify/assert"
+)
+
+// withApps swaps the app registry for the duration of a test.
+func withApps(t *testing.T, list ...*App) {
+	previous := apps
+	apps = newAppRegistry(list)
+	t.Cleanup(func() { apps = previous })
+}
+
+func dialApp(t *testing.T, server *httptest.Server, appKey string) (*websocket.Conn, *http.Response, error) {
+	url := "ws" + strings.TrimPrefix(server.URL, "http") + "/ws?app_key=" + appKey
+	return websocket.DefaultDialer.Dial(url, nil)
+}
+
+func publishAs(router http.Handler, key, secret string, notif Notification) int {
+	body, _ := json.Marshal(notif)
+	req, _ := http.NewRequest("POST", "/notification", bytes.NewBuffer(body))
+	req.Header.Set("key", key)
+	req.Header.Set("secret", secret)
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+	return w.Code
+}
+
+// Test app registry validation
+func TestValidateApps(t *testing.T) {
+	assert.NoError(t, validateApps([]*App{{ID: "a", Key: "ka", Secret: "sa"}, {ID: "b", Key: "kb", Secret: "sb"}}))
+	assert.Error(t, validateApps([]*App{{ID: "a", Key: "ka"}}))
+	assert.Error(t, validateApps([]*App{{ID: "a:b", Key: "ka", Secret: "sa"}}))
+	assert.Error(t, validateApps([]*App{{ID: `a"b`, Key: "ka", Secret: "sa"}}))
+	assert.Error(t, validateApps([]*App{{ID: "a", Key: "k", Secret: "s"}, {ID: "b", Key: "k", Secret: "s"}}))
+}
+
+// Test that storage names of the default app keep their legacy form
+func TestStorageName(t *testing.T) {
+	assert.Equal(t, "orders", storageName(defaultAppID, "orders"))
+	assert.Equal(t, "billing:orders", storageName("billing", "orders"))
+}
+
+// Test that apps cannot see each other's channels
+func TestAppChannelIsolation(t *testing.T) {
+	withApps(t, &App{ID: "shop", Key: "shop-key", Secret: "shop-secret"}, &App{ID: "blog", Key: "blog-key", Secret: "blog-secret"})
+	router := setupTestRouter()
+	server := httptest.NewServer(router)
+	defer server.Close()
+
+	conns := map[string]*websocket.Conn{}
+	for _, key := range []string{"shop-key", "blog-key"} {
+		conn, _, err := dialApp(t, server, key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer conn.Close()
+		conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+
+		var reply map[string]interface{}
+		assert.NoError(t, conn.ReadJSON(&reply))
+		assert.NoError(t, conn.WriteJSON(ControlFrame{Channel: "orders"}))
+		assert.NoError(t, conn.ReadJSON(&reply))
+		assert.Equal(t, "Subscribed to channel", reply["message"])
+		conns[key] = conn
+	}
+
+	assert.Equal(t, http.StatusOK, publishAs(router, "shop-key", "shop-secret", Notification{Channel: "orders", Event: "shop-order"}))
+	assert.Equal(t, http.StatusOK, publishAs(router, "blog-key", "blog-secret", Notification{Channel: "orders", Event: "blog-order"}))
+	assert.Equal(t, http.StatusUnauthorized, publishAs(router, "shop-key", "blog-secret", Notification{Channel: "orders"}))
+
+	var received Notification
+	assert.NoError(t, conns["shop-key"].ReadJSON(&received))
+	assert.Equal(t, "shop-order", received.Event)
+	assert.NoError(t, conns["blog-key"].ReadJSON(&received))
+	assert.Equal(t, "blog-order", received.Event)
+}
+
+// Test that history reads cannot reach internal tables or inject SQL through the channel
+func TestHistoryChannelValidation(t *testing.T) {
+	router := setupTestRouter()
+	for _, channel := range []string{"ws_apps", "WS_scheduled", `orders" WHERE 1=1; --`, "orders.*"} {
+		req, _ := http.NewRequest("GET", "/notifications?channel="+url.QueryEscape(channel), nil)
+		req.Header.Set("key", "key")
+		req.Header.Set("secret", "secret")
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+		assert.Equal(t, http.StatusBadRequest, w.Code, channel)
+
+		body, _ := json.Marshal(SearchRequest{Channel: channel})
+		req, _ = http.NewRequest("GET", "/search", bytes.NewBuffer(body))
+		req.Header.Set("key", "key")
+		req.Header.Set("secret", "secret")
+		w = httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+		assert.Equal(t, http.StatusBadRequest, w.Code, channel)
+	}
+}
+
+// Test per-app connection and origin limits
+func TestAppLimits(t *testing.T) {
+	withApps(t, &App{ID: "tiny", Key: "tiny-key", Secret: "tiny-secret", MaxConnections: 1, AllowedOrigins: []string{"https://tiny.example"}})
+	server := httptest.NewServer(setupTestRouter())
+	defer server.Close()
+
+	_, _, err := dialApp(t, server, "unknown-key")
+	assert.Error(t, err)
+
+	first, _, err := dialApp(t, server, "tiny-key")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer first.Close()
+	first.SetReadDeadline(time.Now().Add(5 * time.Second))
+	var reply map[string]interface{}
+	assert.NoError(t, first.ReadJSON(&reply))
+
+	second, _, err := dialApp(t, server, "tiny-key")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer second.Close()
+	second.SetReadDeadline(time.Now().Add(5 * time.Second))
+	_, _, err = second.ReadMessage()
+	assert.True(t, websocket.IsCloseError(err, closeOverQuota), "expected over quota close, got %v", err)
+
+	header := http.Header{"Origin": []string{"https://evil.example"}}
+	_, resp, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(server.URL, "http")+"/ws?app_key=tiny-key", header)
+	assert.Error(t, err)
+	if resp != nil {
+		assert.Equal(t, http.StatusForbidden, resp.StatusCode)
+	}
+}
+
+// Test the per-app publish rate limit
+func TestAppPublishRateLimit(t *testing.T) {
+	app := &App{MaxPublishPerSecond: 2}
+	now := time.Now()
+	assert.True(t, app.allowPublish(now))
+	assert.True(t, app.allowPublish(now))
+	assert.False(t, app.allowPublish(now))
+	assert.True(t, (&App{}).allowPublish(now))
+}
@@ -0,0 +1,316 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/lib/pq"
+)
+
+// Backplane carries published notifications to every server instance. Each
+// instance, including the publisher, hands every message to broadcastToApp
+// exactly once, so clients receive a notification whichever node they are on.
+type Backplane interface {
+	Name() string
+	Publish(msg BackplaneMessage) error
+	Subscribe(handler func(BackplaneMessage)) error
+	Close() error
+}
+
+// BackplaneMessage is a notification on its way to the local subscribers of each node.
+type BackplaneMessage struct {
+	AppID        string       `json:"app_id"`
+	Notification Notification `json:"notification"`
+
+	// Stored id of each copy of a notification published to several channels
+	ChannelIDs map[string]int64 `json:"channel_ids,omitempty"`
+
+	// Socket that produced a client event, which must not receive it back
+	ExceptSocketID string `json:"except_socket_id,omitempty"`
+
+	// Set instead of Notification for presence roster changes
+	Presence *presenceEvent `json:"presence,omitempty"`
+}
+
+var backplane Backplane
+
+// Set in init because presence events delivered by the backplane publish to it
+func init() {
+	backplane = newInProcessBackplane(deliverBackplaneMessage)
+}
+
+// initBackplane selects the backplane from BACKPLANE ("memory" or "postgres")
+// and starts delivering its messages to local subscribers.
+func initBackplane() {
+	switch kind := envString("BACKPLANE", "memory"); kind {
+	case "memory":
+	case "postgres":
+		if !useDB {
+			log.Println("BACKPLANE=postgres requires a database, using the in-process backplane")
+			break
+		}
+		pg, err := newPostgresBackplane(dbConnString, envString("BACKPLANE_CHANNEL", "websocket_notifications"))
+		if err != nil {
+			log.Println("Postgres backplane error, using the in-process backplane:", err)
+			break
+		}
+		if err := pg.Subscribe(deliverBackplaneMessage); err != nil {
+			log.Println("Postgres backplane error, using the in-process backplane:", err)
+			pg.Close()
+			break
+		}
+		backplane = pg
+		presenceSyncInterval = envDuration("PRESENCE_SYNC_INTERVAL", presenceSyncInterval)
+		startPresenceSync()
+	default:
+		log.Println("Unknown BACKPLANE, using the in-process backplane:", kind)
+	}
+
+	metricsLock.Lock()
+	metrics.ServerStats.Backplane = backplane.Name()
+	metricsLock.Unlock()
+	log.Println("Using backplane:", backplane.Name())
+}
+
+func deliverBackplaneMessage(msg BackplaneMessage) {
+	appID := msg.AppID
+	if appID == "" {
+		appID = defaultAppID
+	}
+	if msg.Presence != nil {
+		handlePresenceEvent(appID, *msg.Presence, msg.ExceptSocketID, time.Now())
+		return
+	}
+	broadcastToApp(appID, msg.Notification, msg.ChannelIDs, msg.ExceptSocketID)
+}
+
+// ------------------ In-process ------------------
+
+// inProcessBackplane delivers synchronously to handlers in the same process.
+// It is the default for single-instance deployments and lets tests attach
+// several simulated nodes to one bus.
+type inProcessBackplane struct {
+	mu       sync.RWMutex
+	handlers []func(BackplaneMessage)
+}
+
+func newInProcessBackplane(handlers ...func(BackplaneMessage)) *inProcessBackplane {
+	return &inProcessBackplane{handlers: handlers}
+}
+
+func (b *inProcessBackplane) Name() string { return "memory" }
+
+func (b *inProcessBackplane) Publish(msg BackplaneMessage) error {
+	b.mu.RLock()
+	handlers := b.handlers
+	b.mu.RUnlock()
+
+	for _, handler := range handlers {
+		handler(msg)
+	}
+	return nil
+}
+
+func (b *inProcessBackplane) Subscribe(handler func(BackplaneMessage)) error {
+	b.mu.Lock()
+	b.handlers = append(b.handlers, handler)
+	b.mu.Unlock()
+	return nil
+}
+
+func (b *inProcessBackplane) Close() error { return nil }
+
+// ------------------ Postgres LISTEN/NOTIFY ------------------
+
+// NOTIFY payloads are limited to 8000 bytes. Larger notifications that are
+// already stored are sent by reference and loaded from the channel table.
+const maxNotifyPayload = 7900
+
+type postgresBackplane struct {
+	listener *pq.Listener
+	channel  string
+
+	// When the listener lost its connection, zero while connected
+	gapLock        sync.Mutex
+	disconnectedAt time.Time
+}
+
+// Notifications stored this long before the listener noticed the lost
+// connection are delivered again after it reconnects.
+const backplaneGapMargin = 10 * time.Second
+
+// notifyReference replaces a notification too large for a NOTIFY payload.
+type notifyReference struct {
+	AppID          string `json:"app_id"`
+	Channel        string `json:"channel"`
+	ID             int64  `json:"id"`
+	ExceptSocketID string `json:"except_socket_id,omitempty"`
+
+	Channels   []string         `json:"channels,omitempty"`
+	ChannelIDs map[string]int64 `json:"channel_ids,omitempty"`
+}
+
+func newPostgresBackplane(connString, channel string) (*postgresBackplane, error) {
+	b := &postgresBackplane{channel: channel}
+	b.listener = pq.NewListener(connString, 10*time.Second, time.Minute, func(event pq.ListenerEventType, err error) {
+		if err != nil {
+			log.Println("Backplane listener error:", err)
+		}
+		switch event {
+		case pq.ListenerEventDisconnected:
+			b.gapLock.Lock()
+			if b.disconnectedAt.IsZero() {
+				b.disconnectedAt = time.Now()
+			}
+			b.gapLock.Unlock()
+		case pq.ListenerEventReconnected:
+			log.Println("Backplane listener reconnected")
+		}
+	})
+	if err := b.listener.Listen(channel); err != nil {
+		b.listener.Close()
+		return nil, err
+	}
+	return b, nil
+}
+
+func (b *postgresBackplane) Name() string { return "postgres" }
+
+func (b *postgresBackplane) Publish(msg BackplaneMessage) error {
+	payload, err := json.Marshal(msg)
+	if err != nil {
+		return err
+	}
+
+	if len(payload) > maxNotifyPayload {
+		if msg.Notification.ID == 0 {
+			return errors.New("notification too large for the backplane")
+		}
+		payload, err = json.Marshal(gin.H{"ref": notifyReference{
+			AppID:          msg.AppID,
+			Channel:        msg.Notification.Channel,
+			ID:             msg.Notification.ID,
+			ExceptSocketID: msg.ExceptSocketID,
+			Channels:       msg.Notification.Channels,
+			ChannelIDs:     msg.ChannelIDs,
+		}})
+		if err != nil {
+			return err
+		}
+	}
+
+	_, err = dbConn.Exec("SELECT pg_notify($1, $2)", b.channel, string(payload))
+	return err
+}
+
+func (b *postgresBackplane) Subscribe(handler func(BackplaneMessage)) error {
+	go func() {
+		for n := range b.listener.Notify {
+			// A nil notification signals a reconnect; NOTIFY does not queue
+			// anything sent meanwhile, so it is loaded from storage instead
+			if n == nil {
+				b.gapLock.Lock()
+				since := b.disconnectedAt
+				b.disconnectedAt = time.Time{}
+				b.gapLock.Unlock()
+				if !since.IsZero() {
+					replayBackplaneGap(since.Add(-backplaneGapMargin))
+				}
+				requestPresenceSync()
+				continue
+			}
+			msg, err := b.decode(n.Extra)
+			if err != nil {
+				log.Println("Invalid backplane message:", err)
+				continue
+			}
+			handler(msg)
+		}
+	}()
+	return nil
+}
+
+// replayBackplaneGap delivers the notifications stored since the given time
+// to the local subscribers, marked as replayed. Some may have been received
+// before the connection was lost, so clients deduplicate them by id. Only a
+// store shared by the instances holds what the others published meanwhile.
+func replayBackplaneGap(since time.Time) {
+	patterns := map[string][]string{} // app -> subscribed patterns
+	msgLock.Lock()
+	for _, client := range clients {
+		for pattern := range client.channels {
+			patterns[client.app.ID] = append(patterns[client.app.ID], pattern)
+		}
+	}
+	msgLock.Unlock()
+
+	names, err := storage.channels()
+	if err != nil {
+		log.Println("Failed to replay the backplane gap:", err)
+		return
+	}
+	for _, name := range names {
+		appID, channel := appFromStorageName(name), channelFromStorageName(name)
+		if !coveredByAny(patterns[appID], channel) {
+			continue
+		}
+		history, err := loadHistory(appID, channel, 0, since, replayLimit)
+		if err != nil {
+			log.Println("Failed to replay the backplane gap:", err)
+			continue
+		}
+		if len(history) == replayLimit {
+			log.Println("Backplane gap exceeds WS_REPLAY_LIMIT, clients must page with since_id:", name)
+		}
+		for _, notif := range history {
+			notif.Replayed = true
+			broadcastToApp(appID, notif, nil, "")
+		}
+	}
+}
+
+func coveredByAny(patterns []string, channel string) bool {
+	for _, pattern := range patterns {
+		if patternCovers(pattern, channel) {
+			return true
+		}
+	}
+	return false
+}
+
+func (b *postgresBackplane) decode(payload string) (BackplaneMessage, error) {
+	var envelope struct {
+		BackplaneMessage
+		Ref *notifyReference `json:"ref"`
+	}
+	if err := json.Unmarshal([]byte(payload), &envelope); err != nil {
+		return BackplaneMessage{}, err
+	}
+	if envelope.Ref == nil {
+		return envelope.BackplaneMessage, nil
+	}
+
+	history, err := loadHistory(envelope.Ref.AppID, envelope.Ref.Channel, envelope.Ref.ID-1, time.Time{}, 1)
+	if err != nil {
+		return BackplaneMessage{}, err
+	}
+	if len(history) == 0 || history[0].ID != envelope.Ref.ID {
+		return BackplaneMessage{}, errors.New("referenced notification not found")
+	}
+	notif := history[0]
+	notif.Channels = envelope.Ref.Channels
+	return BackplaneMessage{
+		AppID:          envelope.Ref.AppID,
+		Notification:   notif,
+		ChannelIDs:     envelope.Ref.ChannelIDs,
+		ExceptSocketID: envelope.Ref.ExceptSocketID,
+	}, nil
+}
+
+func (b *postgresBackplane) Close() error {
+	return b.listener.Close()
+}
@@ -0,0 +1,82 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// Test that every node attached to the bus receives each message once
+func TestInProcessBackplaneFanOut(t *testing.T) {
+	bus := newInProcessBackplane()
+	var mu sync.Mutex
+	received := map[string][]int64{}
+	for _, node := range []string{"node-a", "node-b"} {
+		node := node
+		bus.Subscribe(func(msg BackplaneMessage) {
+			mu.Lock()
+			received[node] = append(received[node], msg.Notification.ID)
+			mu.Unlock()
+		})
+	}
+
+	assert.NoError(t, bus.Publish(BackplaneMessage{Notification: Notification{ID: 1, Channel: "orders"}}))
+	assert.NoError(t, bus.Publish(BackplaneMessage{Notification: Notification{ID: 2, Channel: "orders"}}))
+
+	assert.Equal(t, map[string][]int64{"node-a": {1, 2}, "node-b": {1, 2}}, received)
+}
+
+// Test that sendNotification publishes through the backplane
+func TestSendNotificationUsesBackplane(t *testing.T) {
+	defer func(b Backplane) { backplane = b }(backplane)
+	var published []BackplaneMessage
+	bus := newInProcessBackplane(func(msg BackplaneMessage) { published = append(published, msg) })
+	backplane = bus
+
+	body, _ := json.Marshal(Notification{Channel: "backplane_channel", Event: "created"})
+	req, _ := http.NewRequest("POST", "/notification", bytes.NewBuffer(body))
+	req.Header.Set("key", "key")
+	req.Header.Set("secret", "secret")
+	w := httptest.NewRecorder()
+	setupTestRouter().ServeHTTP(w, req)
+
+	assert.Equal(t, http.StatusOK, w.Code)
+	if assert.Len(t, published, 1) {
+		assert.Equal(t, "backplane_channel", published[0].Notification.Channel)
+		assert.Empty(t, published[0].ExceptSocketID)
+	}
+}
+
+// Test decoding an inline LISTEN/NOTIFY payload
+func TestPostgresBackplaneDecode(t *testing.T) {
+	payload, _ := json.Marshal(BackplaneMessage{
+		Notification:   Notification{ID: 3, Channel: "orders", Event: "created"},
+		ExceptSocketID: "1.2",
+	})
+
+	msg, err := (&postgresBackplane{}).decode(string(payload))
+	assert.NoError(t, err)
+	assert.Equal(t, int64(3), msg.Notification.ID)
+	assert.Equal(t, "orders", msg.Notification.Channel)
+	assert.Equal(t, "1.2", msg.ExceptSocketID)
+}
+
+// failingBackplane rejects every message.
+type failingBackplane struct{}
+
+func (failingBackplane) Name() string                           { return "failing" }
+func (failingBackplane) Publish(BackplaneMessage) error         { return errors.New("backplane down") }
+func (failingBackplane) Subscribe(func(BackplaneMessage)) error { return nil }
+func (failingBackplane) Close() error                           { return nil }
+
+func withFailingBackplane(t *testing.T) {
+	previous := backplane
+	backplane = failingBackplane{}
+	t.Cleanup(func() { backplane = previous })
+}
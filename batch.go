@@ -0,0 +1,147 @@
+package main
+
+import (
+	"log"
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Maximum number of notifications accepted by one batch request
+var batchMaxSize = 100
+
+type batchResult struct {
+	Index   int    `json:"index"`
+	Channel string `json:"channel"`
+	Success bool   `json:"success"`
+	ID      int64  `json:"id,omitempty"`
+	Error   string `json:"error,omitempty"`
+
+	// Stored id per channel, for notifications with several channels
+	IDs map[string]int64 `json:"ids,omitempty"`
+}
+
+func loadBatchConfig() {
+	batchMaxSize = envInt("BATCH_MAX_SIZE", batchMaxSize)
+}
+
+// sendNotificationBatch publishes an array of notifications. Valid items are
+// stored in one transaction and broadcast in request order; every item gets
+// its own result so a rejected item does not hide the others.
+func sendNotificationBatch(c *gin.Context) {
+	app := appFromContext(c)
+
+	var batch []Notification
+	if err := c.ShouldBindJSON(&batch); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid input"})
+		return
+	}
+	if len(batch) == 0 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Batch is empty"})
+		return
+	}
+	if len(batch) > batchMaxSize {
+		c.JSON(http.StatusRequestEntityTooLarge, gin.H{"error": "Batch too large", "max": batchMaxSize})
+		return
+	}
+
+	subject := subjectFromContext(c)
+	results := make([]batchResult, len(batch))
+	accepted := []int{}
+	now := serverTimestamp()
+	for i := range batch {
+		notif := &batch[i]
+		notif.ID = 0
+		notif.Timestamp = now
+		notif.Replayed = false
+		notif.IdempotencyKey = ""
+		targets := setNotificationTargets(notif)
+		results[i] = batchResult{Index: i, Channel: notif.Channel}
+
+		expiresAt, ttlErr := notificationExpiry(*notif, now)
+		notif.ExpiresAt, notif.TTL = expiresAt, ""
+
+		if err := checkBatchTargets(app.ID, subject, targets); err != "" {
+			results[i].Error = err
+		} else if notif.DeliverAt != nil || notif.Delay != "" {
+			results[i].Error = "Scheduling is not supported in batches"
+		} else if ttlErr != nil {
+			results[i].Error = ttlErr.Error()
+		} else if !app.allowPublish(now) {
+			results[i].Error = "Publish rate limit exceeded"
+		} else {
+			accepted = append(accepted, i)
+		}
+	}
+
+	items := make([]*Notification, len(accepted))
+	for j, i := range accepted {
+		items[j] = &batch[i]
+	}
+	ids, errs, err := storage.saveBatch(app.ID, items)
+	if err != nil {
+		log.Println("Failed to save notification batch:", err)
+	}
+	for j, i := range accepted {
+		switch {
+		case errs[j] != nil:
+			results[i].Error = "Failed to save to DB: " + errs[j].Error()
+		case err != nil:
+			// Nothing was stored
+			results[i].Error = "Failed to save to DB: " + err.Error()
+		default:
+			results[i].IDs = ids[j]
+			results[i].Success = true
+		}
+	}
+
+	// Broadcast ke client sesuai urutan request
+	stored, failed := 0, 0
+	for i := range batch {
+		if results[i].Success {
+			stored++
+			trackDeliveries(app.ID, batch[i], results[i].IDs)
+			if err := backplane.Publish(BackplaneMessage{AppID: app.ID, Notification: batch[i], ChannelIDs: results[i].IDs}); err != nil {
+				results[i].Success = false
+				results[i].Error = "Failed to publish notification"
+			}
+			results[i].ID = batch[i].ID
+			if len(batch[i].Channels) == 0 {
+				results[i].IDs = nil
+			}
+		}
+		if !results[i].Success {
+			failed++
+		}
+	}
+
+	// Nothing accepted could be stored, which a retry may fix, so the
+	// idempotency key is released
+	status := http.StatusOK
+	if len(accepted) > 0 && stored == 0 {
+		status = http.StatusServiceUnavailable
+	}
+	c.JSON(status, gin.H{
+		"success":   failed == 0,
+		"published": len(batch) - failed,
+		"failed":    failed,
+		"results":   results,
+	})
+}
+
+// checkBatchTargets validates the channels of one item and returns the error
+// to report for it, if any.
+func checkBatchTargets(appID string, subject policySubject, targets []string) string {
+	if len(targets) == 0 {
+		return "Invalid channel"
+	}
+	for _, channel := range targets {
+		if validateAppChannel(appID, channel) != nil {
+			return "Invalid channel: " + channel
+		}
+		if !authorize(subject, actionPublish, channel).Allowed {
+			return "Forbidden by policy: " + channel
+		}
+	}
+	return ""
+}
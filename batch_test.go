@@ -0,0 +1,122 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func postBatch(router http.Handler, batch interface{}) *httptest.ResponseRecorder {
+	body, _ := json.Marshal(batch)
+	req, _ := http.NewRequest("POST", "/notification/batch", bytes.NewBuffer(body))
+	req.Header.Set("key", "key")
+	req.Header.Set("secret", "secret")
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+	return w
+}
+
+// Test that a batch is broadcast in order with per-item results
+func TestBatchPublish(t *testing.T) {
+	router := setupTestRouter()
+	server := httptest.NewServer(router)
+	defer server.Close()
+
+	conn, _ := dialTestWebSocket(t, server)
+	defer conn.Close()
+
+	var ack map[string]interface{}
+	assert.NoError(t, conn.WriteJSON(ControlFrame{Action: "subscribe", Channel: "batch.#"}))
+	assert.NoError(t, conn.ReadJSON(&ack))
+
+	w := postBatch(router, []Notification{
+		{Channel: "batch.orders", Event: "first"},
+		{Channel: "batch.*", Event: "invalid"},
+		{Channel: "batch.invoices", Event: "second"},
+		{Channel: "batch.orders", Event: "third"},
+	})
+	assert.Equal(t, http.StatusOK, w.Code)
+
+	var resp struct {
+		Success   bool          `json:"success"`
+		Published int           `json:"published"`
+		Failed    int           `json:"failed"`
+		Results   []batchResult `json:"results"`
+	}
+	assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &resp))
+	assert.False(t, resp.Success)
+	assert.Equal(t, 3, resp.Published)
+	assert.Equal(t, 1, resp.Failed)
+	if assert.Len(t, resp.Results, 4) {
+		assert.True(t, resp.Results[0].Success)
+		assert.False(t, resp.Results[1].Success)
+		assert.Equal(t, "Invalid channel: batch.*", resp.Results[1].Error)
+		assert.True(t, resp.Results[2].Success)
+		assert.NotZero(t, resp.Results[3].ID)
+	}
+
+	for _, event := range []string{"first", "second", "third"} {
+		var received Notification
+		assert.NoError(t, conn.ReadJSON(&received))
+		assert.Equal(t, event, received.Event)
+	}
+}
+
+// Test rejected batches
+func TestBatchPublishInvalid(t *testing.T) {
+	router := setupTestRouter()
+
+	assert.Equal(t, http.StatusBadRequest, postBatch(router, []Notification{}).Code)
+	assert.Equal(t, http.StatusBadRequest, postBatch(router, Notification{Channel: "batch.orders"}).Code)
+
+	previous := batchMaxSize
+	batchMaxSize = 2
+	defer func() { batchMaxSize = previous }()
+	batch := []Notification{{Channel: "a"}, {Channel: "b"}, {Channel: "c"}}
+	assert.Equal(t, http.StatusRequestEntityTooLarge, postBatch(router, batch).Code)
+}
+
+// Test that a failed savepoint release fails the batch instead of reporting success
+func TestBatchReleaseFailure(t *testing.T) {
+	store := withSQLiteStorage(t)
+	router := setupTestRouter()
+
+	// Release the savepoint behind saveBatch's back, so its own RELEASE fails
+	insert := store.insertRow
+	store.insertRow = func(q queryer, channel string, notif Notification) (int64, error) {
+		if notif.Event == "release" {
+			if _, err := q.Exec("RELEASE SAVEPOINT batch_item"); err != nil {
+				return 0, err
+			}
+		}
+		return insert(q, channel, notif)
+	}
+
+	w := postBatch(router, []Notification{
+		{Channel: "batch.orders", Event: "first"},
+		{Channel: "batch.*", Event: "invalid"},
+		{Channel: "batch.orders", Event: "release"},
+	})
+	assert.Equal(t, http.StatusServiceUnavailable, w.Code)
+
+	var resp struct {
+		Failed  int           `json:"failed"`
+		Results []batchResult `json:"results"`
+	}
+	assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &resp))
+	assert.Equal(t, 3, resp.Failed)
+	if assert.Len(t, resp.Results, 3) {
+		assert.Contains(t, resp.Results[0].Error, "Failed to save to DB")
+		assert.Equal(t, "Invalid channel: batch.*", resp.Results[1].Error)
+		assert.Contains(t, resp.Results[2].Error, "Failed to save to DB")
+	}
+
+	history, err := loadHistory(defaultAppID, "batch.orders", 0, time.Time{}, 10)
+	assert.NoError(t, err)
+	assert.Empty(t, history)
+}
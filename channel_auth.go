@@ -0,0 +1,57 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"strings"
+)
+
+// Channels starting with this prefix can only be subscribed to with a signature
+// issued by the application backend.
+const privateChannelPrefix = "private-"
+
+func isPrivateChannel(channel string) bool {
+	return strings.HasPrefix(channel, privateChannelPrefix)
+}
+
+// requiresChannelAuth reports whether subscribing to the channel needs a signature.
+func requiresChannelAuth(channel string) bool {
+	return isPrivateChannel(channel) || isPresenceChannel(channel)
+}
+
+// newSocketID returns a random identifier in the "1234.5678" form used by
+// Pusher-compatible clients. Backends sign it together with the channel name.
+func newSocketID() string {
+	var b [8]byte
+	if _, err := rand.Read(b[:]); err != nil {
+		panic(err)
+	}
+	return fmt.Sprintf("%d.%d", binary.BigEndian.Uint32(b[:4]), binary.BigEndian.Uint32(b[4:]))
+}
+
+// channelSignature signs "<socket_id>:<channel>" with the app secret. Presence
+// subscriptions also sign their channel data: "<socket_id>:<channel>:<channel_data>".
+func channelSignature(secret, socketID, channel, channelData string) string {
+	message := socketID + ":" + channel
+	if channelData != "" {
+		message += ":" + channelData
+	}
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(message))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// verifyChannelAuth checks an auth string of the form "<key>:<signature>"
+// against the connection's app, socket ID, the requested channel and its channel data.
+func verifyChannelAuth(app *App, socketID, channel, channelData, auth string) bool {
+	key, signature, ok := strings.Cut(auth, ":")
+	if !ok || key != app.Key {
+		return false
+	}
+	expected := channelSignature(app.Secret, socketID, channel, channelData)
+	return hmac.Equal([]byte(signature), []byte(expected))
+}
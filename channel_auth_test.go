@@ -0,0 +1,54 @@
+package main
+
+import (
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// Test verification of private channel signatures
+func TestVerifyChannelAuth(t *testing.T) {
+	signature := channelSignature(validCredentials["secret"], "123.456", "private-orders", "")
+
+	assert.True(t, verifyChannelAuth(apps.get(defaultAppID), "123.456", "private-orders", "", "key:"+signature))
+	assert.False(t, verifyChannelAuth(apps.get(defaultAppID), "123.457", "private-orders", "", "key:"+signature))
+	assert.False(t, verifyChannelAuth(apps.get(defaultAppID), "123.456", "private-billing", "", "key:"+signature))
+	assert.False(t, verifyChannelAuth(apps.get(defaultAppID), "123.456", "private-orders", "", "other:"+signature))
+	assert.False(t, verifyChannelAuth(apps.get(defaultAppID), "123.456", "private-orders", "", signature))
+}
+
+// Test subscribing to a private channel over WebSocket
+func TestPrivateChannelSubscription(t *testing.T) {
+	server := httptest.NewServer(setupTestRouter())
+	defer server.Close()
+
+	conn, socketID := dialTestWebSocket(t, server)
+	defer conn.Close()
+
+	var reply map[string]interface{}
+	assert.NoError(t, conn.WriteJSON(ControlFrame{Channel: "private-orders"}))
+	assert.NoError(t, conn.ReadJSON(&reply))
+	assert.Equal(t, "Invalid channel signature", reply["error"])
+
+	auth := "key:" + channelSignature(validCredentials["secret"], socketID, "private-orders", "")
+	assert.NoError(t, conn.WriteJSON(ControlFrame{Channel: "private-orders", Auth: auth}))
+	assert.NoError(t, conn.ReadJSON(&reply))
+	assert.Equal(t, "Subscribed to channel", reply["message"])
+
+	broadcastToApp(defaultAppID, Notification{Channel: "private-orders", Event: "created"}, nil, "")
+	var received Notification
+	assert.NoError(t, conn.ReadJSON(&received))
+	assert.Equal(t, "private-orders", received.Channel)
+}
+
+// Test that leading wildcards never match private channels
+func TestWildcardSkipsPrivateChannels(t *testing.T) {
+	trie := newSubscriptionTrie()
+	everything, signed := &Client{}, &Client{}
+	trie.add("#", everything)
+	trie.add("private-orders.#", signed)
+
+	assert.Equal(t, map[*Client]bool{signed: true}, trie.match("private-orders.created"))
+	assert.Equal(t, map[*Client]bool{everything: true}, trie.match("orders.created"))
+}
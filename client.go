@@ -0,0 +1,338 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// Overflow policies applied when a client's send queue is full.
+const (
+	overflowDropOldest = "drop_oldest"
+	overflowDropNewest = "drop_newest"
+	overflowDisconnect = "disconnect"
+)
+
+// Time allowed to write a single message to a client.
+const writeWait = 10 * time.Second
+
+var (
+	sendQueueSize  = 256
+	overflowPolicy = overflowDropOldest
+
+	// Heartbeats: the server pings every pingInterval and expects some traffic
+	// (usually the pong) within pongWait. The reaper removes connections that
+	// have been silent for longer than idleTimeout.
+	pingInterval = 30 * time.Second
+	pongWait     = 60 * time.Second
+	idleTimeout  = 90 * time.Second
+)
+
+// Client is a WebSocket connection with its own writer goroutine. Everything
+// sent to the connection goes through the bounded send queue so a slow reader
+// never blocks broadcastToApp.
+type Client struct {
+	conn     *websocket.Conn
+	app      *App
+	socketID string
+	channels map[string]bool   // subscribed patterns, guarded by msgLock
+	presence map[string]string // presence channel -> user ID, guarded by msgLock
+
+	// Live messages held back while history is replayed, guarded by msgLock
+	replaying map[string][]outboundMessage
+
+	send      chan outboundMessage
+	queueLock sync.Mutex
+	closed    bool
+	// Close frame sent by the writer instead of a normal closure, set before send is closed
+	closeCode   int
+	closeReason string
+
+	lastSeen int64 // unix nanoseconds of the last frame read, accessed atomically
+
+	// Client event rate limiting, only used by the read loop
+	eventBucket tokenBucket
+
+	// JWT claims and the expiry or auth timeout timer, only used by the read loop
+	claims    map[string]interface{}
+	authTimer *time.Timer
+
+	// Durable consumer acknowledging deliveries, only used by the read loop
+	consumer string
+}
+
+type outboundMessage struct {
+	channel string // notification channel, empty for control replies
+	id      int64  // notification id, zero when not persisted
+	payload []byte
+}
+
+// loadClientConfig reads the send queue settings from the environment.
+func loadClientConfig() {
+	sendQueueSize = envInt("WS_SEND_QUEUE_SIZE", sendQueueSize)
+
+	switch policy := envString("WS_OVERFLOW_POLICY", overflowPolicy); policy {
+	case overflowDropOldest, overflowDropNewest, overflowDisconnect:
+		overflowPolicy = policy
+	default:
+		log.Println("Unknown WS_OVERFLOW_POLICY, using", overflowPolicy+":", policy)
+	}
+
+	pingInterval = envDuration("WS_PING_INTERVAL", pingInterval)
+	pongWait = envDuration("WS_PONG_TIMEOUT", pongWait)
+	idleTimeout = envDuration("WS_IDLE_TIMEOUT", idleTimeout)
+	if pongWait <= pingInterval {
+		log.Println("WS_PONG_TIMEOUT must be longer than WS_PING_INTERVAL, using", 2*pingInterval)
+		pongWait = 2 * pingInterval
+	}
+
+	metricsLock.Lock()
+	metrics.WebSocketStats.SendQueueSize = sendQueueSize
+	metrics.WebSocketStats.OverflowPolicy = overflowPolicy
+	metricsLock.Unlock()
+}
+
+func newClient(conn *websocket.Conn, app *App) *Client {
+	cl := &Client{
+		conn:      conn,
+		app:       app,
+		socketID:  newSocketID(),
+		channels:  make(map[string]bool),
+		presence:  make(map[string]string),
+		replaying: make(map[string][]outboundMessage),
+		send:      make(chan outboundMessage, sendQueueSize),
+	}
+	cl.touch()
+	return cl
+}
+
+// touch records activity on the connection and extends its read deadline.
+func (cl *Client) touch() {
+	now := time.Now()
+	atomic.StoreInt64(&cl.lastSeen, now.UnixNano())
+	if cl.conn != nil {
+		cl.conn.SetReadDeadline(now.Add(pongWait))
+	}
+}
+
+// idleSince reports how long ago the last frame was read from the connection.
+func (cl *Client) idleSince(now time.Time) time.Duration {
+	return now.Sub(time.Unix(0, atomic.LoadInt64(&cl.lastSeen)))
+}
+
+// enqueue adds a message to the send queue without blocking, applying the
+// overflow policy when the queue is full. It reports whether the message was queued.
+func (cl *Client) enqueue(msg outboundMessage) bool {
+	cl.queueLock.Lock()
+	defer cl.queueLock.Unlock()
+
+	if cl.closed {
+		return false
+	}
+
+	select {
+	case cl.send <- msg:
+		return true
+	default:
+	}
+
+	switch overflowPolicy {
+	case overflowDropNewest:
+		recordDropped()
+		return false
+	case overflowDisconnect:
+		// Writing the close frame could block for writeWait, so it is left to
+		// the writer, which skips the messages still queued
+		cl.closeCode, cl.closeReason = websocket.CloseTryAgainLater, "send queue full"
+		cl.closeLocked()
+		for range cl.send {
+			recordDropped()
+		}
+
+		metricsLock.Lock()
+		metrics.WebSocketStats.SlowClientDisconnects++
+		metricsLock.Unlock()
+		return false
+	default:
+		// Only the writer consumes from the queue, so there is room after dropping one
+		select {
+		case <-cl.send:
+			recordDropped()
+		default:
+		}
+		cl.send <- msg
+		return true
+	}
+}
+
+// sendJSON queues a control reply for the client.
+func (cl *Client) sendJSON(v interface{}) error {
+	payload, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	cl.enqueue(outboundMessage{payload: payload})
+	return nil
+}
+
+// sendNotification queues a notification for the client alone.
+func (cl *Client) sendNotification(notif Notification) error {
+	payload, err := json.Marshal(notif)
+	if err != nil {
+		return err
+	}
+	cl.enqueue(outboundMessage{channel: notif.Channel, id: notif.ID, payload: payload})
+	return nil
+}
+
+// close stops the writer once the queued messages have been flushed.
+func (cl *Client) close() {
+	cl.queueLock.Lock()
+	defer cl.queueLock.Unlock()
+	cl.closeLocked()
+}
+
+func (cl *Client) closeLocked() {
+	if !cl.closed {
+		cl.closed = true
+		close(cl.send)
+	}
+}
+
+// writePump is the only goroutine that writes data frames to the connection.
+// It also sends the periodic pings that keep the read deadline alive.
+func (cl *Client) writePump() {
+	ticker := time.NewTicker(pingInterval)
+	defer func() {
+		ticker.Stop()
+		cl.conn.Close()
+	}()
+
+	for {
+		select {
+		case msg, ok := <-cl.send:
+			cl.conn.SetWriteDeadline(time.Now().Add(writeWait))
+			if !ok {
+				code, reason := websocket.CloseNormalClosure, ""
+				if cl.closeCode != 0 {
+					code, reason = cl.closeCode, cl.closeReason
+				}
+				cl.conn.WriteMessage(websocket.CloseMessage, websocket.FormatCloseMessage(code, reason))
+				return
+			}
+
+			err := cl.conn.WriteMessage(websocket.TextMessage, msg.payload)
+
+			if msg.channel != "" {
+				metricsLock.Lock()
+				if err != nil {
+					metrics.WebSocketStats.TotalMessagesFailed++
+				} else {
+					metrics.WebSocketStats.TotalMessagesSent++
+					metrics.WebSocketStats.MessagesByChannel[storageName(cl.app.ID, msg.channel)]++
+					metrics.WebSocketStats.MessagesByApp[cl.app.ID]++
+				}
+				metricsLock.Unlock()
+			}
+
+			if err != nil {
+				return
+			}
+		case <-ticker.C:
+			cl.conn.SetWriteDeadline(time.Now().Add(writeWait))
+			if err := cl.conn.WriteMessage(websocket.PingMessage, nil); err != nil {
+				return
+			}
+		}
+	}
+}
+
+// removeClient unregisters a connection. It reports whether the connection was
+// still registered, so the read loop and the reaper can both call it safely.
+func removeClient(conn *websocket.Conn) bool {
+	left := map[string]*presenceMember{}
+	msgLock.Lock()
+	client, ok := clients[conn]
+	if ok {
+		for pattern := range client.channels {
+			subscriptionsFor(client.app.ID).remove(pattern, client)
+			if member := presenceLeaveLocked(client, pattern); member != nil {
+				left[pattern] = member
+			}
+		}
+		delete(clients, conn)
+		appConnections[client.app.ID]--
+	}
+	active := len(clients)
+	msgLock.Unlock()
+
+	for channel, member := range left {
+		announcePresence(channel, "member_removed", *member, client)
+	}
+
+	if ok {
+		metricsLock.Lock()
+		metrics.WebSocketStats.ActiveConnections = active
+		metrics.WebSocketStats.ConnectionsByApp[client.app.ID]--
+		metricsLock.Unlock()
+	}
+	return ok
+}
+
+// reapStaleClients closes connections that have not sent anything, not even a
+// pong, within idleTimeout. It returns the number of connections removed.
+func reapStaleClients(now time.Time) int {
+	stale := []*Client{}
+	msgLock.Lock()
+	for _, client := range clients {
+		if client.idleSince(now) > idleTimeout {
+			stale = append(stale, client)
+		}
+	}
+	msgLock.Unlock()
+
+	reaped := 0
+	for _, client := range stale {
+		if removeClient(client.conn) {
+			client.close()
+			client.conn.Close()
+			reaped++
+		}
+	}
+
+	if reaped > 0 {
+		metricsLock.Lock()
+		metrics.WebSocketStats.StaleConnectionsReaped += reaped
+		metricsLock.Unlock()
+	}
+	return reaped
+}
+
+// startReaper periodically removes dead connections left behind by half-open TCP sessions.
+func startReaper() {
+	go func() {
+		ticker := time.NewTicker(pingInterval)
+		defer ticker.Stop()
+		for now := range ticker.C {
+			if n := reapStaleClients(now); n > 0 {
+				log.Println("Reaped stale WebSocket connections:", n)
+			}
+		}
+	}()
+}
+
+// closeConnection sends a close frame with the given code and drops the connection.
+func closeConnection(conn *websocket.Conn, code int, reason string) {
+	conn.WriteControl(websocket.CloseMessage, websocket.FormatCloseMessage(code, reason), time.Now().Add(writeWait))
+	conn.Close()
+}
+
+func recordDropped() {
+	metricsLock.Lock()
+	metrics.WebSocketStats.TotalMessagesDropped++
+	metricsLock.Unlock()
+}
@@ -0,0 +1,120 @@
+package main
+
+import (
+	"log"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Client events are sent by subscribers of private and presence channels and
+// relayed to the other subscribers of the same channel.
+const clientEventPrefix = "client-"
+
+var (
+	clientEventRate      = 10.0 // events per second per connection, also the burst size
+	clientEventMaxFields = 20   // top-level fields of the data of a client event
+	persistClientEvents  = false
+)
+
+func loadClientEventConfig() {
+	clientEventRate = float64(envInt("WS_CLIENT_EVENT_RATE", int(clientEventRate)))
+	clientEventMaxFields = envInt("WS_CLIENT_EVENT_MAX_FIELDS", clientEventMaxFields)
+	persistClientEvents = envBool("WS_PERSIST_CLIENT_EVENTS", persistClientEvents)
+
+	// Channel tables get a column per data field, which clients must not control
+	if _, tables := storage.(*tableStore); persistClientEvents && tables {
+		log.Println("WS_PERSIST_CLIENT_EVENTS needs STORAGE_MODE=jsonb or another storage backend, client events are not stored")
+		persistClientEvents = false
+	}
+}
+
+func isClientEvent(event string) bool {
+	return strings.HasPrefix(event, clientEventPrefix)
+}
+
+// tokenBucket allows bursts of up to rate events, refilled at rate per second.
+type tokenBucket struct {
+	tokens float64
+	last   time.Time
+}
+
+func (b *tokenBucket) allow(now time.Time, rate float64) bool {
+	if b.last.IsZero() {
+		b.tokens = rate
+	} else {
+		b.tokens += now.Sub(b.last).Seconds() * rate
+		if b.tokens > rate {
+			b.tokens = rate
+		}
+	}
+	b.last = now
+
+	if b.tokens < 1 {
+		return false
+	}
+	b.tokens--
+	return true
+}
+
+// allowClientEvent is only called from the connection's read loop, so the
+// bucket needs no locking.
+func (cl *Client) allowClientEvent(now time.Time) bool {
+	return cl.eventBucket.allow(now, clientEventRate)
+}
+
+// handleClientEvent relays a client-* event to the other subscribers of the channel.
+func handleClientEvent(client *Client, frame ControlFrame) {
+	if !requiresChannelAuth(frame.Channel) {
+		client.sendJSON(gin.H{"error": "Client events are only allowed on private and presence channels", "channel": frame.Channel})
+		return
+	}
+
+	msgLock.Lock()
+	subscribed := client.channels[frame.Channel]
+	msgLock.Unlock()
+	if !subscribed || isPattern(frame.Channel) {
+		client.sendJSON(gin.H{"error": "Not subscribed to channel", "channel": frame.Channel})
+		return
+	}
+
+	if !authorize(client.subject(), actionPublish, frame.Channel).Allowed {
+		client.sendJSON(gin.H{"error": "Forbidden by policy", "channel": frame.Channel})
+		return
+	}
+
+	if len(frame.Data) > clientEventMaxFields {
+		client.sendJSON(gin.H{"error": "Client event data has too many fields", "channel": frame.Channel, "max": clientEventMaxFields})
+		return
+	}
+
+	if !client.allowClientEvent(time.Now()) {
+		metricsLock.Lock()
+		metrics.WebSocketStats.ClientEventsRateLimited++
+		metricsLock.Unlock()
+		client.sendJSON(gin.H{"error": "Client event rate limit exceeded", "channel": frame.Channel})
+		return
+	}
+
+	notif := Notification{Channel: frame.Channel, Event: frame.Event, Data: frame.Data, Timestamp: serverTimestamp()}
+	notif.ExpiresAt, _ = notificationExpiry(notif, notif.Timestamp)
+	if persistClientEvents {
+		id, err := storage.save(storageName(client.app.ID, frame.Channel), notif)
+		if err != nil {
+			log.Println("Failed to save client event:", err)
+		}
+		notif.ID = id
+	}
+
+	msg := BackplaneMessage{AppID: client.app.ID, Notification: notif, ExceptSocketID: client.socketID}
+	if err := backplane.Publish(msg); err != nil {
+		log.Println("Failed to publish client event:", err)
+		client.sendJSON(gin.H{"error": "Failed to publish client event", "channel": frame.Channel})
+		return
+	}
+
+	metricsLock.Lock()
+	metrics.WebSocketStats.ClientEventsRelayed++
+	metricsLock.Unlock()
+}
@@ -0,0 +1,91 @@
+package main
+
+import (
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// Test the client event token bucket
+func TestAllowClientEvent(t *testing.T) {
+	defer func(rate float64) { clientEventRate = rate }(clientEventRate)
+	clientEventRate = 2
+
+	cl := &Client{}
+	now := time.Now()
+	assert.True(t, cl.allowClientEvent(now))
+	assert.True(t, cl.allowClientEvent(now))
+	assert.False(t, cl.allowClientEvent(now))
+
+	// Half a second refills one token at 2 events per second
+	assert.True(t, cl.allowClientEvent(now.Add(500*time.Millisecond)))
+	assert.False(t, cl.allowClientEvent(now.Add(500*time.Millisecond)))
+}
+
+// Test relaying client events to the other subscribers of a private channel
+func TestClientEventRelay(t *testing.T) {
+	server := httptest.NewServer(setupTestRouter())
+	defer server.Close()
+	channel := "private-whisper"
+
+	sender, senderID := dialTestWebSocket(t, server)
+	defer sender.Close()
+	receiver, receiverID := dialTestWebSocket(t, server)
+	defer receiver.Close()
+
+	subscribeSigned(t, sender, senderID, channel, "")
+	subscribeSigned(t, receiver, receiverID, channel, "")
+
+	assert.NoError(t, sender.WriteJSON(ControlFrame{Channel: channel, Event: "client-typing", Data: map[string]interface{}{"typing": true}}))
+	var event Notification
+	assert.NoError(t, receiver.ReadJSON(&event))
+	assert.Equal(t, "client-typing", event.Event)
+	assert.Equal(t, true, event.Data["typing"])
+
+	// The sender does not get its own event back, so the next frame is the server broadcast
+	broadcastToApp(defaultAppID, Notification{Channel: channel, Event: "server-event"}, nil, "")
+	assert.NoError(t, sender.ReadJSON(&event))
+	assert.Equal(t, "server-event", event.Event)
+
+	// Client events on public channels are rejected
+	var reply map[string]interface{}
+	assert.NoError(t, sender.WriteJSON(ControlFrame{Channel: "public-channel", Event: "client-typing"}))
+	assert.NoError(t, sender.ReadJSON(&reply))
+	assert.Equal(t, "Client events are only allowed on private and presence channels", reply["error"])
+}
+
+// Test that client events with too many data fields are rejected
+func TestClientEventMaxFields(t *testing.T) {
+	defer func(max int) { clientEventMaxFields = max }(clientEventMaxFields)
+	clientEventMaxFields = 2
+	server := httptest.NewServer(setupTestRouter())
+	defer server.Close()
+	channel := "private-fields"
+
+	conn, socketID := dialTestWebSocket(t, server)
+	defer conn.Close()
+	subscribeSigned(t, conn, socketID, channel, "")
+
+	var reply map[string]interface{}
+	data := map[string]interface{}{"a": 1, "b": 2, "c": 3}
+	assert.NoError(t, conn.WriteJSON(ControlFrame{Channel: channel, Event: "client-typing", Data: data}))
+	assert.NoError(t, conn.ReadJSON(&reply))
+	assert.Equal(t, "Client event data has too many fields", reply["error"])
+}
+
+// Test that client events are never persisted into channel tables
+func TestPersistClientEventsTablesMode(t *testing.T) {
+	defer func(persist bool) { persistClientEvents = persist }(persistClientEvents)
+	defer func(previous notificationStore) { storage = previous }(storage)
+	t.Setenv("WS_PERSIST_CLIENT_EVENTS", "true")
+
+	storage = &tableStore{}
+	loadClientEventConfig()
+	assert.False(t, persistClientEvents)
+
+	storage = memoryHistory
+	loadClientEventConfig()
+	assert.True(t, persistClientEvents)
+}
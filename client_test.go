@@ -0,0 +1,89 @@
+package main
+
+import (
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/stretchr/testify/assert"
+)
+
+func queuedPayloads(cl *Client) []string {
+	payloads := []string{}
+	for len(cl.send) > 0 {
+		payloads = append(payloads, string((<-cl.send).payload))
+	}
+	return payloads
+}
+
+// Test send queue overflow policies
+func TestClientOverflowPolicies(t *testing.T) {
+	defer func(policy string) { overflowPolicy = policy }(overflowPolicy)
+
+	overflowPolicy = overflowDropOldest
+	cl := &Client{send: make(chan outboundMessage, 2)}
+	for _, p := range []string{"1", "2", "3"} {
+		assert.True(t, cl.enqueue(outboundMessage{payload: []byte(p)}))
+	}
+	assert.Equal(t, []string{"2", "3"}, queuedPayloads(cl))
+
+	overflowPolicy = overflowDropNewest
+	cl = &Client{send: make(chan outboundMessage, 2)}
+	assert.True(t, cl.enqueue(outboundMessage{payload: []byte("1")}))
+	assert.True(t, cl.enqueue(outboundMessage{payload: []byte("2")}))
+	assert.False(t, cl.enqueue(outboundMessage{payload: []byte("3")}))
+	assert.Equal(t, []string{"1", "2"}, queuedPayloads(cl))
+
+	// Disconnecting never writes to the connection from enqueue, the writer
+	// sends the close frame without flushing the queue
+	overflowPolicy = overflowDisconnect
+	cl = &Client{send: make(chan outboundMessage, 2)}
+	assert.True(t, cl.enqueue(outboundMessage{payload: []byte("1")}))
+	assert.True(t, cl.enqueue(outboundMessage{payload: []byte("2")}))
+	assert.False(t, cl.enqueue(outboundMessage{payload: []byte("3")}))
+	assert.True(t, cl.closed)
+	assert.Equal(t, websocket.CloseTryAgainLater, cl.closeCode)
+	_, ok := <-cl.send
+	assert.False(t, ok)
+}
+
+// Test that a closed client no longer accepts messages
+func TestClientClose(t *testing.T) {
+	cl := &Client{send: make(chan outboundMessage, 2)}
+	cl.close()
+	cl.close()
+	assert.False(t, cl.enqueue(outboundMessage{payload: []byte("1")}))
+}
+
+// Test that the reaper removes connections that stopped responding
+func TestReapStaleClients(t *testing.T) {
+	server := httptest.NewServer(setupTestRouter())
+	defer server.Close()
+
+	conn, _ := dialTestWebSocket(t, server)
+	defer conn.Close()
+
+	// Wait for the subscription ack so the connection is registered
+	var ack map[string]interface{}
+	assert.NoError(t, conn.WriteJSON(ControlFrame{Channel: "reaper_channel"}))
+	assert.NoError(t, conn.ReadJSON(&ack))
+
+	msgLock.Lock()
+	for _, client := range clients {
+		atomic.StoreInt64(&client.lastSeen, 0)
+	}
+	msgLock.Unlock()
+
+	before := getMetrics().WebSocketStats.StaleConnectionsReaped
+	assert.GreaterOrEqual(t, reapStaleClients(time.Now()), 1)
+	assert.Greater(t, getMetrics().WebSocketStats.StaleConnectionsReaped, before)
+
+	// The server side is gone, so reads on the client must fail
+	for {
+		if _, _, err := conn.ReadMessage(); err != nil {
+			break
+		}
+	}
+}
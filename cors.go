@@ -0,0 +1,123 @@
+package main
+
+import (
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Origins allowed to call the REST API from a browser and to open WebSocket
+// connections. Entries are exact origins, "*" for any origin, or contain a
+// single "*" such as "https://*.example.com" to match subdomains. Without
+// ALLOWED_ORIGINS no cross-origin access is allowed.
+var (
+	allowedOrigins []string
+	corsMaxAge     = 10 * time.Minute
+
+	corsAllowedMethods = "GET, POST, DELETE, OPTIONS"
+	corsAllowedHeaders = "Content-Type, key, secret, timestamp, nonce, signature, Idempotency-Key"
+)
+
+func loadCORSConfig() {
+	if value := os.Getenv("ALLOWED_ORIGINS"); value != "" {
+		allowedOrigins = nil
+		for _, origin := range strings.Split(value, ",") {
+			if origin = strings.TrimSpace(origin); origin != "" {
+				allowedOrigins = append(allowedOrigins, origin)
+			}
+		}
+	}
+	corsMaxAge = envDuration("CORS_MAX_AGE", corsMaxAge)
+
+	switch {
+	case len(allowedOrigins) == 0:
+		log.Println("ALLOWED_ORIGINS is not set, cross-origin requests and WebSocket connections are rejected")
+	case originAllowed(allowedOrigins, "https://any-origin.invalid"):
+		log.Println("WARNING: ALLOWED_ORIGINS allows every origin, any website can call this server from a browser")
+	}
+}
+
+// originMatches reports whether origin is matched by an allowlist entry.
+func originMatches(pattern, origin string) bool {
+	if pattern == "*" || pattern == origin {
+		return true
+	}
+	prefix, suffix, ok := strings.Cut(pattern, "*")
+	if !ok || len(origin) <= len(prefix)+len(suffix) {
+		return false
+	}
+	if !strings.HasPrefix(origin, prefix) || !strings.HasSuffix(origin, suffix) {
+		return false
+	}
+	// The wildcard stands for host labels, never for a scheme or path
+	middle := origin[len(prefix) : len(origin)-len(suffix)]
+	return !strings.ContainsAny(middle, "/:")
+}
+
+func originAllowed(origins []string, origin string) bool {
+	for _, pattern := range origins {
+		if originMatches(pattern, origin) {
+			return true
+		}
+	}
+	return false
+}
+
+// checkOrigin reports whether the request may use app. Requests without an
+// Origin header come from non-browser clients and are allowed, as are pages
+// served from the same host.
+func checkOrigin(r *http.Request, app *App) bool {
+	origin := r.Header.Get("Origin")
+	return origin == "" || sameOrigin(r, origin) || app.allowsOrigin(origin)
+}
+
+func sameOrigin(r *http.Request, origin string) bool {
+	u, err := url.Parse(origin)
+	return err == nil && strings.EqualFold(u.Host, r.Host)
+}
+
+// corsMiddleware sets the CORS headers for allowed origins and answers
+// preflight requests. Origins are checked against the app of the key header,
+// or against every app for preflights, which carry no credentials.
+func corsMiddleware(c *gin.Context) {
+	origin := c.GetHeader("Origin")
+	if origin == "" {
+		c.Next()
+		return
+	}
+
+	header := c.Writer.Header()
+	header.Add("Vary", "Origin")
+	preflight := c.Request.Method == http.MethodOptions && c.GetHeader("Access-Control-Request-Method") != ""
+	allowed := originAllowed(allowedOrigins, origin)
+	if preflight {
+		allowed = apps.anyAllowsOrigin(origin)
+	} else if app := apps.lookupKey(c.GetHeader("key")); app != nil {
+		allowed = app.allowsOrigin(origin)
+	}
+	if allowed {
+		header.Set("Access-Control-Allow-Origin", origin)
+	}
+
+	if !preflight {
+		c.Next()
+		return
+	}
+
+	if !allowed {
+		c.AbortWithStatus(http.StatusForbidden)
+		return
+	}
+	header.Add("Vary", "Access-Control-Request-Method")
+	header.Add("Vary", "Access-Control-Request-Headers")
+	header.Set("Access-Control-Allow-Methods", corsAllowedMethods)
+	header.Set("Access-Control-Allow-Headers", corsAllowedHeaders)
+	header.Set("Access-Control-Max-Age", strconv.Itoa(int(corsMaxAge.Seconds())))
+	c.AbortWithStatus(http.StatusNoContent)
+}
@@ -0,0 +1,160 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/gorilla/websocket"
+	"github.com/stretchr/testify/assert"
+)
+
+func withAllowedOrigins(t *testing.T, origins ...string) {
+	previous := allowedOrigins
+	allowedOrigins = origins
+	t.Cleanup(func() { allowedOrigins = previous })
+}
+
+// Test exact and wildcard origin matching
+func TestOriginMatches(t *testing.T) {
+	assert.True(t, originMatches("*", "https://anything.example"))
+	assert.True(t, originMatches("https://shop.example.com", "https://shop.example.com"))
+	assert.False(t, originMatches("https://shop.example.com", "http://shop.example.com"))
+	assert.True(t, originMatches("https://*.example.com", "https://shop.example.com"))
+	assert.True(t, originMatches("https://*.example.com", "https://eu.shop.example.com"))
+	assert.False(t, originMatches("https://*.example.com", "https://example.com"))
+	assert.False(t, originMatches("https://*.example.com", "https://evil.com/.example.com"))
+	assert.False(t, originMatches("https://*.example.com", "https://evil.example.com.attacker.net"))
+}
+
+// Test CORS headers and preflight handling
+func TestCORS(t *testing.T) {
+	withAllowedOrigins(t, "https://app.example.com", "https://*.example.org")
+	router := setupTestRouter()
+
+	// Preflight from an allowed origin
+	req, _ := http.NewRequest("OPTIONS", "/notification", nil)
+	req.Header.Set("Origin", "https://shop.example.org")
+	req.Header.Set("Access-Control-Request-Method", "POST")
+	req.Header.Set("Access-Control-Request-Headers", "key, secret, content-type")
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusNoContent, w.Code)
+	assert.Equal(t, "https://shop.example.org", w.Header().Get("Access-Control-Allow-Origin"))
+	assert.Contains(t, w.Header().Get("Access-Control-Allow-Headers"), "key")
+	assert.Contains(t, w.Header().Get("Access-Control-Allow-Headers"), "secret")
+	assert.Contains(t, w.Header().Get("Access-Control-Allow-Methods"), "POST")
+
+	// Preflight from another origin
+	req.Header.Set("Origin", "https://evil.example")
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusForbidden, w.Code)
+	assert.Empty(t, w.Header().Get("Access-Control-Allow-Origin"))
+
+	// Simple requests only get the header for allowed origins
+	req, _ = http.NewRequest("GET", "/notifications?channel=cors_channel", nil)
+	req.Header.Set("key", "key")
+	req.Header.Set("secret", "secret")
+	req.Header.Set("Origin", "https://app.example.com")
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+	assert.Equal(t, "https://app.example.com", w.Header().Get("Access-Control-Allow-Origin"))
+	assert.Contains(t, w.Header().Values("Vary"), "Origin")
+
+	req.Header.Set("Origin", "https://evil.example")
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+	assert.Empty(t, w.Header().Get("Access-Control-Allow-Origin"))
+}
+
+// Test that WebSocket upgrades use the same allowlist
+func TestWebSocketOriginAllowlist(t *testing.T) {
+	withAllowedOrigins(t, "https://*.example.com")
+	server := httptest.NewServer(setupTestRouter())
+	defer server.Close()
+	url := "ws" + strings.TrimPrefix(server.URL, "http") + "/ws"
+
+	conn, _, err := websocket.DefaultDialer.Dial(url, http.Header{"Origin": {"https://app.example.com"}})
+	if assert.NoError(t, err) {
+		conn.Close()
+	}
+
+	_, resp, err := websocket.DefaultDialer.Dial(url, http.Header{"Origin": {"https://evil.example"}})
+	assert.Error(t, err)
+	if assert.NotNil(t, resp) {
+		assert.Equal(t, http.StatusForbidden, resp.StatusCode)
+	}
+
+	// Non-browser clients send no Origin
+	conn, _, err = websocket.DefaultDialer.Dial(url, nil)
+	if assert.NoError(t, err) {
+		conn.Close()
+	}
+}
+
+// Test that only same-origin pages connect when no origins are configured
+func TestDefaultOrigins(t *testing.T) {
+	withAllowedOrigins(t)
+	server := httptest.NewServer(setupTestRouter())
+	defer server.Close()
+	url := "ws" + strings.TrimPrefix(server.URL, "http") + "/ws"
+
+	_, resp, err := websocket.DefaultDialer.Dial(url, http.Header{"Origin": {"https://app.example.com"}})
+	assert.Error(t, err)
+	if assert.NotNil(t, resp) {
+		assert.Equal(t, http.StatusForbidden, resp.StatusCode)
+	}
+
+	conn, _, err := websocket.DefaultDialer.Dial(url, http.Header{"Origin": {server.URL}})
+	if assert.NoError(t, err) {
+		conn.Close()
+	}
+
+	req, _ := http.NewRequest("OPTIONS", "/notification", nil)
+	req.Header.Set("Origin", "https://app.example.com")
+	req.Header.Set("Access-Control-Request-Method", "POST")
+	w := httptest.NewRecorder()
+	setupTestRouter().ServeHTTP(w, req)
+	assert.Equal(t, http.StatusForbidden, w.Code)
+}
+
+// Test that an app's allowed_origins are granted for its WebSocket and REST requests
+func TestAppAllowedOrigins(t *testing.T) {
+	withAllowedOrigins(t)
+	withApps(t, &App{ID: "shop", Key: "shop-key", Secret: "shop-secret", AllowedOrigins: []string{"https://shop.example"}},
+		&App{ID: "blog", Key: "blog-key", Secret: "blog-secret"})
+	router := setupTestRouter()
+	server := httptest.NewServer(router)
+	defer server.Close()
+	url := "ws" + strings.TrimPrefix(server.URL, "http") + "/ws?app_key="
+
+	conn, _, err := websocket.DefaultDialer.Dial(url+"shop-key", http.Header{"Origin": {"https://shop.example"}})
+	if assert.NoError(t, err) {
+		conn.Close()
+	}
+	_, resp, err := websocket.DefaultDialer.Dial(url+"blog-key", http.Header{"Origin": {"https://shop.example"}})
+	assert.Error(t, err)
+	if assert.NotNil(t, resp) {
+		assert.Equal(t, http.StatusForbidden, resp.StatusCode)
+	}
+
+	req, _ := http.NewRequest("OPTIONS", "/notification", nil)
+	req.Header.Set("Origin", "https://shop.example")
+	req.Header.Set("Access-Control-Request-Method", "POST")
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusNoContent, w.Code)
+	assert.Equal(t, "https://shop.example", w.Header().Get("Access-Control-Allow-Origin"))
+
+	for key, allowed := range map[string]bool{"shop-key": true, "blog-key": false} {
+		req, _ = http.NewRequest("GET", "/notifications?channel=cors_channel", nil)
+		req.Header.Set("key", key)
+		req.Header.Set("secret", strings.Replace(key, "key", "secret", 1))
+		req.Header.Set("Origin", "https://shop.example")
+		w = httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+		assert.Equal(t, allowed, w.Header().Get("Access-Control-Allow-Origin") != "", key)
+	}
+}
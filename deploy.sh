@@ -8,7 +8,7 @@ echo "Mengambil perubahan terbaru..."
 git pull origin main
 
 echo "Membangun binary Go..."
-go build -o websocket-server main.go
+go build -o websocket-server .
 
 echo "Membuat systemd service jika belum ada..."
 sudo tee /etc/systemd/system/websocket-server.service > /dev/null <<EOF
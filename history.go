@@ -0,0 +1,97 @@
+package main
+
+import (
+	"log"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Maximum number of notifications replayed when a client subscribes with
+// since_id or since.
+var replayLimit = 100
+
+func loadHistoryConfig() {
+	replayLimit = envInt("WS_REPLAY_LIMIT", replayLimit)
+}
+
+// loadHistory returns up to limit notifications stored in the app channel
+// after sinceID and, if set, after since, oldest first.
+func loadHistory(appID, channel string, sinceID int64, since time.Time, limit int) ([]Notification, error) {
+	return storage.history(storageName(appID, channel), sinceID, since, limit)
+}
+
+// rowToNotification converts a channel table row back into the notification that produced it.
+func rowToNotification(channel string, row map[string]interface{}) Notification {
+	notif := Notification{Channel: channel, Data: make(map[string]interface{})}
+	for col, value := range row {
+		if b, ok := value.([]byte); ok {
+			value = string(b)
+		}
+		switch col {
+		case "id":
+			notif.ID, _ = value.(int64)
+		case "event":
+			notif.Event, _ = value.(string)
+		case "created_at":
+			notif.Timestamp, _ = value.(time.Time)
+		case "expires_at":
+			if expiresAt, ok := value.(time.Time); ok {
+				notif.ExpiresAt = &expiresAt
+			}
+		default:
+			if value != nil {
+				notif.Data[col] = value
+			}
+		}
+	}
+	return notif
+}
+
+// replayHistory sends the notifications a client missed, then releases the live
+// messages held back during the replay. Live messages already covered by the
+// replay are skipped, so every notification is delivered once. When the replay
+// stops at replayLimit, the ack reports has_more and the last_id to continue from.
+func replayHistory(client *Client, channel string, sinceID int64, since time.Time) {
+	history, err := loadHistory(client.app.ID, channel, sinceID, since, replayLimit)
+
+	msgLock.Lock()
+	defer msgLock.Unlock()
+
+	pending, ok := client.replaying[channel]
+	delete(client.replaying, channel)
+	if !ok {
+		// Unsubscribed while the history was loading
+		return
+	}
+
+	if err != nil {
+		log.Println("Failed to load history:", err)
+		client.sendJSON(gin.H{"error": "Failed to load history", "channel": channel})
+	}
+
+	// Ids can commit out of order, so only the replayed ones are known to be sent
+	replayed := make(map[int64]bool, len(history))
+	lastID := sinceID
+	for _, notif := range history {
+		notif.Replayed = true
+		if err := client.sendNotification(notif); err != nil {
+			log.Println("Failed to encode notification:", err)
+		}
+		replayed[notif.ID] = true
+		lastID = notif.ID
+	}
+	client.sendJSON(gin.H{
+		"message":  "History replayed",
+		"channel":  channel,
+		"count":    len(history),
+		"last_id":  lastID,
+		"has_more": len(history) == replayLimit,
+	})
+
+	for _, msg := range pending {
+		if msg.id == 0 || !replayed[msg.id] {
+			client.enqueue(msg)
+		}
+	}
+}
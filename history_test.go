@@ -0,0 +1,52 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// Test converting a channel table row back into a notification
+func TestRowToNotification(t *testing.T) {
+	notif := rowToNotification("orders", map[string]interface{}{
+		"id":         int64(7),
+		"created_at": time.Now(),
+		"event":      []byte("created"),
+		"sender":     "shop",
+		"note":       nil,
+	})
+
+	assert.Equal(t, int64(7), notif.ID)
+	assert.Equal(t, "orders", notif.Channel)
+	assert.Equal(t, "created", notif.Event)
+	assert.Equal(t, map[string]interface{}{"sender": "shop"}, notif.Data)
+}
+
+// Test that live messages held during a replay are released once
+func TestReplayReleasesPendingMessages(t *testing.T) {
+	defer func(limit int) { replayLimit = limit }(replayLimit)
+	replayLimit = 2
+	for i := 0; i < 4; i++ {
+		memoryHistory.append("replay_pending_test", Notification{Event: "chat", Timestamp: serverTimestamp()})
+	}
+
+	client := &Client{app: apps.get(defaultAppID), send: make(chan outboundMessage, 10), replaying: map[string][]outboundMessage{}}
+	client.replaying["replay_pending_test"] = []outboundMessage{
+		{channel: "replay_pending_test", id: 1, payload: []byte("1")},
+		{channel: "replay_pending_test", id: 3, payload: []byte("3")},
+		{channel: "replay_pending_test", id: 5, payload: []byte("5")},
+		{channel: "replay_pending_test", payload: []byte("unsaved")},
+	}
+
+	replayHistory(client, "replay_pending_test", 1, time.Time{})
+
+	payloads := queuedPayloads(client)
+	if assert.Len(t, payloads, 6) {
+		// Ids 2 and 3 are replayed, 4 is left for the next page
+		assert.Equal(t, `{"channel":"replay_pending_test","count":2,"has_more":true,"last_id":3,"message":"History replayed"}`, payloads[2])
+		// Only the replayed id is skipped, a lower id may have committed late
+		assert.Equal(t, []string{"1", "5", "unsaved"}, payloads[3:])
+	}
+	assert.NotContains(t, client.replaying, "replay_pending_test")
+}
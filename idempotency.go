@@ -0,0 +1,242 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Publishers may send an Idempotency-Key header (or an idempotency_key field)
+// so that retries of the same request are answered with the original response
+// instead of storing and broadcasting the notification again.
+const idempotencyHeader = "Idempotency-Key"
+
+var (
+	idempotencyWindow = 24 * time.Hour
+
+	idempotencyKeys idempotencyStore = newMemoryIdempotencyStore()
+)
+
+// idempotencyRecord is the outcome of the first request made with a key.
+type idempotencyRecord struct {
+	Fingerprint string
+	Status      int // zero while the first request is still running
+	Body        []byte
+}
+
+// idempotencyStore reserves keys and remembers responses. With a database the
+// keys are shared by every instance behind the load balancer.
+type idempotencyStore interface {
+	// reserve claims the key for a new request. If the key is already known it
+	// returns false and the existing record.
+	reserve(key, fingerprint string, now time.Time) (bool, idempotencyRecord, error)
+	complete(key string, status int, body []byte) error
+	release(key string) error
+}
+
+func loadIdempotencyConfig() {
+	idempotencyWindow = envDuration("IDEMPOTENCY_WINDOW", idempotencyWindow)
+	if useDB {
+		store, err := newDBIdempotencyStore()
+		if err != nil {
+			log.Println("Failed to create idempotency table, keeping keys in memory:", err)
+			return
+		}
+		idempotencyKeys = store
+	}
+}
+
+// idempotent is middleware for publish endpoints, placed after authenticate.
+func idempotent(c *gin.Context) {
+	var body []byte
+	if c.Request.Body != nil {
+		var err error
+		if body, err = io.ReadAll(c.Request.Body); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Failed to read request body"})
+			c.Abort()
+			return
+		}
+		c.Request.Body = io.NopCloser(bytes.NewReader(body))
+	}
+
+	key := c.GetHeader(idempotencyHeader)
+	if key == "" {
+		var fields struct {
+			IdempotencyKey string `json:"idempotency_key"`
+		}
+		json.Unmarshal(body, &fields)
+		key = fields.IdempotencyKey
+	}
+	if key == "" {
+		c.Next()
+		return
+	}
+
+	key = appFromContext(c).ID + ":" + key
+	hash := sha256.Sum256(append([]byte(c.Request.Method+" "+c.Request.URL.Path+"\n"), body...))
+	fingerprint := hex.EncodeToString(hash[:])
+
+	reserved, record, err := idempotencyKeys.reserve(key, fingerprint, time.Now())
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to check idempotency key", "detail": err.Error()})
+		c.Abort()
+		return
+	}
+	if !reserved {
+		switch {
+		case record.Fingerprint != fingerprint:
+			c.JSON(http.StatusUnprocessableEntity, gin.H{"error": "Idempotency-Key was used for a different request"})
+		case record.Status == 0:
+			c.JSON(http.StatusConflict, gin.H{"error": "A request with this Idempotency-Key is in progress"})
+		default:
+			c.Header("Idempotent-Replayed", "true")
+			c.Data(record.Status, "application/json; charset=utf-8", record.Body)
+		}
+		c.Abort()
+		return
+	}
+
+	recorder := &responseRecorder{ResponseWriter: c.Writer}
+	c.Writer = recorder
+	c.Next()
+
+	// Failures that a retry may fix do not consume the key
+	status := recorder.Status()
+	if status >= http.StatusInternalServerError || status == http.StatusTooManyRequests {
+		err = idempotencyKeys.release(key)
+	} else {
+		err = idempotencyKeys.complete(key, status, recorder.body.Bytes())
+	}
+	if err != nil {
+		log.Println("Failed to store idempotency key:", err)
+	}
+}
+
+// responseRecorder keeps a copy of the response body.
+type responseRecorder struct {
+	gin.ResponseWriter
+	body bytes.Buffer
+}
+
+func (w *responseRecorder) Write(data []byte) (int, error) {
+	w.body.Write(data)
+	return w.ResponseWriter.Write(data)
+}
+
+func (w *responseRecorder) WriteString(s string) (int, error) {
+	w.body.WriteString(s)
+	return w.ResponseWriter.WriteString(s)
+}
+
+// ------------------ Memory ------------------
+
+type memoryIdempotencyStore struct {
+	mu        sync.Mutex
+	records   map[string]*memoryIdempotencyRecord
+	lastSweep time.Time
+}
+
+type memoryIdempotencyRecord struct {
+	idempotencyRecord
+	createdAt time.Time
+}
+
+func newMemoryIdempotencyStore() *memoryIdempotencyStore {
+	return &memoryIdempotencyStore{records: make(map[string]*memoryIdempotencyRecord)}
+}
+
+func (s *memoryIdempotencyStore) reserve(key, fingerprint string, now time.Time) (bool, idempotencyRecord, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if now.Sub(s.lastSweep) > time.Minute {
+		for k, record := range s.records {
+			if now.Sub(record.createdAt) > idempotencyWindow {
+				delete(s.records, k)
+			}
+		}
+		s.lastSweep = now
+	}
+
+	if record, ok := s.records[key]; ok && now.Sub(record.createdAt) <= idempotencyWindow {
+		return false, record.idempotencyRecord, nil
+	}
+	s.records[key] = &memoryIdempotencyRecord{idempotencyRecord{Fingerprint: fingerprint}, now}
+	return true, idempotencyRecord{}, nil
+}
+
+func (s *memoryIdempotencyStore) complete(key string, status int, body []byte) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if record, ok := s.records[key]; ok {
+		record.Status = status
+		record.Body = body
+	}
+	return nil
+}
+
+func (s *memoryIdempotencyStore) release(key string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.records, key)
+	return nil
+}
+
+// ------------------ Postgres ------------------
+
+type dbIdempotencyStore struct{}
+
+func newDBIdempotencyStore() (*dbIdempotencyStore, error) {
+	_, err := dbConn.Exec(`CREATE TABLE IF NOT EXISTS ws_idempotency_keys (
+		key TEXT PRIMARY KEY,
+		fingerprint TEXT NOT NULL,
+		status INTEGER NOT NULL DEFAULT 0,
+		body BYTEA,
+		created_at TIMESTAMP NOT NULL DEFAULT NOW()
+	)`)
+	return &dbIdempotencyStore{}, err
+}
+
+func (s *dbIdempotencyStore) reserve(key, fingerprint string, now time.Time) (bool, idempotencyRecord, error) {
+	// Expired keys are removed first so they can be claimed again
+	if _, err := dbConn.Exec(`DELETE FROM ws_idempotency_keys WHERE created_at < $1`, now.Add(-idempotencyWindow)); err != nil {
+		return false, idempotencyRecord{}, err
+	}
+
+	result, err := dbConn.Exec(`INSERT INTO ws_idempotency_keys (key, fingerprint, created_at) VALUES ($1, $2, $3)
+		ON CONFLICT (key) DO NOTHING`, key, fingerprint, now)
+	if err != nil {
+		return false, idempotencyRecord{}, err
+	}
+	if inserted, _ := result.RowsAffected(); inserted == 1 {
+		return true, idempotencyRecord{}, nil
+	}
+
+	var record idempotencyRecord
+	err = dbConn.QueryRow(`SELECT fingerprint, status, body FROM ws_idempotency_keys WHERE key = $1`, key).
+		Scan(&record.Fingerprint, &record.Status, &record.Body)
+	if err == sql.ErrNoRows {
+		// Released in the meantime
+		return s.reserve(key, fingerprint, now)
+	}
+	return false, record, err
+}
+
+func (s *dbIdempotencyStore) complete(key string, status int, body []byte) error {
+	_, err := dbConn.Exec(`UPDATE ws_idempotency_keys SET status = $2, body = $3 WHERE key = $1`, key, status, body)
+	return err
+}
+
+func (s *dbIdempotencyStore) release(key string) error {
+	_, err := dbConn.Exec(`DELETE FROM ws_idempotency_keys WHERE key = $1`, key)
+	return err
+}
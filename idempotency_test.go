@@ -0,0 +1,106 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func publishIdempotent(router http.Handler, key string, notif Notification) *httptest.ResponseRecorder {
+	body, _ := json.Marshal(notif)
+	req, _ := http.NewRequest("POST", "/notification", bytes.NewBuffer(body))
+	req.Header.Set("key", "key")
+	req.Header.Set("secret", "secret")
+	if key != "" {
+		req.Header.Set(idempotencyHeader, key)
+	}
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+	return w
+}
+
+// Test that a retried publish is answered without broadcasting again
+func TestIdempotentPublish(t *testing.T) {
+	router := setupTestRouter()
+	server := httptest.NewServer(router)
+	defer server.Close()
+
+	conn, _ := dialTestWebSocket(t, server)
+	defer conn.Close()
+	var ack map[string]interface{}
+	assert.NoError(t, conn.WriteJSON(ControlFrame{Action: "subscribe", Channel: "idempotent_channel"}))
+	assert.NoError(t, conn.ReadJSON(&ack))
+
+	notif := Notification{Channel: "idempotent_channel", Event: "created"}
+	first := publishIdempotent(router, "retry-1", notif)
+	assert.Equal(t, http.StatusOK, first.Code)
+
+	second := publishIdempotent(router, "retry-1", notif)
+	assert.Equal(t, http.StatusOK, second.Code)
+	assert.Equal(t, first.Body.String(), second.Body.String())
+	assert.Equal(t, "true", second.Header().Get("Idempotent-Replayed"))
+
+	// The key in the body works too
+	notif.IdempotencyKey = "retry-2"
+	assert.Equal(t, http.StatusOK, publishIdempotent(router, "", notif).Code)
+	assert.Equal(t, "true", publishIdempotent(router, "", notif).Header().Get("Idempotent-Replayed"))
+
+	// Reusing a key for another request is an error
+	other := Notification{Channel: "idempotent_channel", Event: "deleted"}
+	assert.Equal(t, http.StatusUnprocessableEntity, publishIdempotent(router, "retry-1", other).Code)
+
+	// Only the two original publishes were broadcast, without the key
+	broadcastToApp(defaultAppID, Notification{Channel: "idempotent_channel", Event: "marker"}, nil, "")
+	for _, event := range []string{"created", "created", "marker"} {
+		var received map[string]interface{}
+		assert.NoError(t, conn.ReadJSON(&received))
+		assert.Equal(t, event, received["event"])
+		assert.NotContains(t, received, "idempotency_key")
+	}
+}
+
+// Test key expiry, concurrent use and release in the memory store
+func TestMemoryIdempotencyStore(t *testing.T) {
+	store := newMemoryIdempotencyStore()
+	now := time.Now()
+
+	reserved, _, _ := store.reserve("app:k", "f1", now)
+	assert.True(t, reserved)
+
+	reserved, record, _ := store.reserve("app:k", "f1", now)
+	assert.False(t, reserved)
+	assert.Equal(t, 0, record.Status)
+
+	store.complete("app:k", http.StatusOK, []byte(`{"success":true}`))
+	_, record, _ = store.reserve("app:k", "f1", now)
+	assert.Equal(t, http.StatusOK, record.Status)
+
+	reserved, _, _ = store.reserve("app:k", "f1", now.Add(idempotencyWindow+time.Second))
+	assert.True(t, reserved)
+
+	store.release("app:k")
+	reserved, _, _ = store.reserve("app:k", "f2", now)
+	assert.True(t, reserved)
+}
+
+// Test that a stored notification whose broadcast failed consumes the key
+func TestIdempotentPublishStoredNotBroadcast(t *testing.T) {
+	withFailingBackplane(t)
+	router := setupTestRouter()
+	notif := Notification{Channel: "idempotent_stored", Event: "created"}
+
+	first := publishIdempotent(router, "stored-1", notif)
+	assert.Equal(t, http.StatusAccepted, first.Code)
+	retry := publishIdempotent(router, "stored-1", notif)
+	assert.Equal(t, http.StatusAccepted, retry.Code)
+	assert.Equal(t, "true", retry.Header().Get("Idempotent-Replayed"))
+
+	history, err := loadHistory(defaultAppID, "idempotent_stored", 0, time.Time{}, 10)
+	assert.NoError(t, err)
+	assert.Len(t, history, 1)
+}
@@ -0,0 +1,283 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+const notificationsTable = "ws_notifications"
+
+// Columns of the single notifications table that filters can use directly,
+// everything else is a path into data.
+var notificationColumns = map[string]bool{"id": true, "event": true, "created_at": true, "expires_at": true}
+
+// jsonbStore keeps every notification in ws_notifications with its data as
+// JSONB. Its rows are shaped like channel table rows: the data fields next to
+// id, event, created_at and expires_at.
+type jsonbStore struct {
+	sqlWriter
+}
+
+func newJSONBStore(conn *sql.DB) (*jsonbStore, error) {
+	if err := ensureNotificationsTable(conn); err != nil {
+		return nil, err
+	}
+	s := &jsonbStore{}
+	s.sqlWriter = sqlWriter{conn: conn, insertRow: s.insert}
+	return s, nil
+}
+
+// ensureNotificationsTable creates ws_notifications. Ids come from one
+// sequence, so they still increase within every channel, and the primary key
+// lets migrated rows keep the id they had in their channel table.
+func ensureNotificationsTable(db queryer) error {
+	statements := []string{
+		`CREATE SEQUENCE IF NOT EXISTS ws_notifications_id_seq`,
+		`CREATE TABLE IF NOT EXISTS ws_notifications (
+			id BIGINT NOT NULL DEFAULT nextval('ws_notifications_id_seq'),
+			channel TEXT NOT NULL,
+			"event" TEXT,
+			data JSONB NOT NULL DEFAULT '{}',
+			created_at TIMESTAMP NOT NULL DEFAULT NOW(),
+			expires_at TIMESTAMP,
+			PRIMARY KEY (channel, id)
+		)`,
+		`CREATE INDEX IF NOT EXISTS ws_notifications_created_at_idx ON ws_notifications (channel, created_at)`,
+		`CREATE INDEX IF NOT EXISTS ws_notifications_expires_at_idx ON ws_notifications (expires_at) WHERE expires_at IS NOT NULL`,
+		`CREATE INDEX IF NOT EXISTS ws_notifications_data_idx ON ws_notifications USING GIN (data jsonb_path_ops)`,
+	}
+	for _, statement := range statements {
+		if _, err := db.Exec(statement); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// builder starts a query on the notifications of one channel.
+func (s *jsonbStore) builder(channel string) *queryBuilder {
+	q := &queryBuilder{placeholder: "$", zone: time.Local}
+	q.where("channel = " + q.arg(channel))
+	return q
+}
+
+func (s *jsonbStore) insert(q queryer, channel string, notif Notification) (int64, error) {
+	data, err := encodeData(notif.Data)
+	if err != nil {
+		return 0, err
+	}
+
+	var id int64
+	err = q.QueryRow(`INSERT INTO ws_notifications (channel, "event", data, created_at, expires_at)
+		VALUES ($1, $2, $3, $4, $5) RETURNING id`,
+		channel, notif.Event, data, notif.Timestamp, notif.ExpiresAt).Scan(&id)
+	return id, err
+}
+
+func (s *jsonbStore) query(channel string, filters []queryFilter, limit int) ([]map[string]interface{}, error) {
+	q := s.builder(channel)
+	q.notExpired(time.Now())
+	for _, f := range filters {
+		if err := jsonbFilter(q, f); err != nil {
+			return nil, err
+		}
+	}
+	return s.rows(q, "DESC", limit)
+}
+
+func (s *jsonbStore) history(channel string, sinceID int64, since time.Time, limit int) ([]Notification, error) {
+	q := s.builder(channel)
+	q.where("id > " + q.arg(sinceID))
+	q.notExpired(time.Now())
+	if !since.IsZero() {
+		q.where("created_at > " + q.arg(since))
+	}
+	rows, err := s.rows(q, "ASC", limit)
+	if err != nil {
+		return nil, err
+	}
+
+	history := []Notification{}
+	for _, row := range rows {
+		history = append(history, rowToNotification(channelFromStorageName(channel), row))
+	}
+	return history, nil
+}
+
+// rows runs the query and returns up to limit rows ordered by id, "ASC" or "DESC".
+func (s *jsonbStore) rows(q *queryBuilder, order string, limit int) ([]map[string]interface{}, error) {
+	rows, err := s.conn.Query(`SELECT id, "event", data, created_at, expires_at FROM ws_notifications
+		WHERE `+q.whereClause()+`
+		ORDER BY id `+order+` LIMIT `+strconv.Itoa(limit), q.args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	return scanDataRows(rows)
+}
+
+func (s *jsonbStore) channels() ([]string, error) {
+	return queryStrings(s.conn, `SELECT DISTINCT channel FROM ws_notifications`)
+}
+
+func (s *jsonbStore) prune(channel string, now time.Time, maxAge time.Duration, maxRows int) (int, error) {
+	scope := func() *queryBuilder { return s.builder(channel) }
+	return pruneRows(s.conn, notificationsTable, "ctid", scope, now, maxAge, maxRows)
+}
+
+func (s *jsonbStore) purgeExpired(now time.Time) (int64, error) {
+	result, err := s.conn.Exec(`DELETE FROM ws_notifications WHERE expires_at <= $1`, now)
+	if err != nil {
+		return 0, err
+	}
+	return result.RowsAffected()
+}
+
+// jsonbFilter adds a search condition. Fields are columns or dot separated
+// paths into data. Comparisons follow the JSON types, so numbers compare as
+// numbers and never match strings; Text filters compare the text of the value.
+func jsonbFilter(q *queryBuilder, f queryFilter) error {
+	op := allowedOperators[f.Op]
+	if notificationColumns[f.Field] {
+		q.where(`"` + f.Field + `" ` + op + " " + q.arg(f.Value))
+		return nil
+	}
+	path := strings.Split(f.Field, ".")
+
+	switch {
+	case f.Text || op == "LIKE" || op == "ILIKE":
+		q.where("data #>> " + q.arg(pq.Array(path)) + "::text[] " + op + " " + q.arg(fmt.Sprint(f.Value)))
+	case op == "=" && isJSONScalar(f.Value):
+		// Containment can use the GIN index on data
+		document, err := json.Marshal(nestedDocument(path, f.Value))
+		if err != nil {
+			return fmt.Errorf("Invalid value for %s", f.Field)
+		}
+		q.where("data @> " + q.arg(string(document)) + "::jsonb")
+	default:
+		value, err := json.Marshal(f.Value)
+		if err != nil {
+			return fmt.Errorf("Invalid value for %s", f.Field)
+		}
+		p := q.arg(pq.Array(path)) + "::text[]"
+		v := q.arg(string(value)) + "::jsonb"
+		q.where("jsonb_typeof(data #> " + p + ") = jsonb_typeof(" + v + ") AND data #> " + p + " " + op + " " + v)
+	}
+	return nil
+}
+
+// migrateToJSONB copies the channel tables into ws_notifications, including
+// those of earlier versions, which newTableStore registers first. Rows keep
+// their ids, so since_id and pending deliveries stay valid, and already copied
+// rows are skipped, so the migration can run again after new publishes. Data
+// fields that hold a JSON number or boolean are converted to it, so typed
+// filters find migrated rows, and the rest stay strings. The channel tables are
+// left in place.
+func migrateToJSONB() error {
+	if !useDB {
+		return errors.New("database not configured")
+	}
+	if err := ensureNotificationsTable(dbConn); err != nil {
+		return err
+	}
+
+	channelStore, err := newTableStore(dbConn)
+	if err != nil {
+		return err
+	}
+	tables, err := channelStore.channels()
+	if err != nil {
+		return err
+	}
+	for _, table := range tables {
+		result, err := dbConn.Exec(`INSERT INTO ws_notifications (id, channel, "event", data, created_at, expires_at)
+			SELECT id, $1::text, "event", COALESCE((
+					SELECT jsonb_object_agg(key, CASE
+						WHEN value ~ $2 OR value IN ('true', 'false') THEN value::jsonb
+						ELSE to_jsonb(value) END)
+					FROM jsonb_each_text(to_jsonb(t) - 'id' - 'created_at' - 'event' - 'expires_at')
+					WHERE value IS NOT NULL), '{}'),
+				COALESCE(created_at, NOW()), expires_at
+			FROM `+pq.QuoteIdentifier(table)+` t
+			ON CONFLICT (channel, id) DO NOTHING`, table, jsonNumberPattern)
+		if err != nil {
+			return fmt.Errorf("%s: %v", table, err)
+		}
+		n, _ := result.RowsAffected()
+		log.Printf("Migrated %d notifications from %s", n, table)
+	}
+
+	// New ids must follow every migrated one
+	_, err = dbConn.Exec(`SELECT setval('ws_notifications_id_seq', GREATEST(
+		(SELECT COALESCE(MAX(id), 0) FROM ws_notifications),
+		(SELECT last_value FROM ws_notifications_id_seq)))`)
+	return err
+}
+
+// jsonNumberPattern matches the text of a JSON number, which is how the TEXT
+// columns of the tables mode hold published numbers.
+const jsonNumberPattern = `^-?(0|[1-9][0-9]*)(\.[0-9]+)?([eE][+-]?[0-9]+)?$`
+
+// encodeData returns the JSON document stored for the data of a notification.
+func encodeData(data map[string]interface{}) (string, error) {
+	if data == nil {
+		data = map[string]interface{}{}
+	}
+	encoded, err := json.Marshal(data)
+	return string(encoded), err
+}
+
+// scanDataRows reads id, event, data, created_at and expires_at rows into
+// maps shaped like channel table rows.
+func scanDataRows(rows *sql.Rows) ([]map[string]interface{}, error) {
+	result := []map[string]interface{}{}
+	for rows.Next() {
+		var (
+			id        int64
+			event     sql.NullString
+			data      []byte
+			createdAt time.Time
+			expiresAt sql.NullTime
+		)
+		if err := rows.Scan(&id, &event, &data, &createdAt, &expiresAt); err != nil {
+			return nil, err
+		}
+		row := map[string]interface{}{}
+		if err := json.Unmarshal(data, &row); err != nil {
+			return nil, err
+		}
+		row["id"] = id
+		row["event"] = event.String
+		row["created_at"] = createdAt
+		row["expires_at"] = nil
+		if expiresAt.Valid {
+			row["expires_at"] = expiresAt.Time
+		}
+		result = append(result, row)
+	}
+	return result, rows.Err()
+}
+
+func isJSONScalar(value interface{}) bool {
+	switch value.(type) {
+	case map[string]interface{}, []interface{}:
+		return false
+	}
+	return true
+}
+
+// nestedDocument wraps value in objects along path, {"a": {"b": value}} for a.b.
+func nestedDocument(path []string, value interface{}) interface{} {
+	for i := len(path) - 1; i >= 0; i-- {
+		value = map[string]interface{}{path[i]: value}
+	}
+	return value
+}
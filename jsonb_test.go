@@ -0,0 +1,78 @@
+package main
+
+import (
+	"regexp"
+	"testing"
+	"time"
+
+	"github.com/lib/pq"
+	"github.com/stretchr/testify/assert"
+)
+
+// Test the JSON path conditions built for search filters
+func TestJSONBFilters(t *testing.T) {
+	now := time.Now().Round(0)
+	store := &jsonbStore{}
+	q := store.builder("shop:orders")
+	q.notExpired(now)
+	assert.Equal(t, []string{"channel = $1", "(expires_at IS NULL OR expires_at > $2)"}, q.conditions)
+
+	assert.NoError(t, jsonbFilter(q, queryFilter{Field: "event", Op: "==", Value: "created"}))
+	assert.NoError(t, jsonbFilter(q, queryFilter{Field: "customer.name", Op: "==", Value: "Alice"}))
+	assert.NoError(t, jsonbFilter(q, queryFilter{Field: "amount", Op: ">=", Value: float64(10)}))
+	assert.NoError(t, jsonbFilter(q, queryFilter{Field: "sender", Op: "ilike", Value: "ali%"}))
+	assert.NoError(t, jsonbFilter(q, queryFilter{Field: "amount", Op: "==", Value: "10", Text: true}))
+
+	assert.Equal(t, []string{
+		`"event" = $3`,
+		"data @> $4::jsonb",
+		"jsonb_typeof(data #> $5::text[]) = jsonb_typeof($6::jsonb) AND data #> $5::text[] >= $6::jsonb",
+		"data #>> $7::text[] ILIKE $8",
+		"data #>> $9::text[] = $10",
+	}, q.conditions[2:])
+	assert.Equal(t, []interface{}{
+		"shop:orders", now, "created",
+		`{"customer":{"name":"Alice"}}`,
+		pq.Array([]string{"amount"}), "10",
+		pq.Array([]string{"sender"}), "ali%",
+		pq.Array([]string{"amount"}), "10",
+	}, q.args)
+}
+
+// Test that filters no store can run are rejected up front
+func TestValidateFilters(t *testing.T) {
+	assert.NoError(t, validateFilters([]queryFilter{{Field: "customer.name", Op: "=="}}))
+	assert.Error(t, validateFilters([]queryFilter{{Field: "amount", Op: "~"}}))
+	assert.Error(t, validateFilters([]queryFilter{{Field: "customer..name", Op: "=="}}))
+	assert.Error(t, validateFilters([]queryFilter{{Field: `name" = '' OR "x`, Op: "=="}}))
+}
+
+// Test which migrated text values become JSON numbers
+func TestJSONNumberPattern(t *testing.T) {
+	number := regexp.MustCompile(jsonNumberPattern)
+	for _, value := range []string{"0", "20", "-3", "12.50", "1e6", "2.5E-3"} {
+		assert.True(t, number.MatchString(value), value)
+	}
+	for _, value := range []string{"", "007", "12.", ".5", "1,000", "0x10", "NaN", "20 EUR", "+1"} {
+		assert.False(t, number.MatchString(value), value)
+	}
+}
+
+// Test that the migration copies channel tables that were never registered
+func TestMigrateUnregisteredTable(t *testing.T) {
+	db := withTestPostgres(t)
+	createLegacyChannelTable(t, db, "migrated_orders")
+
+	if !assert.NoError(t, migrateToJSONB()) {
+		return
+	}
+	store, err := newJSONBStore(db)
+	if !assert.NoError(t, err) {
+		return
+	}
+	rows, err := store.query("migrated_orders", []queryFilter{{Field: "amount", Op: ">", Value: float64(5)}}, 10)
+	assert.NoError(t, err)
+	if assert.Len(t, rows, 1) {
+		assert.Equal(t, "created", rows[0]["event"])
+	}
+}
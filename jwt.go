@@ -0,0 +1,261 @@
+package main
+
+import (
+	"crypto"
+	"crypto/hmac"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"log"
+	"math/big"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/gorilla/websocket"
+)
+
+// WebSocket clients can authenticate with a JWT from the identity provider,
+// passed as ?token=, as the Sec-WebSocket-Protocol pair "bearer, <token>", or
+// in a {"action": "auth", "token": "..."} frame. Tokens are verified with the
+// HS256 secrets and/or the RS256 keys of a local JWKS file.
+var (
+	jwtRequired      = false
+	jwtHS256Secrets  [][]byte
+	jwtRSAKeys       = map[string]*rsa.PublicKey{} // by key ID
+	jwtIssuer        = ""
+	jwtAudience      = ""
+	jwtChannelsClaim = "channels"
+
+	// How long a connection may stay unauthenticated when a JWT is required
+	jwtAuthTimeout = 10 * time.Second
+)
+
+const bearerProtocol = "bearer"
+
+func loadJWTConfig() {
+	jwtRequired = envBool("WS_JWT_REQUIRED", jwtRequired)
+	jwtIssuer = envString("JWT_ISSUER", jwtIssuer)
+	jwtAudience = envString("JWT_AUDIENCE", jwtAudience)
+	jwtChannelsClaim = envString("JWT_CHANNELS_CLAIM", jwtChannelsClaim)
+	jwtAuthTimeout = envDuration("WS_JWT_AUTH_TIMEOUT", jwtAuthTimeout)
+
+	for _, secret := range strings.Split(os.Getenv("JWT_HS256_SECRETS"), ",") {
+		if secret = strings.TrimSpace(secret); secret != "" {
+			jwtHS256Secrets = append(jwtHS256Secrets, []byte(secret))
+		}
+	}
+
+	if path := os.Getenv("JWT_JWKS_FILE"); path != "" {
+		keys, err := loadJWKSFile(path)
+		if err != nil {
+			log.Fatal("Failed to load JWKS file: ", err)
+		}
+		jwtRSAKeys = keys
+	}
+
+	if jwtRequired && len(jwtHS256Secrets) == 0 && len(jwtRSAKeys) == 0 {
+		log.Fatal("WS_JWT_REQUIRED needs JWT_HS256_SECRETS or JWT_JWKS_FILE")
+	}
+}
+
+// loadJWKSFile reads the RSA keys of a JSON Web Key Set.
+func loadJWKSFile(path string) (map[string]*rsa.PublicKey, error) {
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var jwks struct {
+		Keys []struct {
+			Kty string `json:"kty"`
+			Kid string `json:"kid"`
+			N   string `json:"n"`
+			E   string `json:"e"`
+		} `json:"keys"`
+	}
+	if err := json.Unmarshal(content, &jwks); err != nil {
+		return nil, err
+	}
+
+	keys := map[string]*rsa.PublicKey{}
+	for _, k := range jwks.Keys {
+		if k.Kty != "RSA" {
+			continue
+		}
+		n, err := base64.RawURLEncoding.DecodeString(k.N)
+		if err != nil {
+			return nil, err
+		}
+		e, err := base64.RawURLEncoding.DecodeString(k.E)
+		if err != nil {
+			return nil, err
+		}
+		keys[k.Kid] = &rsa.PublicKey{N: new(big.Int).SetBytes(n), E: int(new(big.Int).SetBytes(e).Int64())}
+	}
+	return keys, nil
+}
+
+// parseJWT verifies the token signature and registered claims and returns its claims.
+func parseJWT(token string, now time.Time) (map[string]interface{}, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return nil, errors.New("Malformed token")
+	}
+
+	var header struct {
+		Alg string `json:"alg"`
+		Kid string `json:"kid"`
+	}
+	if err := decodeJWTPart(parts[0], &header); err != nil {
+		return nil, errors.New("Malformed token header")
+	}
+	signature, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, errors.New("Malformed token signature")
+	}
+	if !verifyJWTSignature(header.Alg, header.Kid, parts[0]+"."+parts[1], signature) {
+		return nil, errors.New("Invalid token signature")
+	}
+
+	claims := map[string]interface{}{}
+	if err := decodeJWTPart(parts[1], &claims); err != nil {
+		return nil, errors.New("Malformed token claims")
+	}
+
+	if exp, ok := claims["exp"].(float64); ok && !now.Before(time.Unix(int64(exp), 0)) {
+		return nil, errors.New("Token expired")
+	}
+	if nbf, ok := claims["nbf"].(float64); ok && now.Before(time.Unix(int64(nbf), 0)) {
+		return nil, errors.New("Token not valid yet")
+	}
+	if jwtIssuer != "" && claims["iss"] != jwtIssuer {
+		return nil, errors.New("Invalid token issuer")
+	}
+	if jwtAudience != "" && !claimContains(claims["aud"], jwtAudience) {
+		return nil, errors.New("Invalid token audience")
+	}
+	return claims, nil
+}
+
+func decodeJWTPart(part string, v interface{}) error {
+	decoded, err := base64.RawURLEncoding.DecodeString(part)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(decoded, v)
+}
+
+func verifyJWTSignature(alg, kid, signingInput string, signature []byte) bool {
+	switch alg {
+	case "HS256":
+		for _, secret := range jwtHS256Secrets {
+			mac := hmac.New(sha256.New, secret)
+			mac.Write([]byte(signingInput))
+			if hmac.Equal(signature, mac.Sum(nil)) {
+				return true
+			}
+		}
+	case "RS256":
+		digest := sha256.Sum256([]byte(signingInput))
+		if key, ok := jwtRSAKeys[kid]; ok {
+			return rsa.VerifyPKCS1v15(key, crypto.SHA256, digest[:], signature) == nil
+		}
+		if kid == "" {
+			for _, key := range jwtRSAKeys {
+				if rsa.VerifyPKCS1v15(key, crypto.SHA256, digest[:], signature) == nil {
+					return true
+				}
+			}
+		}
+	}
+	return false
+}
+
+// claimContains reports whether a string or string-array claim contains value.
+func claimContains(claim interface{}, value string) bool {
+	switch v := claim.(type) {
+	case string:
+		return v == value
+	case []interface{}:
+		for _, item := range v {
+			if item == value {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// tokenFromRequest finds a JWT in the query string or the WebSocket
+// subprotocols. It also returns the subprotocol to accept, if any.
+func tokenFromRequest(r *http.Request) (token, protocol string) {
+	if token := r.URL.Query().Get("token"); token != "" {
+		return token, ""
+	}
+	protocols := websocket.Subprotocols(r)
+	for i := 0; i+1 < len(protocols); i++ {
+		if protocols[i] == bearerProtocol {
+			return protocols[i+1], bearerProtocol
+		}
+	}
+	return "", ""
+}
+
+// authenticateJWT stores the token claims on the client and schedules the
+// connection to close when the token expires. Called from the read loop only.
+func (cl *Client) authenticateJWT(token string) error {
+	claims, err := parseJWT(token, time.Now())
+	if err != nil {
+		return err
+	}
+	cl.claims = claims
+
+	if cl.authTimer != nil {
+		cl.authTimer.Stop()
+	}
+	if exp, ok := claims["exp"].(float64); ok {
+		conn := cl.conn
+		cl.authTimer = time.AfterFunc(time.Until(time.Unix(int64(exp), 0)), func() {
+			closeConnection(conn, websocket.ClosePolicyViolation, "Token expired")
+		})
+	} else {
+		cl.authTimer = nil
+	}
+	return nil
+}
+
+// requireAuthentication closes the connection if no valid token arrives in time.
+func (cl *Client) requireAuthentication() {
+	conn := cl.conn
+	cl.authTimer = time.AfterFunc(jwtAuthTimeout, func() {
+		closeConnection(conn, websocket.ClosePolicyViolation, "Authentication required")
+	})
+}
+
+// claimsAllowChannel applies the channels claim, a list of patterns the token
+// may subscribe to. Tokens without the claim are not restricted.
+func claimsAllowChannel(claims map[string]interface{}, channel string) bool {
+	allowed, ok := claims[jwtChannelsClaim].([]interface{})
+	if !ok {
+		return true
+	}
+	for _, pattern := range allowed {
+		if p, ok := pattern.(string); ok && patternCovers(p, channel) {
+			return true
+		}
+	}
+	return false
+}
+
+func handleAuthFrame(client *Client, token string) {
+	if err := client.authenticateJWT(token); err != nil {
+		client.sendJSON(gin.H{"error": err.Error()})
+		return
+	}
+	client.sendJSON(gin.H{"message": "Authenticated"})
+}
@@ -0,0 +1,194 @@
+package main
+
+import (
+	"crypto"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/stretchr/testify/assert"
+)
+
+func withJWTSecret(t *testing.T, secret string) {
+	required, secrets := jwtRequired, jwtHS256Secrets
+	jwtRequired, jwtHS256Secrets = true, [][]byte{[]byte(secret)}
+	t.Cleanup(func() {
+		jwtRequired, jwtHS256Secrets = required, secrets
+	})
+}
+
+func encodeJWT(header, claims map[string]interface{}) string {
+	h, _ := json.Marshal(header)
+	c, _ := json.Marshal(claims)
+	return base64.RawURLEncoding.EncodeToString(h) + "." + base64.RawURLEncoding.EncodeToString(c)
+}
+
+func hs256Token(secret string, claims map[string]interface{}) string {
+	input := encodeJWT(map[string]interface{}{"alg": "HS256", "typ": "JWT"}, claims)
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(input))
+	return input + "." + base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+func dialJWT(server *httptest.Server, query string, header http.Header) (*websocket.Conn, *http.Response, error) {
+	conn, resp, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(server.URL, "http")+"/ws"+query, header)
+	if err == nil {
+		conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+		var established map[string]interface{}
+		conn.ReadJSON(&established)
+	}
+	return conn, resp, err
+}
+
+// Test token verification for HS256 and RS256
+func TestParseJWT(t *testing.T) {
+	withJWTSecret(t, "jwt-secret")
+	now := time.Now()
+	exp := float64(now.Add(time.Hour).Unix())
+
+	claims, err := parseJWT(hs256Token("jwt-secret", map[string]interface{}{"sub": "user-1", "exp": exp}), now)
+	assert.NoError(t, err)
+	assert.Equal(t, "user-1", claims["sub"])
+
+	_, err = parseJWT(hs256Token("other-secret", map[string]interface{}{"sub": "user-1", "exp": exp}), now)
+	assert.Error(t, err)
+
+	_, err = parseJWT(hs256Token("jwt-secret", map[string]interface{}{"exp": float64(now.Add(-time.Minute).Unix())}), now)
+	assert.EqualError(t, err, "Token expired")
+
+	_, err = parseJWT("not-a-token", now)
+	assert.Error(t, err)
+
+	jwtIssuer = "https://idp.example.com"
+	defer func() { jwtIssuer = "" }()
+	_, err = parseJWT(hs256Token("jwt-secret", map[string]interface{}{"iss": "https://other.example.com"}), now)
+	assert.EqualError(t, err, "Invalid token issuer")
+
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	assert.NoError(t, err)
+	keys := jwtRSAKeys
+	jwtRSAKeys = map[string]*rsa.PublicKey{"key-1": &key.PublicKey}
+	defer func() { jwtRSAKeys = keys }()
+
+	input := encodeJWT(map[string]interface{}{"alg": "RS256", "kid": "key-1"},
+		map[string]interface{}{"sub": "user-2", "iss": jwtIssuer})
+	digest := sha256.Sum256([]byte(input))
+	signature, _ := rsa.SignPKCS1v15(rand.Reader, key, crypto.SHA256, digest[:])
+	claims, err = parseJWT(input+"."+base64.RawURLEncoding.EncodeToString(signature), now)
+	assert.NoError(t, err)
+	assert.Equal(t, "user-2", claims["sub"])
+
+	// An RS256 header must not be verified against the HMAC secrets
+	_, err = parseJWT(strings.Replace(hs256Token("jwt-secret", map[string]interface{}{}), "eyJhbGciOiJIUzI1NiI", "eyJhbGciOiJSUzI1NiI", 1), now)
+	assert.Error(t, err)
+}
+
+// Test the channels claim against subscription patterns
+func TestClaimsAllowChannel(t *testing.T) {
+	claims := map[string]interface{}{"channels": []interface{}{"orders.store-1.#", "user.*"}}
+
+	assert.True(t, claimsAllowChannel(claims, "orders.store-1.created"))
+	assert.True(t, claimsAllowChannel(claims, "orders.store-1.*"))
+	assert.True(t, claimsAllowChannel(claims, "user.42"))
+	assert.False(t, claimsAllowChannel(claims, "orders.store-2.created"))
+	assert.False(t, claimsAllowChannel(claims, "orders.#"))
+	assert.False(t, claimsAllowChannel(claims, "user.42.settings"))
+	assert.True(t, claimsAllowChannel(map[string]interface{}{"sub": "user-1"}, "anything"))
+}
+
+// Test the three ways of passing a token
+func TestJWTWebSocket(t *testing.T) {
+	withJWTSecret(t, "jwt-secret")
+	server := httptest.NewServer(setupTestRouter())
+	defer server.Close()
+
+	token := hs256Token("jwt-secret", map[string]interface{}{
+		"sub":      "user-1",
+		"exp":      float64(time.Now().Add(time.Hour).Unix()),
+		"channels": []interface{}{"jwt_orders.#"},
+	})
+
+	// Invalid tokens are rejected before the upgrade
+	_, resp, err := dialJWT(server, "?token=bogus", nil)
+	assert.Error(t, err)
+	if assert.NotNil(t, resp) {
+		assert.Equal(t, http.StatusUnauthorized, resp.StatusCode)
+	}
+
+	// Query parameter
+	conn, _, err := dialJWT(server, "?token="+token, nil)
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer conn.Close()
+
+	var reply map[string]interface{}
+	conn.WriteJSON(ControlFrame{Action: "subscribe", Channel: "jwt_orders.created"})
+	assert.NoError(t, conn.ReadJSON(&reply))
+	assert.Equal(t, "Subscribed to channel", reply["message"])
+
+	conn.WriteJSON(ControlFrame{Action: "subscribe", Channel: "jwt_invoices"})
+	reply = nil
+	assert.NoError(t, conn.ReadJSON(&reply))
+	assert.Equal(t, "Channel not allowed by token", reply["error"])
+
+	// Subprotocol, echoed back by the server
+	conn2, resp, err := dialJWT(server, "", http.Header{"Sec-WebSocket-Protocol": {"bearer, " + token}})
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer conn2.Close()
+	assert.Equal(t, "bearer", resp.Header.Get("Sec-WebSocket-Protocol"))
+
+	// First frame
+	conn3, _, err := dialJWT(server, "", nil)
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer conn3.Close()
+
+	conn3.WriteJSON(ControlFrame{Action: "subscribe", Channel: "jwt_orders.created"})
+	reply = nil
+	assert.NoError(t, conn3.ReadJSON(&reply))
+	assert.Equal(t, "Authentication required", reply["error"])
+
+	conn3.WriteJSON(ControlFrame{Action: "auth", Token: token})
+	reply = nil
+	assert.NoError(t, conn3.ReadJSON(&reply))
+	assert.Equal(t, "Authenticated", reply["message"])
+
+	conn3.WriteJSON(ControlFrame{Action: "subscribe", Channel: "jwt_orders.created"})
+	reply = nil
+	assert.NoError(t, conn3.ReadJSON(&reply))
+	assert.Equal(t, "Subscribed to channel", reply["message"])
+}
+
+// Test that the connection is closed when the token expires
+func TestJWTExpiryClosesConnection(t *testing.T) {
+	withJWTSecret(t, "jwt-secret")
+	server := httptest.NewServer(setupTestRouter())
+	defer server.Close()
+
+	token := hs256Token("jwt-secret", map[string]interface{}{"exp": float64(time.Now().Add(2 * time.Second).Unix())})
+	conn, _, err := dialJWT(server, "?token="+token, nil)
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer conn.Close()
+
+	for {
+		if _, _, err = conn.ReadMessage(); err != nil {
+			break
+		}
+	}
+	assert.True(t, websocket.IsCloseError(err, websocket.ClosePolicyViolation), err)
+}
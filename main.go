@@ -2,20 +2,19 @@ package main
 
 import (
 	"database/sql"
+	"encoding/json"
 	"fmt"
 	"log"
 	"net/http"
 	"os"
 	"runtime"
 	"strconv"
-	"strings"
 	"sync"
 	"time"
 
 	"github.com/gin-gonic/gin"
 	"github.com/gorilla/websocket"
 	"github.com/joho/godotenv"
-	_ "github.com/lib/pq"
 )
 
 var (
@@ -23,10 +22,11 @@ var (
 		"key":    "key",
 		"secret": "secret",
 	}
-	dbConn *sql.DB
-	useDB  bool // Flag to indicate if database is available
+	dbConn       *sql.DB
+	dbConnString string
+	useDB        bool // Flag to indicate if database is available
 
-	clients = make(map[*websocket.Conn]string)
+	clients = make(map[*websocket.Conn]*Client)
 	msgLock sync.Mutex
 
 	// Monitoring metrics
@@ -37,24 +37,77 @@ var (
 			TotalMessagesSent:   0,
 			TotalMessagesFailed: 0,
 			MessagesByChannel:   make(map[string]int),
+			ConnectionsByApp:    make(map[string]int),
+			MessagesByApp:       make(map[string]int),
+			SendQueueSize:       sendQueueSize,
+			OverflowPolicy:      overflowPolicy,
 		},
 		ServerStats: &ServerStats{
 			StartTime: time.Now(),
 		},
+		RetentionStats: &RetentionStats{
+			RowsPrunedByChannel: make(map[string]int),
+		},
 	}
 	metricsLock sync.RWMutex
 
+	// handleWebSocket checks the origin against the app before upgrading
 	upgrader = websocket.Upgrader{
-		CheckOrigin: func(r *http.Request) bool {
-			return true
-		},
+		CheckOrigin: func(r *http.Request) bool { return true },
 	}
 )
 
 type Notification struct {
-	Channel string                 `json:"channel"`
-	Event   string                 `json:"event"`
-	Data    map[string]interface{} `json:"data"` // dynamic fields like sender, message
+	ID       int64    `json:"id,omitempty"` // row id in the channel table, set by the server
+	Channel  string   `json:"channel"`
+	Channels []string `json:"channels,omitempty"` // all target channels when publishing to several
+	Event    string   `json:"event"`
+	// Server time of the publish, the created_at column of the stored row
+	Timestamp time.Time              `json:"timestamp"`
+	Data      map[string]interface{} `json:"data"`               // dynamic fields like sender, message
+	Replayed  bool                   `json:"replayed,omitempty"` // sent from history on subscribe
+
+	// Alternative to the Idempotency-Key header, never stored or broadcast
+	IdempotencyKey string `json:"idempotency_key,omitempty"`
+
+	// Publish later, at deliver_at or after delay (a duration such as "15m")
+	DeliverAt *time.Time `json:"deliver_at,omitempty"`
+	Delay     string     `json:"delay,omitempty"`
+
+	// Time to live such as "2m". Expired notifications are not replayed or returned by queries.
+	TTL       string     `json:"ttl,omitempty"`
+	ExpiresAt *time.Time `json:"expires_at,omitempty"`
+}
+
+// ControlFrame is sent by a WebSocket client to manage its subscriptions.
+// A frame without an action is treated as a subscribe for backward compatibility.
+type ControlFrame struct {
+	Action  string `json:"action"`
+	Channel string `json:"channel"`
+	Auth    string `json:"auth,omitempty"` // "<key>:<signature>", required for private and presence channels
+
+	// JSON encoded {"user_id": ..., "user_info": {...}}, signed together with the channel
+	ChannelData string `json:"channel_data,omitempty"`
+
+	// Replay notifications stored after this id or time before live delivery starts
+	SinceID int64      `json:"since_id,omitempty"`
+	Since   *time.Time `json:"since,omitempty"`
+
+	// Set instead of an action to send a client-* event to the channel
+	Event string                 `json:"event,omitempty"`
+	Data  map[string]interface{} `json:"data,omitempty"`
+
+	// JWT sent with the "auth" action, to authenticate or refresh the connection
+	Token string `json:"token,omitempty"`
+
+	// Subscribe with acknowledgements as a durable consumer, which defaults to the JWT subject
+	Ack      bool   `json:"ack,omitempty"`
+	Consumer string `json:"consumer,omitempty"`
+	// "<key>:<signature>" of "<socket_id>:consumer:<consumer>", required for a consumer other than the subject
+	ConsumerAuth string `json:"consumer_auth,omitempty"`
+
+	// Notification id confirmed by the "ack" action
+	ID int64 `json:"id,omitempty"`
 }
 
 type WebSocketStats struct {
@@ -64,6 +117,23 @@ type WebSocketStats struct {
 	TotalMessagesFailed int            `json:"totalMessagesFailed"`
 	MessagesByChannel   map[string]int `json:"messagesByChannel"`
 	LastMessageTime     time.Time      `json:"lastMessageTime"`
+
+	// Send queue overflow handling
+	SendQueueSize         int    `json:"sendQueueSize"`
+	OverflowPolicy        string `json:"overflowPolicy"`
+	TotalMessagesDropped  int    `json:"totalMessagesDropped"`
+	SlowClientDisconnects int    `json:"slowClientDisconnects"`
+
+	// Connections removed by the heartbeat reaper
+	StaleConnectionsReaped int `json:"staleConnectionsReaped"`
+
+	// Client-to-server events
+	ClientEventsRelayed     int `json:"clientEventsRelayed"`
+	ClientEventsRateLimited int `json:"clientEventsRateLimited"`
+
+	// Per-app usage
+	ConnectionsByApp map[string]int `json:"connectionsByApp"`
+	MessagesByApp    map[string]int `json:"messagesByApp"`
 }
 
 type ServerStats struct {
@@ -72,11 +142,15 @@ type ServerStats struct {
 	MemoryUsage string    `json:"memoryUsage"`
 	CPUUsage    string    `json:"cpuUsage"`
 	Goroutines  int       `json:"goroutines"`
+	Backplane   string    `json:"backplane"`
+
+	NotificationsExpired int64 `json:"notificationsExpired"`
 }
 
 type Metrics struct {
 	WebSocketStats *WebSocketStats `json:"websocketStats"`
 	ServerStats    *ServerStats    `json:"serverStats"`
+	RetentionStats *RetentionStats `json:"retentionStats"`
 }
 
 // ------------------ DB Setup ------------------
@@ -97,14 +171,15 @@ func initDB() {
 		return
 	}
 
+	dbConnString = "host=" + dbHost +
+		" port=" + dbPort +
+		" user=" + dbUser +
+		" password=" + dbPassword +
+		" dbname=" + dbName +
+		" sslmode=" + dbSSLMode
+
 	var err error
-	dbConn, err = sql.Open("postgres",
-		"host="+dbHost+
-			" port="+dbPort+
-			" user="+dbUser+
-			" password="+dbPassword+
-			" dbname="+dbName+
-			" sslmode="+dbSSLMode)
+	dbConn, err = sql.Open("postgres", dbConnString)
 	if err != nil {
 		log.Println("DB connect error:", err)
 		useDB = false
@@ -121,205 +196,415 @@ func initDB() {
 	log.Println("Database connected successfully.")
 }
 
-// Create table if not exists
-func ensureTable(channel string, data map[string]interface{}) error {
-	if !useDB {
-		return nil
+// serverTimestamp is the time stamped on new notifications, truncated to the
+// precision of a Postgres TIMESTAMP so live and replayed copies are equal.
+func serverTimestamp() time.Time {
+	return time.Now().Truncate(time.Microsecond)
+}
+
+// setNotificationTargets merges channel and channels into the deduplicated
+// list of target channels. Channel becomes the first target, and Channels is
+// only kept when there is more than one.
+func setNotificationTargets(notif *Notification) []string {
+	targets := []string{}
+	seen := map[string]bool{}
+	for _, channel := range append([]string{notif.Channel}, notif.Channels...) {
+		if channel != "" && !seen[channel] {
+			seen[channel] = true
+			targets = append(targets, channel)
+		}
+	}
+
+	notif.Channels = nil
+	if len(targets) > 0 {
+		notif.Channel = targets[0]
+	}
+	if len(targets) > 1 {
+		notif.Channels = targets
 	}
+	return targets
+}
 
-	// Base columns
-	columns := []string{
-		"id SERIAL PRIMARY KEY",
-		"created_at TIMESTAMP DEFAULT NOW()",
-		`"event" TEXT`,
+// notificationTargets returns the channels a notification is published to.
+func notificationTargets(notif Notification) []string {
+	if len(notif.Channels) > 0 {
+		return notif.Channels
 	}
+	return []string{notif.Channel}
+}
 
-	// Add dynamic columns based on data
-	for field := range data {
-		if field != "id" && field != "created_at" && field != "event" {
-			columns = append(columns, `"`+field+`" TEXT`)
+// ------------------ WebSocket ------------------
+
+// handleWebSocket serves /ws. The app is selected with the app_key query
+// parameter; without it the connection belongs to the default app.
+func handleWebSocket(c *gin.Context) {
+	app := apps.get(defaultAppID)
+	if key := c.Query("app_key"); key != "" {
+		app = apps.lookupKey(key)
+	}
+	if app == nil {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Unknown app"})
+		return
+	}
+	if !checkOrigin(c.Request, app) {
+		c.JSON(http.StatusForbidden, gin.H{"error": "Origin not allowed"})
+		return
+	}
+
+	token, protocol := tokenFromRequest(c.Request)
+	if token != "" {
+		if _, err := parseJWT(token, time.Now()); err != nil {
+			c.JSON(http.StatusUnauthorized, gin.H{"error": "Unauthorized", "detail": err.Error()})
+			return
 		}
 	}
 
-	// Create table if not exists
-	query := `CREATE TABLE IF NOT EXISTS "` + channel + `" (` + strings.Join(columns, ", ") + `);`
-	_, err := dbConn.Exec(query)
+	var responseHeader http.Header
+	if protocol != "" {
+		responseHeader = http.Header{"Sec-WebSocket-Protocol": {protocol}}
+	}
+	conn, err := upgrader.Upgrade(c.Writer, c.Request, responseHeader)
 	if err != nil {
-		return err
+		return
 	}
 
-	// Check if event column exists
-	var eventExists bool
-	err = dbConn.QueryRow(`
-		SELECT EXISTS (
-			SELECT 1 
-			FROM information_schema.columns 
-			WHERE table_name = $1 AND column_name = 'event'
-		)`, channel).Scan(&eventExists)
+	client := newClient(conn, app)
 
-	if err != nil {
-		return err
+	msgLock.Lock()
+	if app.MaxConnections > 0 && appConnections[app.ID] >= app.MaxConnections {
+		msgLock.Unlock()
+		closeConnection(conn, closeOverQuota, "Over connection quota")
+		return
 	}
+	clients[conn] = client
+	appConnections[app.ID]++
+	active := len(clients)
+	msgLock.Unlock()
 
-	// Add event column if it doesn't exist
-	if !eventExists {
-		alterQuery := `ALTER TABLE "` + channel + `" ADD COLUMN "event" TEXT;`
-		_, err := dbConn.Exec(alterQuery)
-		if err != nil {
-			return err
-		}
+	conn.SetPongHandler(func(string) error {
+		client.touch()
+		return nil
+	})
+	go client.writePump()
+	defer client.close()
+
+	if token != "" {
+		client.authenticateJWT(token)
+	} else if jwtRequired {
+		client.requireAuthentication()
 	}
+	defer func() {
+		if client.authTimer != nil {
+			client.authTimer.Stop()
+		}
+	}()
 
-	// Check and add any missing columns
-	for field := range data {
-		if field != "id" && field != "created_at" && field != "event" {
-			// Check if column exists
-			var exists bool
-			err := dbConn.QueryRow(`
-				SELECT EXISTS (
-					SELECT 1 
-					FROM information_schema.columns 
-					WHERE table_name = $1 AND column_name = $2
-				)`, channel, field).Scan(&exists)
-
-			if err != nil {
-				return err
-			}
+	client.sendJSON(gin.H{"event": "connection_established", "socket_id": client.socketID})
 
-			// If column doesn't exist, add it
-			if !exists {
-				alterQuery := `ALTER TABLE "` + channel + `" ADD COLUMN "` + field + `" TEXT;`
-				_, err := dbConn.Exec(alterQuery)
-				if err != nil {
-					return err
-				}
-			}
+	// Update metrics
+	metricsLock.Lock()
+	metrics.WebSocketStats.TotalConnections++
+	metrics.WebSocketStats.ActiveConnections = active
+	metrics.WebSocketStats.ConnectionsByApp[app.ID]++
+	metricsLock.Unlock()
+
+	for {
+		_, message, err := conn.ReadMessage()
+		if err != nil {
+			removeClient(conn)
+			break
 		}
-	}
+		client.touch()
 
-	return nil
+		var frame ControlFrame
+		if err := json.Unmarshal(message, &frame); err != nil {
+			client.sendJSON(gin.H{"error": "Invalid control frame"})
+			continue
+		}
+		handleControlFrame(client, frame)
+	}
 }
 
-// Save notif to table
-func saveToDB(channel string, data map[string]interface{}, event string) error {
-	if !useDB {
-		return nil
+// handleControlFrame applies a subscribe/unsubscribe request and acknowledges it,
+// or relays a client event.
+// Channels may be exact names or wildcard patterns such as "orders.*" or "orders.#".
+func handleControlFrame(client *Client, frame ControlFrame) {
+	if frame.Action == "auth" {
+		handleAuthFrame(client, frame.Token)
+		return
 	}
-
-	if err := ensureTable(channel, data); err != nil {
-		return err
+	if jwtRequired && client.claims == nil {
+		client.sendJSON(gin.H{"error": "Authentication required"})
+		return
 	}
 
-	// Build dynamic query
-	fields := []string{`"event"`}
-	placeholders := []string{"$1"}
-	values := []interface{}{event}
-	valueIndex := 2
+	err := validatePattern(frame.Channel)
+	if err == nil {
+		err = validateStorageName(client.app.ID, frame.Channel)
+	}
+	if err != nil {
+		client.sendJSON(gin.H{"error": err.Error()})
+		return
+	}
 
-	for field, value := range data {
-		if field != "id" && field != "created_at" && field != "event" {
-			fields = append(fields, `"`+field+`"`)
-			placeholders = append(placeholders, "$"+strconv.Itoa(valueIndex))
-			values = append(values, value)
-			valueIndex++
+	switch frame.Action {
+	case "":
+		if isClientEvent(frame.Event) {
+			handleClientEvent(client, frame)
+		} else {
+			subscribeClient(client, frame)
+		}
+	case "subscribe":
+		subscribeClient(client, frame)
+	case "ack":
+		handleAck(client, frame)
+	case "unsubscribe":
+		if client.consumer != "" {
+			if err := deliveries.unregister(client.app.ID, client.consumer, frame.Channel); err != nil {
+				log.Println("Failed to remove ack consumer:", err)
+			}
 		}
-	}
 
-	// Add created_at
-	fields = append(fields, "created_at")
-	placeholders = append(placeholders, "$"+strconv.Itoa(valueIndex))
-	values = append(values, time.Now())
+		msgLock.Lock()
+		delete(client.channels, frame.Channel)
+		delete(client.replaying, frame.Channel)
+		subscriptionsFor(client.app.ID).remove(frame.Channel, client)
+		left := presenceLeaveLocked(client, frame.Channel)
+		msgLock.Unlock()
 
-	stmt := `INSERT INTO "` + channel + `" (` + strings.Join(fields, ", ") + `) VALUES (` + strings.Join(placeholders, ", ") + `)`
-	_, err := dbConn.Exec(stmt, values...)
-	return err
+		if left != nil {
+			announcePresence(frame.Channel, "member_removed", *left, client)
+		}
+		client.sendJSON(gin.H{"message": "Unsubscribed from channel", "channel": frame.Channel})
+	default:
+		client.sendJSON(gin.H{"error": "Invalid action: " + frame.Action})
+	}
 }
 
-// ------------------ WebSocket ------------------
+func subscribeClient(client *Client, frame ControlFrame) {
+	if client.claims != nil && !claimsAllowChannel(client.claims, frame.Channel) {
+		client.sendJSON(gin.H{"error": "Channel not allowed by token", "channel": frame.Channel})
+		return
+	}
+	if requiresChannelAuth(frame.Channel) && !verifyChannelAuth(client.app, client.socketID, frame.Channel, frame.ChannelData, frame.Auth) {
+		client.sendJSON(gin.H{"error": "Invalid channel signature", "channel": frame.Channel})
+		return
+	}
 
-func handleWebSocket(c *gin.Context) {
-	conn, err := upgrader.Upgrade(c.Writer, c.Request, nil)
-	if err != nil {
+	if !authorize(client.subject(), actionSubscribe, frame.Channel).Allowed {
+		client.sendJSON(gin.H{"error": "Forbidden by policy", "channel": frame.Channel})
 		return
 	}
-	defer conn.Close()
 
-	var subscription struct {
-		Channel string `json:"channel"`
+	replay := frame.SinceID > 0 || frame.Since != nil
+	if replay && isPattern(frame.Channel) {
+		client.sendJSON(gin.H{"error": "History replay requires an exact channel", "channel": frame.Channel})
+		return
 	}
-	if err := conn.ReadJSON(&subscription); err != nil {
-		conn.WriteJSON(gin.H{"error": "Invalid subscription request"})
+	if replay && !authorize(client.subject(), actionHistory, frame.Channel).Allowed {
+		client.sendJSON(gin.H{"error": "Forbidden by policy", "channel": frame.Channel})
 		return
 	}
 
-	msgLock.Lock()
-	clients[conn] = subscription.Channel
-	msgLock.Unlock()
+	consumer := ""
+	if frame.Ack {
+		var err error
+		if consumer, err = ackConsumer(client, frame); err != nil {
+			client.sendJSON(gin.H{"error": err.Error(), "channel": frame.Channel})
+			return
+		}
+		if client.consumer != "" && client.consumer != consumer {
+			client.sendJSON(gin.H{"error": "Connection already acknowledges as " + client.consumer, "channel": frame.Channel})
+			return
+		}
+	}
 
-	// Update metrics
-	metricsLock.Lock()
-	metrics.WebSocketStats.TotalConnections++
-	metrics.WebSocketStats.ActiveConnections = len(clients)
-	metricsLock.Unlock()
+	presence := isPresenceChannel(frame.Channel)
+	var member presenceMember
+	if presence {
+		if isPattern(frame.Channel) {
+			client.sendJSON(gin.H{"error": "Presence channels cannot use wildcards", "channel": frame.Channel})
+			return
+		}
+		var err error
+		if member, err = parseChannelData(frame.ChannelData); err != nil {
+			client.sendJSON(gin.H{"error": err.Error(), "channel": frame.Channel})
+			return
+		}
+	}
 
-	conn.WriteJSON(gin.H{"message": "Subscribed to channel", "channel": subscription.Channel})
+	// Registered before subscribing so nothing published after the ack goes untracked
+	if frame.Ack {
+		if err := deliveries.register(client.app.ID, consumer, frame.Channel); err != nil {
+			log.Println("Failed to register ack consumer:", err)
+			client.sendJSON(gin.H{"error": "Failed to register consumer", "channel": frame.Channel})
+			return
+		}
+		client.consumer = consumer
+	}
 
-	for {
-		_, _, err := conn.ReadMessage()
-		if err != nil {
-			msgLock.Lock()
-			delete(clients, conn)
-			msgLock.Unlock()
-
-			// Update metrics
-			metricsLock.Lock()
-			metrics.WebSocketStats.ActiveConnections = len(clients)
-			metricsLock.Unlock()
-			break
+	// The ack is queued while holding msgLock so it always precedes live notifications
+	msgLock.Lock()
+	client.channels[frame.Channel] = true
+	subscriptionsFor(client.app.ID).add(frame.Channel, client)
+	if replay {
+		client.replaying[frame.Channel] = []outboundMessage{}
+	}
+
+	ack := gin.H{"message": "Subscribed to channel", "channel": frame.Channel}
+	joined := false
+	if presence {
+		joined = presenceJoinLocked(client, frame.Channel, member)
+		members := presenceMembersLocked(client.app.ID, frame.Channel)
+		ack["presence"] = gin.H{"count": len(members), "members": members}
+	}
+	client.sendJSON(ack)
+	msgLock.Unlock()
+
+	if joined {
+		announcePresence(frame.Channel, "member_added", member, client)
+	}
+	if replay {
+		var since time.Time
+		if frame.Since != nil {
+			since = *frame.Since
 		}
+		replayHistory(client, frame.Channel, frame.SinceID, since)
+	}
+	if frame.Ack {
+		redeliver(client, frame.Channel)
 	}
 }
 
 // ------------------ Notifikasi Handler ------------------
 
+// authenticate resolves the app from a signed request or the legacy key/secret
+// headers, depending on AUTH_MODE. Handlers read it with appFromContext.
 func authenticate(c *gin.Context) {
-	key := c.GetHeader("key")
-	secret := c.GetHeader("secret")
-
-	if key != validCredentials["key"] || secret != validCredentials["secret"] {
-		c.JSON(http.StatusUnauthorized, gin.H{"error": "Unauthorized"})
+	app, err := authenticateRequest(c)
+	if err != nil {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Unauthorized", "detail": err.Error()})
 		c.Abort()
 		return
 	}
+	c.Set("app", app)
+	c.Set("subject", policySubject{Kind: "key", ID: app.Key})
 	c.Next()
 }
 
 func sendNotification(c *gin.Context) {
+	app := appFromContext(c)
+	if !app.allowPublish(time.Now()) {
+		c.JSON(http.StatusTooManyRequests, gin.H{"error": "Publish rate limit exceeded"})
+		return
+	}
+
 	var notif Notification
 	if err := c.ShouldBindJSON(&notif); err != nil {
 		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid input"})
 		return
 	}
 
-	// Simpan ke DB (jika database tersedia)
-	if useDB {
-		if err := saveToDB(notif.Channel, notif.Data, notif.Event); err != nil {
-			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to save to DB", "detail": err.Error()})
+	targets := setNotificationTargets(&notif)
+	if len(targets) == 0 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid channel"})
+		return
+	}
+	for _, channel := range targets {
+		if validateAppChannel(app.ID, channel) != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid channel", "channel": channel})
+			return
+		}
+		if !authorizeRequest(c, actionPublish, channel) {
 			return
 		}
 	}
 
-	// Broadcast ke client
-	broadcastNotification(notif)
+	if _, err := notificationExpiry(notif, time.Now()); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	deliverAt, err := scheduledTime(notif, time.Now())
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if !deliverAt.IsZero() {
+		scheduleNotification(c, app, notif, deliverAt)
+		return
+	}
+
+	ids, err := publishNotification(app, &notif)
+	perr, failed := err.(*publishError)
+	if failed && ids == nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": perr.message, "detail": perr.err.Error()})
+		return
+	}
+
+	resp := gin.H{
+		"success":   true,
+		"message":   "Notification sent",
+		"id":        notif.ID,
+		"channel":   notif.Channel,
+		"timestamp": notif.Timestamp,
+	}
+	if len(notif.Channels) > 0 {
+		resp["ids"] = ids
+	}
+	status := http.StatusOK
+	if failed {
+		// Stored but not broadcast: it is in the history, and a retry would store it again
+		status = http.StatusAccepted
+		resp["message"] = "Notification stored but not broadcast"
+		resp["error"] = perr.message
+		resp["detail"] = perr.err.Error()
+	}
+	c.JSON(status, resp)
+}
 
-	c.JSON(http.StatusOK, gin.H{"success": true, "message": "Notification sent"})
+// publishError tells which step of publishNotification failed.
+type publishError struct {
+	message string
+	err     error
 }
 
-func searchHandler(c *gin.Context) {
-	if !useDB {
-		c.JSON(http.StatusServiceUnavailable, gin.H{"error": "Database not available"})
-		return
+func (e *publishError) Error() string {
+	return e.message + ": " + e.err.Error()
+}
+
+// publishNotification stores a validated notification and broadcasts it to
+// every instance. It returns the stored id of each target channel.
+func publishNotification(app *App, notif *Notification) (map[string]int64, error) {
+	notif.ID = 0
+	notif.Timestamp = serverTimestamp()
+	notif.Replayed = false
+	notif.IdempotencyKey = ""
+	notif.DeliverAt = nil
+	notif.Delay = ""
+
+	var err error
+	if notif.ExpiresAt, err = notificationExpiry(*notif, notif.Timestamp); err != nil {
+		return nil, &publishError{"Invalid ttl", err}
+	}
+	notif.TTL = ""
+
+	// Simpan ke storage
+	ids, err := storage.saveCopies(app.ID, notif)
+	if err != nil {
+		return nil, &publishError{"Failed to save to DB", err}
+	}
+
+	trackDeliveries(app.ID, *notif, ids)
+
+	// Broadcast ke client di semua instance
+	if err := backplane.Publish(BackplaneMessage{AppID: app.ID, Notification: *notif, ChannelIDs: ids}); err != nil {
+		return ids, &publishError{"Failed to publish notification", err}
 	}
+	return ids, nil
+}
+
+func searchHandler(c *gin.Context) {
+	app := appFromContext(c)
 
 	var req SearchRequest
 	if err := c.ShouldBindJSON(&req); err != nil {
@@ -328,66 +613,29 @@ func searchHandler(c *gin.Context) {
 	}
 
 	// Validasi nama tabel
-	if req.Channel == "" {
-		c.JSON(http.StatusBadRequest, gin.H{"error": "Channel required"})
+	if err := validateAppChannel(app.ID, req.Channel); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if !authorizeRequest(c, actionHistory, req.Channel) {
 		return
 	}
 
-	// Build query
-	baseQuery := `SELECT * FROM "` + req.Channel + `"`
-	conditions := []string{}
-	args := []interface{}{}
-	argIdx := 1
-
+	filters := []queryFilter{}
 	for _, f := range req.Filters {
-		op, ok := allowedOperators[f.Op]
-		if !ok {
-			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid operator: " + f.Op})
-			return
-		}
-		conditions = append(conditions, `"`+f.Field+`" `+op+` $`+strconv.Itoa(argIdx))
-		args = append(args, f.Value)
-		argIdx++
+		filters = append(filters, queryFilter{Field: f.Field, Op: f.Op, Value: f.Value})
 	}
-
-	query := baseQuery
-	if len(conditions) > 0 {
-		query += " WHERE " + strings.Join(conditions, " AND ")
+	if err := validateFilters(filters); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
 	}
-	query += " ORDER BY id DESC LIMIT 100"
 
 	// Eksekusi query
-	rows, err := dbConn.Query(query, args...)
+	result, err := queryNotifications(storageName(app.ID, req.Channel), filters)
 	if err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "Query error", "detail": err.Error()})
 		return
 	}
-	defer rows.Close()
-
-	// Ambil hasil sebagai map[string]interface{}
-	cols, _ := rows.Columns()
-	result := []map[string]interface{}{}
-
-	for rows.Next() {
-		// prepare holder
-		columns := make([]interface{}, len(cols))
-		columnPointers := make([]interface{}, len(cols))
-		for i := range columns {
-			columnPointers[i] = &columns[i]
-		}
-
-		if err := rows.Scan(columnPointers...); err != nil {
-			continue
-		}
-
-		rowMap := make(map[string]interface{})
-		for i, colName := range cols {
-			val := columnPointers[i].(*interface{})
-			rowMap[colName] = *val
-		}
-		result = append(result, rowMap)
-	}
-
 	c.JSON(http.StatusOK, gin.H{"data": result})
 }
 
@@ -411,100 +659,98 @@ var allowedOperators = map[string]string{
 	"ilike": "ILIKE",
 }
 
-func broadcastNotification(notif Notification) {
-	msgLock.Lock()
-	defer msgLock.Unlock()
+// broadcastToApp queues the notification for every local subscriber of the app
+// but the one with exceptSocketID, typically the connection that caused it.
+// Delivery and its metrics are handled by each client's writePump.
+// A notification with several target channels reaches each client once, as the
+// copy of the first target it is subscribed to; channelIDs holds the stored id
+// of each copy.
+func broadcastToApp(appID string, notif Notification, channelIDs map[string]int64, exceptSocketID string) {
+	if notif.Timestamp.IsZero() {
+		notif.Timestamp = serverTimestamp()
+	}
+	if notif.ExpiresAt != nil && !time.Now().Before(*notif.ExpiresAt) {
+		return
+	}
 
-	successCount := 0
-	failedCount := 0
+	targets := notificationTargets(notif)
+	messages := make([]outboundMessage, len(targets))
+	for i, channel := range targets {
+		item := notif
+		item.Channel = channel
+		if channelIDs != nil {
+			item.ID = channelIDs[channel]
+		}
+		payload, err := json.Marshal(item)
+		if err != nil {
+			log.Println("Failed to encode notification:", err)
+			return
+		}
+		messages[i] = outboundMessage{channel: channel, id: item.ID, payload: payload}
+	}
 
-	for client, channel := range clients {
-		if channel == notif.Channel {
-			if err := client.WriteJSON(notif); err != nil {
-				failedCount++
-			} else {
-				successCount++
+	delivered := make(map[*Client]bool)
+	msgLock.Lock()
+	for i, channel := range targets {
+		for client := range subscriptionsFor(appID).match(channel) {
+			if delivered[client] || (exceptSocketID != "" && client.socketID == exceptSocketID) {
+				continue
 			}
+			delivered[client] = true
+			// Hold live messages back until the client's history replay is done
+			if pending, ok := client.replaying[channel]; ok {
+				client.replaying[channel] = append(pending, messages[i])
+				continue
+			}
+			client.enqueue(messages[i])
 		}
 	}
+	msgLock.Unlock()
 
 	// Update metrics
 	metricsLock.Lock()
-	metrics.WebSocketStats.TotalMessagesSent += successCount
-	metrics.WebSocketStats.TotalMessagesFailed += failedCount
-	metrics.WebSocketStats.MessagesByChannel[notif.Channel] += successCount
 	metrics.WebSocketStats.LastMessageTime = time.Now()
 	metricsLock.Unlock()
 }
 
 func getNotifications(c *gin.Context) {
-	if !useDB {
-		c.JSON(http.StatusServiceUnavailable, gin.H{"error": "Database not available"})
-		return
-	}
+	app := appFromContext(c)
 
 	channel := c.Query("channel")
-	if channel == "" {
-		c.JSON(http.StatusBadRequest, gin.H{"error": "Channel is required"})
+	if err := validateAppChannel(app.ID, channel); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if !authorizeRequest(c, actionHistory, channel) {
 		return
 	}
-
-	// Build query
-	baseQuery := `SELECT * FROM "` + channel + `"`
-	conditions := []string{}
-	args := []interface{}{}
-	argIdx := 1
 
 	// Add filters from query parameters
+	filters := []queryFilter{}
 	for key, value := range c.Request.URL.Query() {
 		if key != "channel" && len(value) > 0 {
-			conditions = append(conditions, `"`+key+`" = $`+strconv.Itoa(argIdx))
-			args = append(args, value[0])
-			argIdx++
+			filters = append(filters, queryFilter{Field: key, Op: "==", Value: value[0], Text: true})
 		}
 	}
-
-	query := baseQuery
-	if len(conditions) > 0 {
-		query += " WHERE " + strings.Join(conditions, " AND ")
+	if err := validateFilters(filters); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
 	}
-	query += " ORDER BY id DESC LIMIT 100"
 
 	// Execute query
-	rows, err := dbConn.Query(query, args...)
+	result, err := queryNotifications(storageName(app.ID, channel), filters)
 	if err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "Query error", "detail": err.Error()})
 		return
 	}
-	defer rows.Close()
-
-	// Get results as map[string]interface{}
-	cols, _ := rows.Columns()
-	result := []map[string]interface{}{}
-
-	for rows.Next() {
-		// prepare holder
-		columns := make([]interface{}, len(cols))
-		columnPointers := make([]interface{}, len(cols))
-		for i := range columns {
-			columnPointers[i] = &columns[i]
-		}
-
-		if err := rows.Scan(columnPointers...); err != nil {
-			continue
-		}
-
-		rowMap := make(map[string]interface{})
-		for i, colName := range cols {
-			val := columnPointers[i].(*interface{})
-			rowMap[colName] = *val
-		}
-		result = append(result, rowMap)
-	}
-
 	c.JSON(http.StatusOK, gin.H{"data": result})
 }
 
+// queryNotifications returns the newest notifications of a channel matching every filter.
+func queryNotifications(channel string, filters []queryFilter) ([]map[string]interface{}, error) {
+	return storage.query(channel, filters, 100)
+}
+
 // ------------------ Monitoring Functions ------------------
 
 func updateServerStats() {
@@ -565,13 +811,27 @@ func getMetrics() *Metrics {
 	// Create a copy to avoid race conditions
 	wsStats := *metrics.WebSocketStats
 	serverStats := *metrics.ServerStats
+	wsStats.MessagesByChannel = copyCounts(metrics.WebSocketStats.MessagesByChannel)
+	wsStats.ConnectionsByApp = copyCounts(metrics.WebSocketStats.ConnectionsByApp)
+	wsStats.MessagesByApp = copyCounts(metrics.WebSocketStats.MessagesByApp)
+	retentionStats := *metrics.RetentionStats
+	retentionStats.RowsPrunedByChannel = copyCounts(metrics.RetentionStats.RowsPrunedByChannel)
 
 	return &Metrics{
 		WebSocketStats: &wsStats,
 		ServerStats:    &serverStats,
+		RetentionStats: &retentionStats,
 	}
 }
 
+func copyCounts(counts map[string]int) map[string]int {
+	copied := make(map[string]int, len(counts))
+	for k, v := range counts {
+		copied[k] = v
+	}
+	return copied
+}
+
 func monitorHandler(c *gin.Context) {
 	html := `<!DOCTYPE html>
 <html lang="en">
@@ -753,22 +1013,101 @@ func metricsAPIHandler(c *gin.Context) {
 	c.JSON(http.StatusOK, metrics)
 }
 
+// ------------------ Config Helpers ------------------
+
+func envString(name, fallback string) string {
+	if value := os.Getenv(name); value != "" {
+		return value
+	}
+	return fallback
+}
+
+func envInt(name string, fallback int) int {
+	value := os.Getenv(name)
+	if value == "" {
+		return fallback
+	}
+	n, err := strconv.Atoi(value)
+	if err != nil {
+		log.Println("Invalid value for "+name+", using default:", err)
+		return fallback
+	}
+	return n
+}
+
+func envBool(name string, fallback bool) bool {
+	value := os.Getenv(name)
+	if value == "" {
+		return fallback
+	}
+	b, err := strconv.ParseBool(value)
+	if err != nil {
+		log.Println("Invalid value for "+name+", using default:", err)
+		return fallback
+	}
+	return b
+}
+
+func envDuration(name string, fallback time.Duration) time.Duration {
+	value := os.Getenv(name)
+	if value == "" {
+		return fallback
+	}
+	d, err := time.ParseDuration(value)
+	if err != nil {
+		log.Println("Invalid value for "+name+", using default:", err)
+		return fallback
+	}
+	return d
+}
+
 // ------------------ MAIN ------------------
 
 func main() {
 	godotenv.Load()
 	initDB()
+	if len(os.Args) > 1 && os.Args[1] == "migrate-jsonb" {
+		if err := migrateToJSONB(); err != nil {
+			log.Fatal("Migration failed: ", err)
+		}
+		return
+	}
+	loadStorageConfig()
+	loadApps()
+	loadAuthConfig()
+	loadJWTConfig()
+	loadPolicyConfig()
+	loadCORSConfig()
+	loadBatchConfig()
+	loadIdempotencyConfig()
+	loadDeliveryConfig()
+	loadSchedulerConfig()
+	loadExpiryConfig()
+	loadRetentionConfig()
+	loadClientConfig()
+	loadClientEventConfig()
+	loadHistoryConfig()
+	loadMemoryHistoryConfig()
+	initBackplane()
+	startReaper()
+	startPolicyWatcher()
+	startScheduler()
+	startExpiryPurger()
+	startRetentionWorker()
 
 	r := gin.Default()
-	r.Use(func(c *gin.Context) {
-		c.Writer.Header().Set("Access-Control-Allow-Origin", "*")
-	})
-	r.POST("/notification", authenticate, sendNotification)
+	r.Use(corsMiddleware)
+	r.POST("/notification", authenticate, idempotent, sendNotification)
+	r.POST("/notification/batch", authenticate, idempotent, sendNotificationBatch)
 	r.GET("/ws", handleWebSocket)
 	r.GET("/search", authenticate, searchHandler)
 	r.GET("/notifications", authenticate, getNotifications)
+	r.GET("/notifications/delivery", authenticate, deliveryStatusHandler)
+	r.GET("/scheduled", authenticate, listScheduledHandler)
+	r.DELETE("/scheduled/:id", authenticate, cancelScheduledHandler)
 	r.GET("/monitor", monitorHandler)
 	r.GET("/api/metrics", metricsAPIHandler)
+	r.POST("/api/policy/check", authenticate, policyCheckHandler)
 
 	r.Run(":3000")
 }
@@ -10,6 +10,7 @@ import (
 	"time"
 
 	"github.com/gin-gonic/gin"
+	"github.com/gorilla/websocket"
 	"github.com/stretchr/testify/assert"
 )
 
@@ -17,16 +18,35 @@ import (
 func setupTestRouter() *gin.Engine {
 	gin.SetMode(gin.TestMode)
 	r := gin.Default()
-	r.Use(func(c *gin.Context) {
-		c.Writer.Header().Set("Access-Control-Allow-Origin", "*")
-	})
-	r.POST("/notification", authenticate, sendNotification)
+	r.Use(corsMiddleware)
+	r.POST("/notification", authenticate, idempotent, sendNotification)
+	r.POST("/notification/batch", authenticate, idempotent, sendNotificationBatch)
 	r.GET("/ws", handleWebSocket)
 	r.GET("/search", authenticate, searchHandler)
 	r.GET("/notifications", authenticate, getNotifications)
+	r.GET("/notifications/delivery", authenticate, deliveryStatusHandler)
+	r.GET("/scheduled", authenticate, listScheduledHandler)
+	r.DELETE("/scheduled/:id", authenticate, cancelScheduledHandler)
+	r.POST("/api/policy/check", authenticate, policyCheckHandler)
 	return r
 }
 
+// dialTestWebSocket connects to the test server and returns the connection
+// together with the socket ID announced by the server.
+func dialTestWebSocket(t *testing.T, server *httptest.Server) (*websocket.Conn, string) {
+	conn, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(server.URL, "http")+"/ws", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+
+	var established map[string]interface{}
+	assert.NoError(t, conn.ReadJSON(&established))
+	assert.Equal(t, "connection_established", established["event"])
+	socketID, _ := established["socket_id"].(string)
+	return conn, socketID
+}
+
 // Test authentication
 func TestAuthenticate(t *testing.T) {
 	r := setupTestRouter()
@@ -161,7 +181,7 @@ func TestBroadcastNotification(t *testing.T) {
 	}
 
 	// Test broadcast with no clients
-	broadcastNotification(notification)
+	broadcastToApp(defaultAppID, notification, nil, "")
 	// Should not panic or error
 }
 
@@ -291,3 +311,132 @@ func TestConcurrentNotifications(t *testing.T) {
 		}
 	}
 }
+
+// Test subscribing a single connection to multiple channels
+func TestMultiChannelSubscription(t *testing.T) {
+	server := httptest.NewServer(setupTestRouter())
+	defer server.Close()
+
+	conn, _ := dialTestWebSocket(t, server)
+	defer conn.Close()
+
+	var ack map[string]interface{}
+	for _, channel := range []string{"multi_a", "multi_b"} {
+		assert.NoError(t, conn.WriteJSON(ControlFrame{Action: "subscribe", Channel: channel}))
+		assert.NoError(t, conn.ReadJSON(&ack))
+		assert.Equal(t, "Subscribed to channel", ack["message"])
+		assert.Equal(t, channel, ack["channel"])
+	}
+
+	for _, channel := range []string{"multi_a", "multi_b"} {
+		broadcastToApp(defaultAppID, Notification{Channel: channel, Event: "test_event"}, nil, "")
+		var received Notification
+		assert.NoError(t, conn.ReadJSON(&received))
+		assert.Equal(t, channel, received.Channel)
+	}
+
+	assert.NoError(t, conn.WriteJSON(ControlFrame{Action: "unsubscribe", Channel: "multi_a"}))
+	assert.NoError(t, conn.ReadJSON(&ack))
+	assert.Equal(t, "Unsubscribed from channel", ack["message"])
+
+	// Only the notification for the remaining subscription should arrive
+	broadcastToApp(defaultAppID, Notification{Channel: "multi_a", Event: "test_event"}, nil, "")
+	broadcastToApp(defaultAppID, Notification{Channel: "multi_b", Event: "test_event"}, nil, "")
+	var received Notification
+	assert.NoError(t, conn.ReadJSON(&received))
+	assert.Equal(t, "multi_b", received.Channel)
+}
+
+// Test publishing one notification to several channels
+func TestPublishToMultipleChannels(t *testing.T) {
+	router := setupTestRouter()
+	server := httptest.NewServer(router)
+	defer server.Close()
+
+	both, _ := dialTestWebSocket(t, server)
+	defer both.Close()
+	audit, _ := dialTestWebSocket(t, server)
+	defer audit.Close()
+
+	var ack map[string]interface{}
+	for _, channel := range []string{"multi_user.12", "multi_team.4"} {
+		assert.NoError(t, both.WriteJSON(ControlFrame{Action: "subscribe", Channel: channel}))
+		assert.NoError(t, both.ReadJSON(&ack))
+	}
+	assert.NoError(t, audit.WriteJSON(ControlFrame{Action: "subscribe", Channel: "multi_audit"}))
+	assert.NoError(t, audit.ReadJSON(&ack))
+
+	code := publishAs(router, "key", "secret", Notification{
+		Channel:  "multi_user.12",
+		Channels: []string{"multi_team.4", "multi_audit", "multi_user.12"},
+		Event:    "fanout",
+	})
+	assert.Equal(t, http.StatusOK, code)
+
+	var received Notification
+	assert.NoError(t, both.ReadJSON(&received))
+	assert.Equal(t, "multi_user.12", received.Channel)
+	assert.Equal(t, []string{"multi_user.12", "multi_team.4", "multi_audit"}, received.Channels)
+
+	assert.NoError(t, audit.ReadJSON(&received))
+	assert.Equal(t, "multi_audit", received.Channel)
+
+	// The subscriber of both channels gets a single copy
+	broadcastToApp(defaultAppID, Notification{Channel: "multi_team.4", Event: "marker"}, nil, "")
+	assert.NoError(t, both.ReadJSON(&received))
+	assert.Equal(t, "marker", received.Event)
+
+	// Invalid targets reject the whole notification
+	code = publishAs(router, "key", "secret", Notification{Channel: "multi_audit", Channels: []string{"multi.*"}})
+	assert.Equal(t, http.StatusBadRequest, code)
+	code = publishAs(router, "key", "secret", Notification{Channels: []string{}})
+	assert.Equal(t, http.StatusBadRequest, code)
+}
+
+// Test merging channel and channels into targets
+func TestSetNotificationTargets(t *testing.T) {
+	notif := Notification{Channels: []string{"a", "b", "a", ""}}
+	assert.Equal(t, []string{"a", "b"}, setNotificationTargets(&notif))
+	assert.Equal(t, "a", notif.Channel)
+	assert.Equal(t, []string{"a", "b"}, notif.Channels)
+
+	notif = Notification{Channel: "a", Channels: []string{"a"}}
+	assert.Equal(t, []string{"a"}, setNotificationTargets(&notif))
+	assert.Nil(t, notif.Channels)
+}
+
+// Test that published notifications carry a per-channel id and server timestamp
+func TestNotificationIDsAndTimestamps(t *testing.T) {
+	router := setupTestRouter()
+	server := httptest.NewServer(router)
+	defer server.Close()
+
+	conn, _ := dialTestWebSocket(t, server)
+	defer conn.Close()
+	var ack map[string]interface{}
+	assert.NoError(t, conn.WriteJSON(ControlFrame{Action: "subscribe", Channel: "sequence_channel"}))
+	assert.NoError(t, conn.ReadJSON(&ack))
+
+	var lastID int64
+	for i := 0; i < 3; i++ {
+		before := time.Now().Add(-time.Millisecond)
+		w := publishIdempotent(router, "", Notification{Channel: "sequence_channel", Event: "tick"})
+		assert.Equal(t, http.StatusOK, w.Code)
+
+		var resp struct {
+			ID        int64     `json:"id"`
+			Channel   string    `json:"channel"`
+			Timestamp time.Time `json:"timestamp"`
+		}
+		assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &resp))
+		assert.Greater(t, resp.ID, lastID)
+		assert.Equal(t, "sequence_channel", resp.Channel)
+		assert.True(t, resp.Timestamp.After(before))
+		lastID = resp.ID
+
+		var received Notification
+		assert.NoError(t, conn.ReadJSON(&received))
+		assert.Equal(t, resp.ID, received.ID)
+		assert.True(t, resp.Timestamp.Equal(received.Timestamp))
+	}
+}
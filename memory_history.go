@@ -0,0 +1,320 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// When no database is configured, notifications are kept in a per-channel ring
+// buffer so /notifications, /search and subscribe-time replay still work.
+var (
+	memoryHistorySize = 1000
+	memoryHistoryTTL  = 24 * time.Hour // zero keeps notifications until overwritten
+
+	memoryHistory = newMemoryStore()
+)
+
+func loadMemoryHistoryConfig() {
+	memoryHistorySize = envInt("HISTORY_BUFFER_SIZE", memoryHistorySize)
+	memoryHistoryTTL = envDuration("HISTORY_BUFFER_TTL", memoryHistoryTTL)
+	if memoryHistorySize < 1 {
+		log.Println("HISTORY_BUFFER_SIZE must be positive, using 1")
+		memoryHistorySize = 1
+	}
+}
+
+// memoryStore keeps a ring buffer per app-scoped channel name (see storageName).
+type memoryStore struct {
+	mu      sync.RWMutex
+	buffers map[string]*ringBuffer
+}
+
+// ringBuffer holds the newest notifications of one channel. IDs increase
+// monotonically per channel, like the SERIAL id of a channel table.
+type ringBuffer struct {
+	items  []storedNotification
+	start  int // index of the oldest item
+	count  int
+	lastID int64
+}
+
+type storedNotification struct {
+	Notification
+	CreatedAt time.Time
+}
+
+func newMemoryStore() *memoryStore {
+	return &memoryStore{buffers: make(map[string]*ringBuffer)}
+}
+
+// append stores the notification under name and returns it with its assigned id.
+func (m *memoryStore) append(name string, notif Notification) Notification {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	buf, ok := m.buffers[name]
+	if !ok {
+		buf = &ringBuffer{items: make([]storedNotification, memoryHistorySize)}
+		m.buffers[name] = buf
+	}
+
+	buf.lastID++
+	notif.ID = buf.lastID
+	if notif.Timestamp.IsZero() {
+		notif.Timestamp = serverTimestamp()
+	}
+	item := storedNotification{Notification: notif, CreatedAt: notif.Timestamp}
+
+	if buf.count < len(buf.items) {
+		buf.items[(buf.start+buf.count)%len(buf.items)] = item
+		buf.count++
+	} else {
+		buf.items[buf.start] = item
+		buf.start = (buf.start + 1) % len(buf.items)
+	}
+	return notif
+}
+
+// snapshot returns the unexpired notifications of a channel, oldest first.
+func (m *memoryStore) snapshot(name string, now time.Time) []storedNotification {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	buf, ok := m.buffers[name]
+	if !ok {
+		return nil
+	}
+
+	items := make([]storedNotification, 0, buf.count)
+	for i := 0; i < buf.count; i++ {
+		item := buf.items[(buf.start+i)%len(buf.items)]
+		if memoryHistoryTTL > 0 && now.Sub(item.CreatedAt) > memoryHistoryTTL {
+			continue
+		}
+		if item.expired(now) {
+			continue
+		}
+		items = append(items, item)
+	}
+	return items
+}
+
+func (m *memoryStore) save(name string, notif Notification) (int64, error) {
+	return m.append(name, notif).ID, nil
+}
+
+func (m *memoryStore) saveCopies(appID string, notif *Notification) (map[string]int64, error) {
+	ids := map[string]int64{}
+	for _, channel := range notificationTargets(*notif) {
+		stored := *notif
+		stored.Channel = channel
+		stored.Channels = nil
+		ids[channel] = m.append(storageName(appID, channel), stored).ID
+	}
+	notif.ID = ids[notif.Channel]
+	return ids, nil
+}
+
+func (m *memoryStore) saveBatch(appID string, batch []*Notification) ([]map[string]int64, []error, error) {
+	ids := make([]map[string]int64, len(batch))
+	for i, notif := range batch {
+		ids[i], _ = m.saveCopies(appID, notif)
+	}
+	return ids, make([]error, len(batch)), nil
+}
+
+// retain keeps the items for which keep returns true, given their position
+// from the oldest, and returns how many were removed.
+func (buf *ringBuffer) retain(keep func(i int, item storedNotification) bool) int {
+	kept := make([]storedNotification, len(buf.items))
+	count := 0
+	for i := 0; i < buf.count; i++ {
+		item := buf.items[(buf.start+i)%len(buf.items)]
+		if keep(i, item) {
+			kept[count] = item
+			count++
+		}
+	}
+	removed := buf.count - count
+	if removed > 0 {
+		buf.items, buf.start, buf.count = kept, 0, count
+	}
+	return removed
+}
+
+// purgeExpired drops notifications whose TTL has passed and returns how many were removed.
+func (m *memoryStore) purgeExpired(now time.Time) (int64, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	var purged int64
+	for _, buf := range m.buffers {
+		purged += int64(buf.retain(func(_ int, item storedNotification) bool { return !item.expired(now) }))
+	}
+	return purged, nil
+}
+
+// prune drops the notifications of a channel older than maxAge and beyond the newest maxRows.
+func (m *memoryStore) prune(name string, now time.Time, maxAge time.Duration, maxRows int) (int, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	buf, ok := m.buffers[name]
+	if !ok {
+		return 0, nil
+	}
+	count := buf.count
+	return buf.retain(func(i int, item storedNotification) bool {
+		if maxAge > 0 && item.CreatedAt.Before(now.Add(-maxAge)) {
+			return false
+		}
+		return maxRows <= 0 || i >= count-maxRows
+	}), nil
+}
+
+func (m *memoryStore) channels() ([]string, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	names := make([]string, 0, len(m.buffers))
+	for name := range m.buffers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names, nil
+}
+
+func (m *memoryStore) history(name string, sinceID int64, since time.Time, limit int) ([]Notification, error) {
+	history := []Notification{}
+	for _, item := range m.snapshot(name, time.Now()) {
+		if len(history) >= limit {
+			break
+		}
+		if item.ID > sinceID && (since.IsZero() || item.CreatedAt.After(since)) {
+			history = append(history, item.Notification)
+		}
+	}
+	return history, nil
+}
+
+// query returns rows shaped like channel table rows, newest first, keeping
+// those that satisfy every filter.
+func (m *memoryStore) query(name string, filters []queryFilter, limit int) ([]map[string]interface{}, error) {
+	for _, f := range filters {
+		if _, ok := allowedOperators[f.Op]; !ok {
+			return nil, fmt.Errorf("Invalid operator: %s", f.Op)
+		}
+	}
+
+	items := m.snapshot(name, time.Now())
+	result := []map[string]interface{}{}
+	for i := len(items) - 1; i >= 0 && len(result) < limit; i-- {
+		row := items[i].row()
+		if matchesFilters(row, filters) {
+			result = append(result, row)
+		}
+	}
+	return result, nil
+}
+
+func (s storedNotification) row() map[string]interface{} {
+	row := make(map[string]interface{}, len(s.Data)+3)
+	for field, value := range s.Data {
+		row[field] = value
+	}
+	row["id"] = s.ID
+	row["created_at"] = s.CreatedAt
+	row["event"] = s.Event
+	if s.ExpiresAt != nil {
+		row["expires_at"] = *s.ExpiresAt
+	}
+	return row
+}
+
+func (s storedNotification) expired(now time.Time) bool {
+	return s.ExpiresAt != nil && !now.Before(*s.ExpiresAt)
+}
+
+func matchesFilters(row map[string]interface{}, filters []queryFilter) bool {
+	for _, f := range filters {
+		value, ok := row[f.Field]
+		if !ok || value == nil || !compareFilter(value, f.Op, f.Value) {
+			return false
+		}
+	}
+	return true
+}
+
+// compareFilter applies an operator to a value kept in memory: numerically when
+// both sides read as numbers, otherwise as strings. This is not what Postgres
+// does with the per-channel tables, which store data as TEXT and compare the
+// text ("10" < "9"), nor what the jsonb and SQLite stores do, which never match
+// a number against a string.
+func compareFilter(value interface{}, op string, target interface{}) bool {
+	left, right := fmt.Sprint(value), fmt.Sprint(target)
+
+	switch op {
+	case "like":
+		return likePattern(right, false).MatchString(left)
+	case "ilike":
+		return likePattern(right, true).MatchString(left)
+	}
+
+	cmp := strings.Compare(left, right)
+	if l, err := strconv.ParseFloat(left, 64); err == nil {
+		if r, err := strconv.ParseFloat(right, 64); err == nil {
+			switch {
+			case l < r:
+				cmp = -1
+			case l > r:
+				cmp = 1
+			default:
+				cmp = 0
+			}
+		}
+	}
+
+	switch op {
+	case "==":
+		return cmp == 0
+	case "!=":
+		return cmp != 0
+	case ">":
+		return cmp > 0
+	case "<":
+		return cmp < 0
+	case ">=":
+		return cmp >= 0
+	case "<=":
+		return cmp <= 0
+	}
+	return false
+}
+
+// likePattern translates a SQL LIKE pattern into an anchored regular expression.
+func likePattern(pattern string, caseInsensitive bool) *regexp.Regexp {
+	var b strings.Builder
+	b.WriteString("(?s")
+	if caseInsensitive {
+		b.WriteString("i")
+	}
+	b.WriteString(")^")
+	for _, r := range pattern {
+		switch r {
+		case '%':
+			b.WriteString(".*")
+		case '_':
+			b.WriteString(".")
+		default:
+			b.WriteString(regexp.QuoteMeta(string(r)))
+		}
+	}
+	b.WriteString("$")
+	return regexp.MustCompile(b.String())
+}
@@ -0,0 +1,135 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// Test that the ring buffer keeps the newest notifications with increasing ids
+func TestMemoryStoreRingBuffer(t *testing.T) {
+	defer func(size int) { memoryHistorySize = size }(memoryHistorySize)
+	memoryHistorySize = 3
+
+	store := newMemoryStore()
+	for i := 1; i <= 5; i++ {
+		notif := store.append("ring", Notification{Channel: "ring", Event: "tick", Data: map[string]interface{}{"n": i}})
+		assert.Equal(t, int64(i), notif.ID)
+	}
+
+	history, _ := store.history("ring", 0, time.Time{}, 10)
+	if assert.Len(t, history, 3) {
+		assert.Equal(t, []int64{3, 4, 5}, []int64{history[0].ID, history[1].ID, history[2].ID})
+	}
+	history, _ = store.history("ring", 4, time.Time{}, 10)
+	assert.Len(t, history, 1)
+	history, _ = store.history("ring", 0, time.Time{}, 2)
+	assert.Len(t, history, 2)
+	history, _ = store.history("other", 0, time.Time{}, 10)
+	assert.Empty(t, history)
+}
+
+// Test that expired notifications are hidden
+func TestMemoryStoreTTL(t *testing.T) {
+	defer func(ttl time.Duration) { memoryHistoryTTL = ttl }(memoryHistoryTTL)
+	memoryHistoryTTL = time.Minute
+
+	store := newMemoryStore()
+	store.append("ttl", Notification{Channel: "ttl", Event: "old"})
+	store.buffers["ttl"].items[0].CreatedAt = time.Now().Add(-2 * time.Minute)
+	store.append("ttl", Notification{Channel: "ttl", Event: "new"})
+
+	history, _ := store.history("ttl", 0, time.Time{}, 10)
+	if assert.Len(t, history, 1) {
+		assert.Equal(t, "new", history[0].Event)
+	}
+}
+
+// Test filtering stored notifications with search operators
+func TestMemoryStoreQuery(t *testing.T) {
+	store := newMemoryStore()
+	store.append("q", Notification{Channel: "q", Event: "order", Data: map[string]interface{}{"amount": 5, "sender": "Alice"}})
+	store.append("q", Notification{Channel: "q", Event: "order", Data: map[string]interface{}{"amount": 20, "sender": "bob"}})
+	store.append("q", Notification{Channel: "q", Event: "refund", Data: map[string]interface{}{"amount": 100, "sender": "alice"}})
+
+	rows, err := store.query("q", []queryFilter{{Field: "amount", Op: ">", Value: "9"}}, 100)
+	assert.NoError(t, err)
+	if assert.Len(t, rows, 2) {
+		// Newest first, like ORDER BY id DESC
+		assert.Equal(t, int64(3), rows[0]["id"])
+	}
+
+	rows, _ = store.query("q", []queryFilter{{Field: "sender", Op: "ilike", Value: "ali%"}, {Field: "event", Op: "==", Value: "order"}}, 100)
+	assert.Len(t, rows, 1)
+
+	rows, _ = store.query("q", []queryFilter{{Field: "sender", Op: "like", Value: "ali%"}}, 100)
+	assert.Len(t, rows, 1)
+
+	_, err = store.query("q", []queryFilter{{Field: "sender", Op: "~", Value: "x"}}, 100)
+	assert.Error(t, err)
+}
+
+// Test that published notifications are replayed from memory on subscribe
+func TestMemoryHistoryReplay(t *testing.T) {
+	if useDB {
+		t.Skip("in-memory history is only used without a database")
+	}
+	router := setupTestRouter()
+	server := httptest.NewServer(router)
+	defer server.Close()
+
+	for _, message := range []string{"first", "second"} {
+		body, _ := json.Marshal(Notification{Channel: "memory_replay", Event: "chat", Data: map[string]interface{}{"message": message}})
+		req, _ := http.NewRequest("POST", "/notification", bytes.NewBuffer(body))
+		req.Header.Set("key", "key")
+		req.Header.Set("secret", "secret")
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+		assert.Equal(t, http.StatusOK, w.Code)
+	}
+
+	conn, _ := dialTestWebSocket(t, server)
+	defer conn.Close()
+	assert.NoError(t, conn.WriteJSON(ControlFrame{Channel: "memory_replay", SinceID: 1}))
+
+	var ack map[string]interface{}
+	assert.NoError(t, conn.ReadJSON(&ack))
+	assert.Equal(t, "Subscribed to channel", ack["message"])
+
+	var replayed Notification
+	assert.NoError(t, conn.ReadJSON(&replayed))
+	assert.True(t, replayed.Replayed)
+	assert.Equal(t, int64(2), replayed.ID)
+	assert.Equal(t, "second", replayed.Data["message"])
+
+	assert.NoError(t, conn.ReadJSON(&ack))
+	assert.Equal(t, "History replayed", ack["message"])
+	assert.Equal(t, float64(1), ack["count"])
+}
+
+// Test that retention prunes the ring buffer by age and by count
+func TestMemoryStorePrune(t *testing.T) {
+	store := newMemoryStore()
+	for i := 0; i < 4; i++ {
+		store.append("prune", Notification{Channel: "prune", Event: "tick"})
+	}
+	store.buffers["prune"].items[0].CreatedAt = time.Now().Add(-2 * time.Hour)
+
+	n, err := store.prune("prune", time.Now(), time.Hour, 0)
+	assert.NoError(t, err)
+	assert.Equal(t, 1, n)
+	n, _ = store.prune("prune", time.Now(), 0, 2)
+	assert.Equal(t, 1, n)
+
+	history, _ := store.history("prune", 0, time.Time{}, 10)
+	if assert.Len(t, history, 2) {
+		assert.Equal(t, int64(3), history[0].ID)
+	}
+	channels, _ := store.channels()
+	assert.Equal(t, []string{"prune"}, channels)
+}
@@ -0,0 +1,326 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Channel authorization policy. Rules are read from POLICY_FILE and evaluated
+// in order; the first rule matching the subject, action and channel decides.
+// Without a policy file every authenticated request is allowed.
+//
+//	{
+//	  "default": "deny",
+//	  "rules": [
+//	    {"effect": "allow", "subjects": ["user:*"], "actions": ["subscribe", "history"], "channels": ["user.{id}.#"]},
+//	    {"effect": "allow", "subjects": ["key:billing-key"], "actions": ["publish"], "channels": ["billing.#"]}
+//	  ]
+//	}
+const (
+	actionPublish   = "publish"
+	actionSubscribe = "subscribe"
+	actionHistory   = "history"
+
+	effectAllow = "allow"
+	effectDeny  = "deny"
+
+	// Replaced with the subject ID in rule channel patterns
+	subjectIDPlaceholder = "{id}"
+)
+
+var (
+	policyFile           = ""
+	policyReloadInterval = 5 * time.Second
+
+	policyLock    sync.RWMutex
+	currentPolicy *policy // nil when no policy file is configured
+)
+
+type policy struct {
+	Default string       `json:"default"`
+	Rules   []policyRule `json:"rules"`
+
+	modTime time.Time
+}
+
+type policyRule struct {
+	Name     string            `json:"name,omitempty"`
+	Effect   string            `json:"effect"`
+	Subjects []string          `json:"subjects"` // "user:42", "user:*", "key:<app key>", "anonymous" or "*"
+	Actions  []string          `json:"actions"`  // publish, subscribe, history or "*"
+	Channels []string          `json:"channels"` // channel patterns, may contain {id}
+	Claims   map[string]string `json:"claims,omitempty"`
+}
+
+// policySubject is who is asking: a WebSocket user identified by the JWT sub
+// claim, a REST caller identified by its app key, or an anonymous connection.
+type policySubject struct {
+	Kind   string
+	ID     string
+	Claims map[string]interface{}
+}
+
+func (s policySubject) String() string {
+	if s.ID == "" {
+		return s.Kind
+	}
+	return s.Kind + ":" + s.ID
+}
+
+// parseSubject reads a subject written as "kind:id", as used in the policy file.
+func parseSubject(subject string) policySubject {
+	kind, id, _ := strings.Cut(subject, ":")
+	return policySubject{Kind: kind, ID: id}
+}
+
+type policyDecision struct {
+	Allowed bool   `json:"allowed"`
+	Rule    *int   `json:"rule,omitempty"` // index of the deciding rule, nil for the default
+	Name    string `json:"name,omitempty"`
+	Reason  string `json:"reason"`
+}
+
+func loadPolicyConfig() {
+	policyFile = envString("POLICY_FILE", policyFile)
+	policyReloadInterval = envDuration("POLICY_RELOAD_INTERVAL", policyReloadInterval)
+	if policyFile == "" {
+		return
+	}
+
+	p, err := readPolicyFile(policyFile)
+	if err != nil {
+		log.Fatal("Failed to load policy file: ", err)
+	}
+	setPolicy(p)
+	log.Println("Loaded channel policy with", len(p.Rules), "rules")
+}
+
+func readPolicyFile(path string) (*policy, error) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return nil, err
+	}
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	p := &policy{Default: effectDeny}
+	if err := json.Unmarshal(content, p); err != nil {
+		return nil, err
+	}
+	if err := p.validate(); err != nil {
+		return nil, err
+	}
+	p.modTime = info.ModTime()
+	return p, nil
+}
+
+func (p *policy) validate() error {
+	if p.Default != effectAllow && p.Default != effectDeny {
+		return fmt.Errorf("default must be %q or %q", effectAllow, effectDeny)
+	}
+	for i, rule := range p.Rules {
+		if rule.Effect != effectAllow && rule.Effect != effectDeny {
+			return fmt.Errorf("rule %d: effect must be %q or %q", i, effectAllow, effectDeny)
+		}
+		if len(rule.Subjects) == 0 || len(rule.Actions) == 0 || len(rule.Channels) == 0 {
+			return fmt.Errorf("rule %d: subjects, actions and channels are required", i)
+		}
+		for _, action := range rule.Actions {
+			switch action {
+			case actionPublish, actionSubscribe, actionHistory, "*":
+			default:
+				return fmt.Errorf("rule %d: unknown action %q", i, action)
+			}
+		}
+		for _, pattern := range rule.Channels {
+			if err := validatePattern(strings.ReplaceAll(pattern, subjectIDPlaceholder, "id")); err != nil {
+				return fmt.Errorf("rule %d: channel %q: %v", i, pattern, err)
+			}
+		}
+	}
+	return nil
+}
+
+func setPolicy(p *policy) {
+	policyLock.Lock()
+	currentPolicy = p
+	policyLock.Unlock()
+}
+
+// startPolicyWatcher reloads the policy file when it changes. A file that fails
+// to parse is logged and the previous policy stays in effect.
+func startPolicyWatcher() {
+	if policyFile == "" {
+		return
+	}
+	go func() {
+		ticker := time.NewTicker(policyReloadInterval)
+		defer ticker.Stop()
+		for range ticker.C {
+			reloadPolicy()
+		}
+	}()
+}
+
+func reloadPolicy() {
+	info, err := os.Stat(policyFile)
+	if err != nil {
+		log.Println("Failed to stat policy file:", err)
+		return
+	}
+
+	policyLock.RLock()
+	unchanged := currentPolicy != nil && info.ModTime().Equal(currentPolicy.modTime)
+	policyLock.RUnlock()
+	if unchanged {
+		return
+	}
+
+	p, err := readPolicyFile(policyFile)
+	if err != nil {
+		log.Println("Failed to reload policy file, keeping the previous policy:", err)
+		return
+	}
+	setPolicy(p)
+	log.Println("Reloaded channel policy with", len(p.Rules), "rules")
+}
+
+// authorize decides whether the subject may perform the action on the channel.
+func authorize(subject policySubject, action, channel string) policyDecision {
+	policyLock.RLock()
+	p := currentPolicy
+	policyLock.RUnlock()
+
+	if p == nil {
+		return policyDecision{Allowed: true, Reason: "No policy configured"}
+	}
+	return p.evaluate(subject, action, channel)
+}
+
+func (p *policy) evaluate(subject policySubject, action, channel string) policyDecision {
+	for i, rule := range p.Rules {
+		if rule.matches(subject, action, channel) {
+			index := i
+			return policyDecision{
+				Allowed: rule.Effect == effectAllow,
+				Rule:    &index,
+				Name:    rule.Name,
+				Reason:  "Matched rule " + rule.Effect,
+			}
+		}
+	}
+	return policyDecision{Allowed: p.Default == effectAllow, Reason: "No rule matched, default " + p.Default}
+}
+
+func (r policyRule) matches(subject policySubject, action, channel string) bool {
+	if !matchesAny(r.Actions, action) || !matchesAny(r.Subjects, subject.String()) {
+		return false
+	}
+	for claim, value := range r.Claims {
+		if !claimContains(subject.Claims[claim], value) {
+			return false
+		}
+	}
+	for _, pattern := range r.Channels {
+		if strings.Contains(pattern, subjectIDPlaceholder) {
+			id := subject.ID
+			// An ID that is not a single plain segment could widen the pattern
+			if id == "" || strings.ContainsAny(id, ".*#:") {
+				if r.Effect != effectDeny {
+					continue
+				}
+				id = singleLevelWildcard
+			}
+			pattern = strings.ReplaceAll(pattern, subjectIDPlaceholder, id)
+		}
+		// An allow rule must cover every channel of a wildcard request, a deny
+		// rule applies as soon as it matches one of them
+		if r.Effect == effectDeny && patternsOverlap(pattern, channel) {
+			return true
+		}
+		if r.Effect != effectDeny && patternCovers(pattern, channel) {
+			return true
+		}
+	}
+	return false
+}
+
+// matchesAny reports whether value equals one of the patterns, where "*" matches
+// anything and a trailing "*" matches any suffix.
+func matchesAny(patterns []string, value string) bool {
+	for _, pattern := range patterns {
+		if pattern == "*" || pattern == value {
+			return true
+		}
+		if strings.HasSuffix(pattern, "*") && strings.HasPrefix(value, strings.TrimSuffix(pattern, "*")) {
+			return true
+		}
+	}
+	return false
+}
+
+// subject identifies the WebSocket client for policy decisions.
+func (cl *Client) subject() policySubject {
+	if sub, ok := cl.claims["sub"].(string); ok && sub != "" {
+		return policySubject{Kind: "user", ID: sub, Claims: cl.claims}
+	}
+	return policySubject{Kind: "anonymous"}
+}
+
+func subjectFromContext(c *gin.Context) policySubject {
+	if subject, ok := c.Get("subject"); ok {
+		return subject.(policySubject)
+	}
+	return policySubject{Kind: "anonymous"}
+}
+
+// authorizeRequest applies the policy to a REST request, responding with 403 when denied.
+func authorizeRequest(c *gin.Context, action, channel string) bool {
+	decision := authorize(subjectFromContext(c), action, channel)
+	if !decision.Allowed {
+		c.JSON(http.StatusForbidden, gin.H{"error": "Forbidden by policy", "action": action, "channel": channel})
+		return false
+	}
+	return true
+}
+
+// policyCheckHandler evaluates a decision without performing the action.
+func policyCheckHandler(c *gin.Context) {
+	var req struct {
+		Subject string                 `json:"subject"`
+		Action  string                 `json:"action"`
+		Channel string                 `json:"channel"`
+		Claims  map[string]interface{} `json:"claims,omitempty"`
+	}
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid input"})
+		return
+	}
+	if req.Subject == "" || req.Action == "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "subject and action are required"})
+		return
+	}
+	if err := validatePattern(req.Channel); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	subject := parseSubject(req.Subject)
+	subject.Claims = req.Claims
+	c.JSON(http.StatusOK, gin.H{
+		"subject":  subject.String(),
+		"action":   req.Action,
+		"channel":  req.Channel,
+		"decision": authorize(subject, req.Action, req.Channel),
+	})
+}
@@ -0,0 +1,212 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+const testPolicy = `{
+  "default": "deny",
+  "rules": [
+    {"name": "own-channels", "effect": "allow", "subjects": ["user:*"], "actions": ["subscribe", "history"], "channels": ["user.{id}.#"]},
+    {"effect": "allow", "subjects": ["user:*"], "actions": ["*"], "channels": ["admin.#"], "claims": {"role": "admin"}},
+    {"effect": "deny", "subjects": ["key:key"], "actions": ["publish"], "channels": ["billing.internal"]},
+    {"effect": "allow", "subjects": ["key:key"], "actions": ["publish", "history"], "channels": ["billing.#"]}
+  ]
+}`
+
+func withPolicy(t *testing.T, content string) string {
+	path := filepath.Join(t.TempDir(), "policy.json")
+	assert.NoError(t, os.WriteFile(path, []byte(content), 0o644))
+	p, err := readPolicyFile(path)
+	if !assert.NoError(t, err) {
+		t.FailNow()
+	}
+
+	file := policyFile
+	policyFile = path
+	setPolicy(p)
+	t.Cleanup(func() {
+		policyFile = file
+		setPolicy(nil)
+	})
+	return path
+}
+
+// Test rule matching, ordering and the {id} placeholder
+func TestPolicyEvaluate(t *testing.T) {
+	withPolicy(t, testPolicy)
+	user42 := policySubject{Kind: "user", ID: "42"}
+	key := policySubject{Kind: "key", ID: "key"}
+
+	decision := authorize(user42, actionSubscribe, "user.42.orders")
+	assert.True(t, decision.Allowed)
+	assert.Equal(t, "own-channels", decision.Name)
+	assert.True(t, authorize(user42, actionSubscribe, "user.42.*").Allowed)
+	assert.False(t, authorize(user42, actionSubscribe, "user.43.orders").Allowed)
+	assert.False(t, authorize(user42, actionSubscribe, "user.#").Allowed)
+	assert.False(t, authorize(user42, actionPublish, "user.42.orders").Allowed)
+
+	// IDs that would widen the pattern never match
+	assert.False(t, authorize(policySubject{Kind: "user", ID: "#"}, actionSubscribe, "user.43.orders").Allowed)
+
+	assert.True(t, authorize(key, actionPublish, "billing.invoices").Allowed)
+	assert.False(t, authorize(key, actionPublish, "billing.internal").Allowed)
+	assert.False(t, authorize(key, actionPublish, "orders.created").Allowed)
+	assert.False(t, authorize(policySubject{Kind: "anonymous"}, actionSubscribe, "user.42.orders").Allowed)
+
+	admin := policySubject{Kind: "user", ID: "7", Claims: map[string]interface{}{"role": "admin"}}
+	assert.True(t, authorize(admin, actionPublish, "admin.alerts").Allowed)
+	assert.False(t, authorize(user42, actionPublish, "admin.alerts").Allowed)
+
+	setPolicy(nil)
+	assert.True(t, authorize(user42, actionPublish, "anything").Allowed)
+}
+
+// Test that invalid policy files are rejected
+func TestPolicyValidate(t *testing.T) {
+	for _, content := range []string{
+		`{"default": "maybe"}`,
+		`{"rules": [{"effect": "allow", "subjects": ["*"], "actions": ["delete"], "channels": ["#"]}]}`,
+		`{"rules": [{"effect": "allow", "subjects": ["*"], "actions": ["publish"], "channels": ["orders.#.created"]}]}`,
+		`{"rules": [{"effect": "allow", "actions": ["publish"], "channels": ["orders"]}]}`,
+	} {
+		path := filepath.Join(t.TempDir(), "policy.json")
+		os.WriteFile(path, []byte(content), 0o644)
+		_, err := readPolicyFile(path)
+		assert.Error(t, err, content)
+	}
+}
+
+// Test that REST publishes and history reads are checked
+func TestPolicyREST(t *testing.T) {
+	withPolicy(t, testPolicy)
+	router := setupTestRouter()
+
+	publish := func(channel string) int {
+		body, _ := json.Marshal(Notification{Channel: channel, Event: "created"})
+		req, _ := http.NewRequest("POST", "/notification", bytes.NewBuffer(body))
+		req.Header.Set("key", "key")
+		req.Header.Set("secret", "secret")
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+		return w.Code
+	}
+	assert.Equal(t, http.StatusOK, publish("billing.invoices"))
+	assert.Equal(t, http.StatusForbidden, publish("billing.internal"))
+	assert.Equal(t, http.StatusForbidden, publish("orders"))
+
+	req, _ := http.NewRequest("GET", "/notifications?channel=orders", nil)
+	req.Header.Set("key", "key")
+	req.Header.Set("secret", "secret")
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusForbidden, w.Code)
+}
+
+// Test that WebSocket subscriptions use the JWT subject
+func TestPolicyWebSocket(t *testing.T) {
+	withPolicy(t, testPolicy)
+	withJWTSecret(t, "jwt-secret")
+	server := httptest.NewServer(setupTestRouter())
+	defer server.Close()
+
+	token := hs256Token("jwt-secret", map[string]interface{}{"sub": "42"})
+	conn, _, err := dialJWT(server, "?token="+token, nil)
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer conn.Close()
+
+	var reply map[string]interface{}
+	conn.WriteJSON(ControlFrame{Action: "subscribe", Channel: "user.42.orders"})
+	assert.NoError(t, conn.ReadJSON(&reply))
+	assert.Equal(t, "Subscribed to channel", reply["message"])
+
+	reply = nil
+	conn.WriteJSON(ControlFrame{Action: "subscribe", Channel: "user.43.orders"})
+	assert.NoError(t, conn.ReadJSON(&reply))
+	assert.Equal(t, "Forbidden by policy", reply["error"])
+}
+
+// Test that a deny rule applies to wildcard subscriptions that include its channels
+func TestPolicyDenyWildcard(t *testing.T) {
+	withPolicy(t, `{
+  "default": "allow",
+  "rules": [
+    {"effect": "deny", "subjects": ["user:*"], "actions": ["subscribe"], "channels": ["user.43.*"]},
+    {"effect": "deny", "subjects": ["user:*"], "actions": ["subscribe"], "channels": ["private.{id}.#"]}
+  ]
+}`)
+	user42 := policySubject{Kind: "user", ID: "42"}
+	for _, channel := range []string{"#", "user.#", "user.*.orders", "user.43.orders", "private.42", "*.*.x"} {
+		assert.False(t, authorize(user42, actionSubscribe, channel).Allowed, channel)
+	}
+	for _, channel := range []string{"user.42.orders", "user.43", "user.43.orders.x", "orders.#", "*"} {
+		assert.True(t, authorize(user42, actionSubscribe, channel).Allowed, channel)
+	}
+	// IDs that could widen the pattern make the deny rule broader, not void
+	assert.False(t, authorize(policySubject{Kind: "user", ID: "a.b"}, actionSubscribe, "private.x.y").Allowed)
+
+	withJWTSecret(t, "jwt-secret")
+	server := httptest.NewServer(setupTestRouter())
+	defer server.Close()
+	conn, _, err := dialJWT(server, "?token="+hs256Token("jwt-secret", map[string]interface{}{"sub": "42"}), nil)
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer conn.Close()
+
+	var reply map[string]interface{}
+	conn.WriteJSON(ControlFrame{Action: "subscribe", Channel: "#"})
+	assert.NoError(t, conn.ReadJSON(&reply))
+	assert.Equal(t, "Forbidden by policy", reply["error"])
+}
+
+// Test hot reload, keeping the old policy when the new file is invalid
+func TestPolicyReload(t *testing.T) {
+	path := withPolicy(t, `{"default": "deny"}`)
+	subject := policySubject{Kind: "key", ID: "key"}
+	assert.False(t, authorize(subject, actionPublish, "orders").Allowed)
+
+	os.WriteFile(path, []byte(`{"default": "allow"}`), 0o644)
+	os.Chtimes(path, time.Now(), time.Now().Add(time.Second))
+	reloadPolicy()
+	assert.True(t, authorize(subject, actionPublish, "orders").Allowed)
+
+	os.WriteFile(path, []byte(`{"default": `), 0o644)
+	os.Chtimes(path, time.Now(), time.Now().Add(2*time.Second))
+	reloadPolicy()
+	assert.True(t, authorize(subject, actionPublish, "orders").Allowed)
+}
+
+// Test the dry-run endpoint
+func TestPolicyCheckEndpoint(t *testing.T) {
+	withPolicy(t, testPolicy)
+	router := setupTestRouter()
+
+	body, _ := json.Marshal(map[string]interface{}{"subject": "user:42", "action": "subscribe", "channel": "user.42.orders"})
+	req, _ := http.NewRequest("POST", "/api/policy/check", bytes.NewBuffer(body))
+	req.Header.Set("key", "key")
+	req.Header.Set("secret", "secret")
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusOK, w.Code)
+
+	var resp struct {
+		Decision policyDecision `json:"decision"`
+	}
+	json.Unmarshal(w.Body.Bytes(), &resp)
+	assert.True(t, resp.Decision.Allowed)
+	if assert.NotNil(t, resp.Decision.Rule) {
+		assert.Equal(t, 0, *resp.Decision.Rule)
+	}
+}
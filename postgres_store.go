@@ -0,0 +1,363 @@
+package main
+
+import (
+	"database/sql"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+// tableStore keeps every channel in its own Postgres table, created by
+// ensureTable with a TEXT column per data field. The tables are listed in
+// ws_channel_tables, and only those are ever read, purged or pruned, so other
+// tables sharing the schema are left alone. Tables of earlier versions are
+// recognized by their id, event and created_at columns.
+type tableStore struct {
+	sqlWriter
+}
+
+// Tables known to have the expires_at column and to be registered
+var (
+	expiryColumns sync.Map
+	channelTables sync.Map
+)
+
+func newTableStore(conn *sql.DB) (*tableStore, error) {
+	if _, err := conn.Exec(`CREATE TABLE IF NOT EXISTS ws_channel_tables (
+		table_name TEXT PRIMARY KEY,
+		created_at TIMESTAMP NOT NULL DEFAULT NOW()
+	)`); err != nil {
+		return nil, err
+	}
+
+	// Channel tables created before the registry existed are registered on start
+	if _, err := conn.Exec(`INSERT INTO ws_channel_tables (table_name)
+		SELECT c.table_name
+		FROM information_schema.columns c
+		JOIN information_schema.tables t ON t.table_schema = c.table_schema AND t.table_name = c.table_name
+		WHERE c.table_schema = current_schema() AND t.table_type = 'BASE TABLE'
+			AND lower(c.table_name) NOT LIKE 'ws\_%'
+			AND c.column_name IN ('id', 'event', 'created_at')
+		GROUP BY c.table_name
+		HAVING COUNT(*) = 3
+		ON CONFLICT DO NOTHING`); err != nil {
+		return nil, err
+	}
+
+	// Tables registered that way may predate message expiry
+	tables, err := queryStrings(conn, `SELECT table_name FROM ws_channel_tables`)
+	if err != nil {
+		return nil, err
+	}
+	for _, table := range tables {
+		if err := ensureExpiryColumn(conn, table); err != nil {
+			return nil, err
+		}
+	}
+	s := &tableStore{}
+	s.sqlWriter = sqlWriter{conn: conn, insertRow: s.insert}
+	return s, nil
+}
+
+// registered reports whether the table was created for a channel.
+func (s *tableStore) registered(table string) (bool, error) {
+	if _, ok := channelTables.Load(table); ok {
+		return true, nil
+	}
+	var exists bool
+	err := s.conn.QueryRow(`SELECT EXISTS (SELECT 1 FROM ws_channel_tables WHERE table_name = $1)`, table).Scan(&exists)
+	if exists {
+		channelTables.Store(table, true)
+	}
+	return exists, err
+}
+
+func (s *tableStore) builder() *queryBuilder {
+	return &queryBuilder{placeholder: "$", zone: time.Local}
+}
+
+func (s *tableStore) insert(q queryer, channel string, notif Notification) (int64, error) {
+	return insertNotification(q, channel, notif)
+}
+
+func (s *tableStore) query(channel string, filters []queryFilter, limit int) ([]map[string]interface{}, error) {
+	if ok, err := s.registered(channel); !ok {
+		// Nothing has been published to the channel yet
+		return []map[string]interface{}{}, err
+	}
+	q := s.builder()
+	q.notExpired(time.Now())
+	for _, f := range filters {
+		q.where(pq.QuoteIdentifier(f.Field) + " " + allowedOperators[f.Op] + " " + q.arg(f.Value))
+	}
+
+	rows, err := s.conn.Query(`SELECT * FROM `+pq.QuoteIdentifier(channel)+` WHERE `+q.whereClause()+` ORDER BY id DESC LIMIT `+strconv.Itoa(limit), q.args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	return scanRows(rows), nil
+}
+
+func (s *tableStore) history(channel string, sinceID int64, since time.Time, limit int) ([]Notification, error) {
+	if ok, err := s.registered(channel); !ok {
+		return nil, err
+	}
+	q := s.builder()
+	q.where("id > " + q.arg(sinceID))
+	q.notExpired(time.Now())
+	if !since.IsZero() {
+		q.where("created_at > " + q.arg(since))
+	}
+
+	rows, err := s.conn.Query(`SELECT * FROM `+pq.QuoteIdentifier(channel)+` WHERE `+q.whereClause()+` ORDER BY id ASC LIMIT `+strconv.Itoa(limit), q.args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	history := []Notification{}
+	for _, row := range scanRows(rows) {
+		history = append(history, rowToNotification(channelFromStorageName(channel), row))
+	}
+	return history, nil
+}
+
+// channels lists the registered channel tables.
+func (s *tableStore) channels() ([]string, error) {
+	return queryStrings(s.conn, `SELECT table_name FROM ws_channel_tables ORDER BY table_name`)
+}
+
+func (s *tableStore) prune(channel string, now time.Time, maxAge time.Duration, maxRows int) (int, error) {
+	return pruneRows(s.conn, pq.QuoteIdentifier(channel), "ctid", s.builder, now, maxAge, maxRows)
+}
+
+func (s *tableStore) purgeExpired(now time.Time) (int64, error) {
+	tables, err := s.channels()
+	if err != nil {
+		return 0, err
+	}
+
+	var purged int64
+	for _, table := range tables {
+		result, err := s.conn.Exec(`DELETE FROM `+pq.QuoteIdentifier(table)+` WHERE expires_at <= $1`, now)
+		if err != nil {
+			return purged, err
+		}
+		n, _ := result.RowsAffected()
+		purged += n
+	}
+	return purged, nil
+}
+
+// registerChannelTable records a table created by ensureTable.
+func registerChannelTable(db queryer, table string) error {
+	if _, ok := channelTables.Load(table); ok {
+		return nil
+	}
+	if _, err := db.Exec(`INSERT INTO ws_channel_tables (table_name) VALUES ($1) ON CONFLICT DO NOTHING`, table); err != nil {
+		return err
+	}
+	// Inside a transaction the row only exists once it commits
+	if _, ok := db.(*sql.DB); ok {
+		channelTables.Store(table, true)
+	}
+	return nil
+}
+
+// ensureExpiryColumn adds expires_at to channel tables created before
+// notifications could expire. It only runs when writing or at startup.
+func ensureExpiryColumn(db queryer, table string) error {
+	if _, ok := expiryColumns.Load(table); ok {
+		return nil
+	}
+
+	var exists bool
+	err := db.QueryRow(`
+		SELECT EXISTS (
+			SELECT 1
+			FROM information_schema.columns
+			WHERE table_schema = current_schema() AND table_name = $1 AND column_name = 'expires_at'
+		)`, table).Scan(&exists)
+	if err != nil {
+		return err
+	}
+	if !exists {
+		if _, err := db.Exec(`ALTER TABLE IF EXISTS ` + pq.QuoteIdentifier(table) + ` ADD COLUMN IF NOT EXISTS expires_at TIMESTAMP`); err != nil {
+			return err
+		}
+	}
+
+	// Inside a transaction the column only exists once it commits
+	if _, ok := db.(*sql.DB); ok {
+		expiryColumns.Store(table, true)
+	}
+	return nil
+}
+
+// queryStrings returns the first column of every row.
+func queryStrings(db *sql.DB, query string, args ...interface{}) ([]string, error) {
+	rows, err := db.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	values := []string{}
+	for rows.Next() {
+		var value string
+		if err := rows.Scan(&value); err != nil {
+			return nil, err
+		}
+		values = append(values, value)
+	}
+	return values, rows.Err()
+}
+
+// Create table if not exists
+func ensureTable(db queryer, channel string, data map[string]interface{}) error {
+	// Base columns
+	columns := []string{
+		"id SERIAL PRIMARY KEY",
+		"created_at TIMESTAMP DEFAULT NOW()",
+		`"event" TEXT`,
+		"expires_at TIMESTAMP",
+	}
+
+	// Add dynamic columns based on data
+	for field := range data {
+		if !reservedColumns[field] {
+			columns = append(columns, pq.QuoteIdentifier(field)+" TEXT")
+		}
+	}
+
+	// Create table if not exists
+	query := `CREATE TABLE IF NOT EXISTS ` + pq.QuoteIdentifier(channel) + ` (` + strings.Join(columns, ", ") + `);`
+	_, err := db.Exec(query)
+	if err != nil {
+		return err
+	}
+
+	// Check if event column exists
+	var eventExists bool
+	err = db.QueryRow(`
+		SELECT EXISTS (
+			SELECT 1 
+			FROM information_schema.columns 
+			WHERE table_schema = current_schema() AND table_name = $1 AND column_name = 'event'
+		)`, channel).Scan(&eventExists)
+
+	if err != nil {
+		return err
+	}
+
+	// Add event column if it doesn't exist
+	if !eventExists {
+		alterQuery := `ALTER TABLE ` + pq.QuoteIdentifier(channel) + ` ADD COLUMN "event" TEXT;`
+		_, err := db.Exec(alterQuery)
+		if err != nil {
+			return err
+		}
+	}
+
+	// Tables created before message expiry lack expires_at
+	if err := ensureExpiryColumn(db, channel); err != nil {
+		return err
+	}
+	if err := registerChannelTable(db, channel); err != nil {
+		return err
+	}
+
+	// Check and add any missing columns
+	for field := range data {
+		if !reservedColumns[field] {
+			// Check if column exists
+			var exists bool
+			err := db.QueryRow(`
+				SELECT EXISTS (
+					SELECT 1 
+					FROM information_schema.columns 
+					WHERE table_schema = current_schema() AND table_name = $1 AND column_name = $2
+				)`, channel, field).Scan(&exists)
+
+			if err != nil {
+				return err
+			}
+
+			// If column doesn't exist, add it
+			if !exists {
+				alterQuery := `ALTER TABLE ` + pq.QuoteIdentifier(channel) + ` ADD COLUMN ` + pq.QuoteIdentifier(field) + ` TEXT;`
+				_, err := db.Exec(alterQuery)
+				if err != nil {
+					return err
+				}
+			}
+		}
+	}
+
+	return nil
+}
+
+// Columns every channel table has, which data fields cannot overwrite
+var reservedColumns = map[string]bool{"id": true, "created_at": true, "event": true, "expires_at": true}
+
+func insertNotification(db queryer, channel string, notif Notification) (int64, error) {
+	if err := ensureTable(db, channel, notif.Data); err != nil {
+		return 0, err
+	}
+
+	// Build dynamic query
+	fields := []string{`"event"`, "expires_at"}
+	placeholders := []string{"$1", "$2"}
+	values := []interface{}{notif.Event, notif.ExpiresAt}
+	valueIndex := 3
+
+	for field, value := range notif.Data {
+		if !reservedColumns[field] {
+			fields = append(fields, pq.QuoteIdentifier(field))
+			placeholders = append(placeholders, "$"+strconv.Itoa(valueIndex))
+			values = append(values, value)
+			valueIndex++
+		}
+	}
+
+	// Add created_at
+	fields = append(fields, "created_at")
+	placeholders = append(placeholders, "$"+strconv.Itoa(valueIndex))
+	values = append(values, notif.Timestamp)
+
+	stmt := `INSERT INTO ` + pq.QuoteIdentifier(channel) + ` (` + strings.Join(fields, ", ") + `) VALUES (` + strings.Join(placeholders, ", ") + `) RETURNING id`
+	var id int64
+	err := db.QueryRow(stmt, values...).Scan(&id)
+	return id, err
+}
+
+// scanRows reads every row of a channel table as map[string]interface{}
+func scanRows(rows *sql.Rows) []map[string]interface{} {
+	cols, _ := rows.Columns()
+	result := []map[string]interface{}{}
+
+	for rows.Next() {
+		// prepare holder
+		columns := make([]interface{}, len(cols))
+		columnPointers := make([]interface{}, len(cols))
+		for i := range columns {
+			columnPointers[i] = &columns[i]
+		}
+
+		if err := rows.Scan(columnPointers...); err != nil {
+			continue
+		}
+
+		rowMap := make(map[string]interface{})
+		for i, colName := range cols {
+			val := columnPointers[i].(*interface{})
+			rowMap[colName] = *val
+		}
+		result = append(result, rowMap)
+	}
+	return result
+}
@@ -0,0 +1,93 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/lib/pq"
+	"github.com/stretchr/testify/assert"
+)
+
+// withTestPostgres connects to TEST_DATABASE_URL with a fresh schema as the
+// search path and makes it the server database. Tests using it are skipped
+// without one.
+func withTestPostgres(t *testing.T) *sql.DB {
+	connString := os.Getenv("TEST_DATABASE_URL")
+	if connString == "" {
+		t.Skip("TEST_DATABASE_URL is not set")
+	}
+	if strings.HasPrefix(connString, "postgres://") || strings.HasPrefix(connString, "postgresql://") {
+		parsed, err := pq.ParseURL(connString)
+		if !assert.NoError(t, err) {
+			t.FailNow()
+		}
+		connString = parsed
+	}
+
+	admin, err := sql.Open("postgres", connString)
+	if !assert.NoError(t, err) {
+		t.FailNow()
+	}
+	schema := fmt.Sprintf("test_%d", time.Now().UnixNano())
+	if _, err := admin.Exec(`CREATE SCHEMA ` + pq.QuoteIdentifier(schema)); !assert.NoError(t, err) {
+		admin.Close()
+		t.FailNow()
+	}
+
+	conn, err := sql.Open("postgres", connString+" search_path="+schema)
+	if !assert.NoError(t, err) {
+		t.FailNow()
+	}
+
+	previousConn, previousUseDB := dbConn, useDB
+	dbConn, useDB = conn, true
+	t.Cleanup(func() {
+		dbConn, useDB = previousConn, previousUseDB
+		conn.Close()
+		admin.Exec(`DROP SCHEMA ` + pq.QuoteIdentifier(schema) + ` CASCADE`)
+		admin.Close()
+	})
+	return conn
+}
+
+// createLegacyChannelTable creates a channel table the way versions without
+// ws_channel_tables did, with one row.
+func createLegacyChannelTable(t *testing.T, db *sql.DB, table string) {
+	for _, statement := range []string{
+		`CREATE TABLE ` + pq.QuoteIdentifier(table) + ` (id SERIAL PRIMARY KEY, created_at TIMESTAMP DEFAULT NOW(), "event" TEXT, amount TEXT)`,
+		`INSERT INTO ` + pq.QuoteIdentifier(table) + ` ("event", amount) VALUES ('created', '10')`,
+	} {
+		if _, err := db.Exec(statement); !assert.NoError(t, err) {
+			t.FailNow()
+		}
+	}
+}
+
+// Test that channel tables of earlier versions stay readable after an upgrade
+func TestTableStoreRegistersLegacyTables(t *testing.T) {
+	db := withTestPostgres(t)
+	createLegacyChannelTable(t, db, "legacy_orders")
+	_, err := db.Exec(`CREATE TABLE users (id SERIAL PRIMARY KEY, name TEXT)`)
+	assert.NoError(t, err)
+
+	store, err := newTableStore(db)
+	if !assert.NoError(t, err) {
+		return
+	}
+	channels, err := store.channels()
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"legacy_orders"}, channels)
+
+	history, err := store.history("legacy_orders", 0, time.Time{}, 10)
+	assert.NoError(t, err)
+	if assert.Len(t, history, 1) {
+		assert.Equal(t, "created", history[0].Event)
+	}
+	rows, err := store.query("legacy_orders", []queryFilter{{Field: "amount", Op: "==", Value: "10"}}, 10)
+	assert.NoError(t, err)
+	assert.Len(t, rows, 1)
+}
@@ -0,0 +1,356 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"log"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Presence channels keep a roster of the users subscribed to them. A user with
+// several connections (e.g. browser tabs) is listed once and only announced
+// when their first connection joins or their last one leaves.
+const presenceChannelPrefix = "presence-"
+
+const (
+	presenceMemberAdded   = "member_added"
+	presenceMemberRemoved = "member_removed"
+	presenceRosterEvent   = "roster"       // an instance's full roster, sent periodically
+	presenceSyncRequest   = "sync_request" // asks every instance to send its roster
+
+	// Roster messages are split to stay below the NOTIFY payload limit
+	presenceChunkSize = 6000
+)
+
+var (
+	// presenceRoster maps app-scoped channel -> user ID -> member. Guarded by msgLock.
+	presenceRoster = make(map[string]map[string]*presenceEntry)
+
+	// remotePresence maps app-scoped channel -> user ID -> instance -> member
+	// for users connected to other instances. Guarded by msgLock.
+	remotePresence = make(map[string]map[string]map[string]*remotePresenceEntry)
+
+	// Identifies this instance in presence events on the backplane
+	instanceID = newSocketID()
+
+	// How often each instance republishes its roster. Remote members that
+	// were not refreshed for three intervals are dropped.
+	presenceSyncInterval = 30 * time.Second
+)
+
+// presenceEvent carries roster changes between instances.
+type presenceEvent struct {
+	Instance string           `json:"instance"`
+	Channel  string           `json:"channel,omitempty"`
+	Event    string           `json:"event"`
+	Members  []presenceMember `json:"members,omitempty"`
+}
+
+type remotePresenceEntry struct {
+	member    presenceMember
+	refreshed time.Time
+}
+
+type presenceMember struct {
+	UserID   string                 `json:"user_id"`
+	UserInfo map[string]interface{} `json:"user_info,omitempty"`
+}
+
+type presenceEntry struct {
+	member  presenceMember
+	clients map[*Client]bool
+}
+
+func isPresenceChannel(channel string) bool {
+	return strings.HasPrefix(channel, presenceChannelPrefix)
+}
+
+// parseChannelData decodes the signed channel_data of a presence subscription.
+// The user ID may be a string or a number.
+func parseChannelData(channelData string) (presenceMember, error) {
+	var data struct {
+		UserID   interface{}            `json:"user_id"`
+		UserInfo map[string]interface{} `json:"user_info"`
+	}
+	if err := json.Unmarshal([]byte(channelData), &data); err != nil {
+		return presenceMember{}, errors.New("Invalid channel_data")
+	}
+
+	member := presenceMember{UserInfo: data.UserInfo}
+	switch id := data.UserID.(type) {
+	case string:
+		member.UserID = id
+	case float64:
+		member.UserID = strconv.FormatFloat(id, 'f', -1, 64)
+	}
+	if member.UserID == "" {
+		return presenceMember{}, errors.New("channel_data must contain user_id")
+	}
+	return member, nil
+}
+
+// presenceJoinLocked adds the client to the channel roster and reports whether
+// this is the user's first connection. msgLock must be held.
+func presenceJoinLocked(client *Client, channel string, member presenceMember) bool {
+	if userID, ok := client.presence[channel]; ok && userID == member.UserID {
+		return false
+	}
+	presenceLeaveLocked(client, channel)
+
+	key := storageName(client.app.ID, channel)
+	members, ok := presenceRoster[key]
+	if !ok {
+		members = make(map[string]*presenceEntry)
+		presenceRoster[key] = members
+	}
+	client.presence[channel] = member.UserID
+
+	entry, ok := members[member.UserID]
+	if ok {
+		entry.clients[client] = true
+		return false
+	}
+	members[member.UserID] = &presenceEntry{member: member, clients: map[*Client]bool{client: true}}
+	return true
+}
+
+// presenceLeaveLocked removes the client from the channel roster and returns
+// the member if that was the user's last connection. msgLock must be held.
+func presenceLeaveLocked(client *Client, channel string) *presenceMember {
+	userID, ok := client.presence[channel]
+	if !ok {
+		return nil
+	}
+	delete(client.presence, channel)
+
+	key := storageName(client.app.ID, channel)
+	entry, ok := presenceRoster[key][userID]
+	if !ok {
+		return nil
+	}
+	delete(entry.clients, client)
+	if len(entry.clients) > 0 {
+		return nil
+	}
+
+	delete(presenceRoster[key], userID)
+	if len(presenceRoster[key]) == 0 {
+		delete(presenceRoster, key)
+	}
+	return &entry.member
+}
+
+// presenceMembersLocked returns the roster of an app channel across all
+// instances, ordered by user ID. msgLock must be held.
+func presenceMembersLocked(appID, channel string) []presenceMember {
+	key := storageName(appID, channel)
+	members := []presenceMember{}
+	for _, entry := range presenceRoster[key] {
+		members = append(members, entry.member)
+	}
+	for userID, instances := range remotePresence[key] {
+		if _, ok := presenceRoster[key][userID]; ok {
+			continue
+		}
+		for _, entry := range instances {
+			members = append(members, entry.member)
+			break
+		}
+	}
+	sort.Slice(members, func(i, j int) bool { return members[i].UserID < members[j].UserID })
+	return members
+}
+
+// presentElsewhereLocked reports whether the user is on the channel through an
+// instance other than origin. msgLock must be held.
+func presentElsewhereLocked(key, userID, origin string) bool {
+	if _, ok := presenceRoster[key][userID]; ok && origin != instanceID {
+		return true
+	}
+	for instance := range remotePresence[key][userID] {
+		if instance != origin {
+			return true
+		}
+	}
+	return false
+}
+
+func presenceNotification(channel, event string, member presenceMember) Notification {
+	return Notification{
+		Channel: channel,
+		Event:   event,
+		Data: map[string]interface{}{
+			"user_id":   member.UserID,
+			"user_info": member.UserInfo,
+		},
+	}
+}
+
+// announcePresence tells the other subscribers of a channel, on every
+// instance, that a member joined or left.
+func announcePresence(channel, event string, member presenceMember, except *Client) {
+	msg := BackplaneMessage{
+		AppID:          except.app.ID,
+		ExceptSocketID: except.socketID,
+		Presence:       &presenceEvent{Instance: instanceID, Channel: channel, Event: event, Members: []presenceMember{member}},
+	}
+	if err := backplane.Publish(msg); err != nil {
+		log.Println("Failed to publish presence event, announcing it locally:", err)
+		handlePresenceEvent(msg.AppID, *msg.Presence, msg.ExceptSocketID, time.Now())
+	}
+}
+
+// handlePresenceEvent applies a presence event from the backplane. Members are
+// only announced when they are not present through another instance.
+func handlePresenceEvent(appID string, ev presenceEvent, exceptSocketID string, now time.Time) {
+	remote := ev.Instance != instanceID
+	if ev.Event == presenceSyncRequest {
+		if remote {
+			publishPresenceRoster()
+		}
+		return
+	}
+	if !remote && ev.Event == presenceRosterEvent {
+		return
+	}
+
+	key := storageName(appID, ev.Channel)
+	announce := []Notification{}
+	msgLock.Lock()
+	for _, member := range ev.Members {
+		switch ev.Event {
+		case presenceMemberAdded, presenceRosterEvent:
+			known := false
+			if remote {
+				known = remotePresence[key][member.UserID][ev.Instance] != nil
+				setRemotePresenceLocked(key, ev.Instance, member, now)
+			}
+			if !known && !presentElsewhereLocked(key, member.UserID, ev.Instance) {
+				announce = append(announce, presenceNotification(ev.Channel, presenceMemberAdded, member))
+			}
+		case presenceMemberRemoved:
+			if remote {
+				deleteRemotePresenceLocked(key, member.UserID, ev.Instance)
+			}
+			if !presentElsewhereLocked(key, member.UserID, ev.Instance) {
+				announce = append(announce, presenceNotification(ev.Channel, presenceMemberRemoved, member))
+			}
+		}
+	}
+	msgLock.Unlock()
+
+	for _, notif := range announce {
+		broadcastToApp(appID, notif, nil, exceptSocketID)
+	}
+}
+
+func setRemotePresenceLocked(key, instance string, member presenceMember, now time.Time) {
+	users, ok := remotePresence[key]
+	if !ok {
+		users = make(map[string]map[string]*remotePresenceEntry)
+		remotePresence[key] = users
+	}
+	instances, ok := users[member.UserID]
+	if !ok {
+		instances = make(map[string]*remotePresenceEntry)
+		users[member.UserID] = instances
+	}
+	instances[instance] = &remotePresenceEntry{member: member, refreshed: now}
+}
+
+func deleteRemotePresenceLocked(key, userID, instance string) {
+	delete(remotePresence[key][userID], instance)
+	if len(remotePresence[key][userID]) == 0 {
+		delete(remotePresence[key], userID)
+	}
+	if len(remotePresence[key]) == 0 {
+		delete(remotePresence, key)
+	}
+}
+
+// expireRemotePresence drops members of instances that stopped refreshing
+// their roster, e.g. because they crashed, and announces their departure.
+func expireRemotePresence(now time.Time) {
+	type removal struct {
+		appID string
+		notif Notification
+	}
+	removals := []removal{}
+
+	msgLock.Lock()
+	for key, users := range remotePresence {
+		for userID, instances := range users {
+			for instance, entry := range instances {
+				if now.Sub(entry.refreshed) < 3*presenceSyncInterval {
+					continue
+				}
+				deleteRemotePresenceLocked(key, userID, instance)
+				if !presentElsewhereLocked(key, userID, instance) {
+					channel := channelFromStorageName(key)
+					removals = append(removals, removal{appFromStorageName(key), presenceNotification(channel, presenceMemberRemoved, entry.member)})
+				}
+			}
+		}
+	}
+	msgLock.Unlock()
+
+	for _, r := range removals {
+		broadcastToApp(r.appID, r.notif, nil, "")
+	}
+}
+
+// publishPresenceRoster sends the local roster of every presence channel to
+// the other instances.
+func publishPresenceRoster() {
+	msgs := []BackplaneMessage{}
+	msgLock.Lock()
+	for key, entries := range presenceRoster {
+		appID, channel := appFromStorageName(key), channelFromStorageName(key)
+		ev := &presenceEvent{Instance: instanceID, Channel: channel, Event: presenceRosterEvent}
+		size := 0
+		for _, entry := range entries {
+			encoded, _ := json.Marshal(entry.member)
+			if size+len(encoded) > presenceChunkSize && len(ev.Members) > 0 {
+				msgs = append(msgs, BackplaneMessage{AppID: appID, Presence: ev})
+				ev = &presenceEvent{Instance: instanceID, Channel: channel, Event: presenceRosterEvent}
+				size = 0
+			}
+			ev.Members = append(ev.Members, entry.member)
+			size += len(encoded)
+		}
+		msgs = append(msgs, BackplaneMessage{AppID: appID, Presence: ev})
+	}
+	msgLock.Unlock()
+
+	for _, msg := range msgs {
+		if err := backplane.Publish(msg); err != nil {
+			log.Println("Failed to publish presence roster:", err)
+		}
+	}
+}
+
+// requestPresenceSync asks the other instances for their rosters and sends
+// ours, e.g. after starting or reconnecting to the backplane.
+func requestPresenceSync() {
+	if err := backplane.Publish(BackplaneMessage{Presence: &presenceEvent{Instance: instanceID, Event: presenceSyncRequest}}); err != nil {
+		log.Println("Failed to request presence rosters:", err)
+	}
+	publishPresenceRoster()
+}
+
+// startPresenceSync keeps the rosters of other instances fresh. It is only
+// needed when several instances share a backplane.
+func startPresenceSync() {
+	requestPresenceSync()
+	go func() {
+		ticker := time.NewTicker(presenceSyncInterval)
+		defer ticker.Stop()
+		for now := range ticker.C {
+			publishPresenceRoster()
+			expireRemotePresence(now)
+		}
+	}()
+}
@@ -0,0 +1,140 @@
+package main
+
+import (
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/stretchr/testify/assert"
+)
+
+// Test decoding presence channel data
+func TestParseChannelData(t *testing.T) {
+	member, err := parseChannelData(`{"user_id": 42, "user_info": {"name": "Ana"}}`)
+	assert.NoError(t, err)
+	assert.Equal(t, "42", member.UserID)
+	assert.Equal(t, "Ana", member.UserInfo["name"])
+
+	member, err = parseChannelData(`{"user_id": "u-7"}`)
+	assert.NoError(t, err)
+	assert.Equal(t, "u-7", member.UserID)
+
+	_, err = parseChannelData(`{"user_info": {}}`)
+	assert.Error(t, err)
+	_, err = parseChannelData(`not json`)
+	assert.Error(t, err)
+}
+
+// Test that several connections of one user are listed once
+func TestPresenceRosterDeduplicatesUsers(t *testing.T) {
+	channel := "presence-roster-test"
+	app := apps.get(defaultAppID)
+	tab1 := &Client{app: app, presence: map[string]string{}}
+	tab2 := &Client{app: app, presence: map[string]string{}}
+	other := &Client{app: app, presence: map[string]string{}}
+
+	msgLock.Lock()
+	defer msgLock.Unlock()
+
+	assert.True(t, presenceJoinLocked(tab1, channel, presenceMember{UserID: "1"}))
+	assert.False(t, presenceJoinLocked(tab2, channel, presenceMember{UserID: "1"}))
+	assert.True(t, presenceJoinLocked(other, channel, presenceMember{UserID: "2"}))
+	assert.Len(t, presenceMembersLocked(defaultAppID, channel), 2)
+
+	assert.Nil(t, presenceLeaveLocked(tab1, channel))
+	left := presenceLeaveLocked(tab2, channel)
+	if assert.NotNil(t, left) {
+		assert.Equal(t, "1", left.UserID)
+	}
+	assert.Equal(t, []presenceMember{{UserID: "2"}}, presenceMembersLocked(defaultAppID, channel))
+
+	assert.NotNil(t, presenceLeaveLocked(other, channel))
+	_, ok := presenceRoster[channel]
+	assert.False(t, ok)
+}
+
+// subscribeSigned subscribes to a private or presence channel with a valid signature.
+func subscribeSigned(t *testing.T, conn *websocket.Conn, socketID, channel, channelData string) map[string]interface{} {
+	auth := "key:" + channelSignature(validCredentials["secret"], socketID, channel, channelData)
+	assert.NoError(t, conn.WriteJSON(ControlFrame{Channel: channel, Auth: auth, ChannelData: channelData}))
+
+	var ack map[string]interface{}
+	assert.NoError(t, conn.ReadJSON(&ack))
+	assert.Equal(t, "Subscribed to channel", ack["message"])
+	return ack
+}
+
+// Test member_added and member_removed events over WebSocket
+func TestPresenceChannelEvents(t *testing.T) {
+	server := httptest.NewServer(setupTestRouter())
+	defer server.Close()
+	channel := "presence-chat"
+
+	alice, aliceID := dialTestWebSocket(t, server)
+	defer alice.Close()
+	ack := subscribeSigned(t, alice, aliceID, channel, `{"user_id":"alice"}`)
+	assert.Equal(t, float64(1), ack["presence"].(map[string]interface{})["count"])
+
+	bob, bobID := dialTestWebSocket(t, server)
+	ack = subscribeSigned(t, bob, bobID, channel, `{"user_id":"bob","user_info":{"name":"Bob"}}`)
+	assert.Equal(t, float64(2), ack["presence"].(map[string]interface{})["count"])
+
+	var event Notification
+	assert.NoError(t, alice.ReadJSON(&event))
+	assert.Equal(t, "member_added", event.Event)
+	assert.Equal(t, "bob", event.Data["user_id"])
+
+	bob.Close()
+	assert.NoError(t, alice.ReadJSON(&event))
+	assert.Equal(t, "member_removed", event.Event)
+	assert.Equal(t, "bob", event.Data["user_id"])
+
+	// Presence subscriptions without a valid signature are rejected
+	var reply map[string]interface{}
+	assert.NoError(t, alice.WriteJSON(ControlFrame{Channel: "presence-other", ChannelData: `{"user_id":"alice"}`}))
+	assert.NoError(t, alice.ReadJSON(&reply))
+	assert.Equal(t, "Invalid channel signature", reply["error"])
+}
+
+// Test that members connected to other instances are listed and announced once
+func TestRemotePresence(t *testing.T) {
+	server := httptest.NewServer(setupTestRouter())
+	defer server.Close()
+	channel := "presence-remote"
+	now := time.Now()
+
+	alice, aliceID := dialTestWebSocket(t, server)
+	defer alice.Close()
+	subscribeSigned(t, alice, aliceID, channel, `{"user_id":"alice"}`)
+
+	var event Notification
+	handlePresenceEvent(defaultAppID, presenceEvent{Instance: "node-b", Channel: channel, Event: presenceMemberAdded, Members: []presenceMember{{UserID: "carol"}}}, "", now)
+	assert.NoError(t, alice.ReadJSON(&event))
+	assert.Equal(t, presenceMemberAdded, event.Event)
+	assert.Equal(t, "carol", event.Data["user_id"])
+
+	// The same user on a third instance and alice seen from outside are not announced again
+	handlePresenceEvent(defaultAppID, presenceEvent{Instance: "node-c", Channel: channel, Event: presenceRosterEvent, Members: []presenceMember{{UserID: "carol"}, {UserID: "alice"}}}, "", now.Add(-time.Hour))
+	msgLock.Lock()
+	members := presenceMembersLocked(defaultAppID, channel)
+	msgLock.Unlock()
+	assert.Equal(t, []presenceMember{{UserID: "alice"}, {UserID: "carol"}}, members)
+
+	// carol is still on node-c after leaving node-b
+	handlePresenceEvent(defaultAppID, presenceEvent{Instance: "node-b", Channel: channel, Event: presenceMemberRemoved, Members: []presenceMember{{UserID: "carol"}}}, "", now)
+	msgLock.Lock()
+	assert.Len(t, presenceMembersLocked(defaultAppID, channel), 2)
+	msgLock.Unlock()
+
+	// node-c stopped refreshing its roster, so carol is gone
+	expireRemotePresence(now)
+	assert.NoError(t, alice.ReadJSON(&event))
+	assert.Equal(t, presenceMemberRemoved, event.Event)
+	assert.Equal(t, "carol", event.Data["user_id"])
+
+	msgLock.Lock()
+	_, ok := remotePresence[channel]
+	msgLock.Unlock()
+	assert.False(t, ok)
+}
@@ -0,0 +1,182 @@
+package main
+
+import (
+	"errors"
+	"log"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// retentionRule limits how long or how many notifications the tables of
+// matching channels keep. A rule sets either MaxAge or MaxRows; for each of
+// them the first matching rule applies.
+type retentionRule struct {
+	Pattern string
+	MaxAge  time.Duration
+	MaxRows int
+}
+
+type RetentionStats struct {
+	Rules               int            `json:"rules"`
+	Runs                int            `json:"runs"`
+	LastRun             time.Time      `json:"lastRun"`
+	LastRunDuration     string         `json:"lastRunDuration"`
+	RowsPruned          int            `json:"rowsPruned"`
+	RowsPrunedByChannel map[string]int `json:"rowsPrunedByChannel"`
+	Errors              int            `json:"errors"`
+	LastError           string         `json:"lastError,omitempty"`
+}
+
+var (
+	retentionRules     []retentionRule
+	retentionInterval  = 10 * time.Minute
+	retentionBatchSize = 1000
+)
+
+func loadRetentionConfig() {
+	rules, err := parseRetentionRules(envString("RETENTION_MAX_AGE", ""), envString("RETENTION_MAX_ROWS", ""))
+	if err != nil {
+		log.Println("Invalid retention policy, channel tables are not pruned:", err)
+	}
+	retentionRules = rules
+	retentionInterval = envDuration("RETENTION_INTERVAL", retentionInterval)
+	retentionBatchSize = envInt("RETENTION_BATCH_SIZE", retentionBatchSize)
+	if retentionBatchSize < 1 {
+		log.Println("RETENTION_BATCH_SIZE must be positive, using 1000")
+		retentionBatchSize = 1000
+	}
+
+	metricsLock.Lock()
+	metrics.RetentionStats.Rules = len(retentionRules)
+	metricsLock.Unlock()
+}
+
+// parseRetentionRules reads lists such as "logs.#=168h,chat.*=720h" for the
+// maximum age and "chat.*=10000" for the maximum number of rows.
+func parseRetentionRules(maxAge, maxRows string) ([]retentionRule, error) {
+	rules := []retentionRule{}
+	err := parsePatternList(maxAge, func(pattern, value string) error {
+		age, err := time.ParseDuration(value)
+		if err != nil || age <= 0 {
+			return errors.New("invalid max age for " + pattern)
+		}
+		rules = append(rules, retentionRule{Pattern: pattern, MaxAge: age})
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	err = parsePatternList(maxRows, func(pattern, value string) error {
+		rows, err := strconv.Atoi(value)
+		if err != nil || rows <= 0 {
+			return errors.New("invalid max rows for " + pattern)
+		}
+		rules = append(rules, retentionRule{Pattern: pattern, MaxRows: rows})
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return rules, nil
+}
+
+// retentionFor returns the limits of a channel, zero when it has none.
+func retentionFor(channel string) (maxAge time.Duration, maxRows int) {
+	for _, rule := range retentionRules {
+		if !patternCovers(rule.Pattern, channel) {
+			continue
+		}
+		if maxAge == 0 {
+			maxAge = rule.MaxAge
+		}
+		if maxRows == 0 {
+			maxRows = rule.MaxRows
+		}
+	}
+	return maxAge, maxRows
+}
+
+// appFromStorageName returns the app id of a storage name.
+func appFromStorageName(name string) string {
+	if i := strings.Index(name, ":"); i >= 0 {
+		return name[:i]
+	}
+	return defaultAppID
+}
+
+// channelFromStorageName reverses storageName.
+func channelFromStorageName(name string) string {
+	if i := strings.Index(name, ":"); i >= 0 {
+		return name[i+1:]
+	}
+	return name
+}
+
+// startRetentionWorker periodically prunes stored channels according to the
+// retention rules.
+func startRetentionWorker() {
+	if len(retentionRules) == 0 {
+		return
+	}
+	go func() {
+		ticker := time.NewTicker(retentionInterval)
+		defer ticker.Stop()
+		for now := range ticker.C {
+			runRetention(now)
+		}
+	}()
+}
+
+// runRetention prunes every channel table once and returns the rows deleted.
+func runRetention(now time.Time) int {
+	started := time.Now()
+	pruned := map[string]int{}
+	err := func() error {
+		channels, err := storage.channels()
+		if err != nil {
+			return err
+		}
+		for _, name := range channels {
+			maxAge, maxRows := retentionFor(channelFromStorageName(name))
+			if maxAge == 0 && maxRows == 0 {
+				continue
+			}
+			n, err := storage.prune(name, now, maxAge, maxRows)
+			if n > 0 {
+				pruned[name] = n
+			}
+			if err != nil {
+				return err
+			}
+			// Deliveries of rows pruned by count are forgotten when redelivered
+			if maxAge > 0 {
+				if _, err := deliveries.pruneChannel(appFromStorageName(name), channelFromStorageName(name), now.Add(-maxAge)); err != nil {
+					return err
+				}
+			}
+		}
+		return nil
+	}()
+	if err != nil {
+		log.Println("Failed to prune channel tables:", err)
+	}
+
+	total := 0
+	metricsLock.Lock()
+	stats := metrics.RetentionStats
+	stats.Runs++
+	stats.LastRun = now
+	stats.LastRunDuration = time.Since(started).String()
+	for table, n := range pruned {
+		stats.RowsPrunedByChannel[table] += n
+		total += n
+	}
+	stats.RowsPruned += total
+	if err != nil {
+		stats.Errors++
+		stats.LastError = err.Error()
+	}
+	metricsLock.Unlock()
+	return total
+}
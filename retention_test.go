@@ -0,0 +1,53 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// Test that max age and max rows are resolved independently, first match wins
+func TestRetentionFor(t *testing.T) {
+	defer func(rules []retentionRule) { retentionRules = rules }(retentionRules)
+	rules, err := parseRetentionRules("logs.#=168h, chat.*=720h", "chat.lobby=500,chat.*=10000")
+	assert.NoError(t, err)
+	retentionRules = rules
+
+	maxAge, maxRows := retentionFor("chat.lobby")
+	assert.Equal(t, 720*time.Hour, maxAge)
+	assert.Equal(t, 500, maxRows)
+
+	maxAge, maxRows = retentionFor("chat.support")
+	assert.Equal(t, 720*time.Hour, maxAge)
+	assert.Equal(t, 10000, maxRows)
+
+	maxAge, maxRows = retentionFor("logs.api.errors")
+	assert.Equal(t, 168*time.Hour, maxAge)
+	assert.Zero(t, maxRows)
+
+	maxAge, maxRows = retentionFor("orders")
+	assert.Zero(t, maxAge)
+	assert.Zero(t, maxRows)
+
+	_, err = parseRetentionRules("", "chat.*=lots")
+	assert.Error(t, err)
+	_, err = parseRetentionRules("chat.*=-1h", "")
+	assert.Error(t, err)
+	_, err = parseRetentionRules("chat:*=1h", "")
+	assert.Error(t, err)
+}
+
+// Test that retention applies to the channel part of app-scoped table names
+func TestChannelFromStorageName(t *testing.T) {
+	assert.Equal(t, "chat.lobby", channelFromStorageName(storageName(defaultAppID, "chat.lobby")))
+	assert.Equal(t, "chat.lobby", channelFromStorageName(storageName("shop", "chat.lobby")))
+}
+
+// Test that retention statistics are part of the metrics
+func TestRetentionStats(t *testing.T) {
+	stats := getMetrics().RetentionStats
+	if assert.NotNil(t, stats) {
+		assert.NotNil(t, stats.RowsPrunedByChannel)
+	}
+}
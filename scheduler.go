@@ -0,0 +1,455 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+var (
+	schedulerInterval = time.Second
+	maxScheduleDelay  = 30 * 24 * time.Hour
+
+	// Notifications handed to publishNotification per scheduler run
+	schedulerBatchSize = 100
+
+	// A notification that fails to publish is retried after scheduleRetryDelay,
+	// doubling each time, and dropped after scheduleMaxAttempts
+	scheduleRetryDelay  = 10 * time.Second
+	scheduleMaxAttempts = 5
+
+	schedules scheduleStore = newMemoryScheduleStore()
+)
+
+// scheduledNotification is a notification waiting for its delivery time.
+type scheduledNotification struct {
+	ID           int64        `json:"id"`
+	AppID        string       `json:"-"`
+	DeliverAt    time.Time    `json:"deliver_at"`
+	CreatedAt    time.Time    `json:"created_at"`
+	Notification Notification `json:"notification"`
+
+	// Failed publish attempts so far
+	Attempts  int    `json:"attempts,omitempty"`
+	LastError string `json:"last_error,omitempty"`
+}
+
+// scheduleStore keeps scheduled notifications. The Postgres store survives
+// restarts and lets several instances share the work without double delivery.
+type scheduleStore interface {
+	add(item scheduledNotification) (scheduledNotification, error)
+	list(appID string) ([]scheduledNotification, error)
+	cancel(appID string, id int64) (bool, error)
+	// due passes the notifications due at now to deliver, oldest first, and
+	// removes those delivered successfully. Those that fail are kept for a
+	// retry (see retryLater) without holding back the others.
+	due(now time.Time, limit int, deliver func(scheduledNotification) error) error
+}
+
+func loadSchedulerConfig() {
+	schedulerInterval = envDuration("SCHEDULER_INTERVAL", schedulerInterval)
+	maxScheduleDelay = envDuration("SCHEDULE_MAX_DELAY", maxScheduleDelay)
+	scheduleRetryDelay = envDuration("SCHEDULE_RETRY_DELAY", scheduleRetryDelay)
+	scheduleMaxAttempts = envInt("SCHEDULE_MAX_ATTEMPTS", scheduleMaxAttempts)
+	if useDB {
+		store, err := newDBScheduleStore()
+		if err != nil {
+			log.Println("Failed to create schedule table, keeping scheduled notifications in memory:", err)
+			return
+		}
+		schedules = store
+	}
+}
+
+// scheduledTime returns when a notification with deliver_at or delay should be
+// published, or the zero time when it should be published now.
+func scheduledTime(notif Notification, now time.Time) (time.Time, error) {
+	var deliverAt time.Time
+	switch {
+	case notif.DeliverAt != nil && notif.Delay != "":
+		return time.Time{}, errors.New("Use either deliver_at or delay")
+	case notif.DeliverAt != nil:
+		deliverAt = *notif.DeliverAt
+	case notif.Delay != "":
+		delay, err := time.ParseDuration(notif.Delay)
+		if err != nil || delay < 0 {
+			return time.Time{}, errors.New("Invalid delay")
+		}
+		deliverAt = now.Add(delay)
+	default:
+		return time.Time{}, nil
+	}
+
+	if deliverAt.Sub(now) > maxScheduleDelay {
+		return time.Time{}, errors.New("Delivery time too far in the future")
+	}
+	if !deliverAt.After(now) {
+		return time.Time{}, nil
+	}
+	return deliverAt, nil
+}
+
+func scheduleNotification(c *gin.Context, app *App, notif Notification, deliverAt time.Time) {
+	notif.ID = 0
+	notif.Timestamp = time.Time{}
+	notif.Replayed = false
+	notif.IdempotencyKey = ""
+	notif.DeliverAt = nil
+	notif.Delay = ""
+
+	item, err := schedules.add(scheduledNotification{
+		AppID:        app.ID,
+		DeliverAt:    deliverAt,
+		CreatedAt:    time.Now(),
+		Notification: notif,
+	})
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to schedule notification", "detail": err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusAccepted, gin.H{
+		"success":     true,
+		"message":     "Notification scheduled",
+		"schedule_id": item.ID,
+		"deliver_at":  item.DeliverAt,
+	})
+}
+
+// startScheduler publishes scheduled notifications once they are due.
+func startScheduler() {
+	go func() {
+		ticker := time.NewTicker(schedulerInterval)
+		defer ticker.Stop()
+		for now := range ticker.C {
+			runScheduler(now)
+		}
+	}()
+}
+
+func runScheduler(now time.Time) {
+	err := schedules.due(now, schedulerBatchSize, func(item scheduledNotification) error {
+		app := apps.get(item.AppID)
+		if app == nil {
+			log.Println("Dropping scheduled notification of unknown app:", item.AppID)
+			return nil
+		}
+		notif := item.Notification
+		ids, err := publishNotification(app, &notif)
+		if err != nil && ids != nil {
+			// Already stored, so a retry would store another copy; subscribers
+			// that missed the broadcast find it in the history
+			log.Println("Scheduled notification stored but not broadcast:", err)
+			return nil
+		}
+		return err
+	})
+	if err != nil {
+		log.Println("Failed to deliver scheduled notifications:", err)
+	}
+}
+
+func listScheduledHandler(c *gin.Context) {
+	app := appFromContext(c)
+	channel := c.Query("channel")
+
+	items, err := schedules.list(app.ID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to load scheduled notifications", "detail": err.Error()})
+		return
+	}
+
+	subject := subjectFromContext(c)
+	visible := []scheduledNotification{}
+	for _, item := range items {
+		if channel != "" && !containsString(notificationTargets(item.Notification), channel) {
+			continue
+		}
+		if authorize(subject, actionHistory, item.Notification.Channel).Allowed {
+			visible = append(visible, item)
+		}
+	}
+	c.JSON(http.StatusOK, gin.H{"data": visible})
+}
+
+func cancelScheduledHandler(c *gin.Context) {
+	app := appFromContext(c)
+	id, err := strconv.ParseInt(c.Param("id"), 10, 64)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid id"})
+		return
+	}
+
+	// Cancelling requires the right to publish to the channels
+	items, err := schedules.list(app.ID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to load scheduled notifications", "detail": err.Error()})
+		return
+	}
+	for _, item := range items {
+		if item.ID != id {
+			continue
+		}
+		for _, channel := range notificationTargets(item.Notification) {
+			if !authorizeRequest(c, actionPublish, channel) {
+				return
+			}
+		}
+	}
+
+	cancelled, err := schedules.cancel(app.ID, id)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to cancel scheduled notification", "detail": err.Error()})
+		return
+	}
+	if !cancelled {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Scheduled notification not found"})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"success": true, "message": "Scheduled notification cancelled"})
+}
+
+// retryLater records a failed delivery and moves the notification to its next
+// attempt. It reports false once the attempts are used up and the notification
+// should be dropped.
+func (item *scheduledNotification) retryLater(now time.Time, err error) bool {
+	item.Attempts++
+	item.LastError = err.Error()
+	if item.Attempts >= scheduleMaxAttempts {
+		log.Printf("Dropping scheduled notification %d after %d attempts: %v", item.ID, item.Attempts, err)
+		return false
+	}
+	item.DeliverAt = now.Add(scheduleRetryDelay << (item.Attempts - 1))
+	return true
+}
+
+func containsString(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
+
+// ------------------ Memory ------------------
+
+type memoryScheduleStore struct {
+	mu     sync.Mutex
+	lastID int64
+	items  map[int64]scheduledNotification
+}
+
+func newMemoryScheduleStore() *memoryScheduleStore {
+	return &memoryScheduleStore{items: make(map[int64]scheduledNotification)}
+}
+
+func (s *memoryScheduleStore) add(item scheduledNotification) (scheduledNotification, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.lastID++
+	item.ID = s.lastID
+	s.items[item.ID] = item
+	return item, nil
+}
+
+func (s *memoryScheduleStore) list(appID string) ([]scheduledNotification, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	items := []scheduledNotification{}
+	for _, item := range s.items {
+		if item.AppID == appID {
+			items = append(items, item)
+		}
+	}
+	sortSchedule(items)
+	return items, nil
+}
+
+func (s *memoryScheduleStore) cancel(appID string, id int64) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	item, ok := s.items[id]
+	if !ok || item.AppID != appID {
+		return false, nil
+	}
+	delete(s.items, id)
+	return true, nil
+}
+
+func (s *memoryScheduleStore) due(now time.Time, limit int, deliver func(scheduledNotification) error) error {
+	s.mu.Lock()
+	items := []scheduledNotification{}
+	for _, item := range s.items {
+		if !item.DeliverAt.After(now) {
+			items = append(items, item)
+		}
+	}
+	sortSchedule(items)
+	if len(items) > limit {
+		items = items[:limit]
+	}
+	for _, item := range items {
+		delete(s.items, item.ID)
+	}
+	s.mu.Unlock()
+
+	var deliverErr error
+	for _, item := range items {
+		if err := deliver(item); err != nil {
+			deliverErr = err
+			if item.retryLater(now, err) {
+				s.mu.Lock()
+				s.items[item.ID] = item
+				s.mu.Unlock()
+			}
+		}
+	}
+	return deliverErr
+}
+
+func sortSchedule(items []scheduledNotification) {
+	sort.Slice(items, func(i, j int) bool {
+		if !items[i].DeliverAt.Equal(items[j].DeliverAt) {
+			return items[i].DeliverAt.Before(items[j].DeliverAt)
+		}
+		return items[i].ID < items[j].ID
+	})
+}
+
+// ------------------ Postgres ------------------
+
+type dbScheduleStore struct{}
+
+func newDBScheduleStore() (*dbScheduleStore, error) {
+	_, err := dbConn.Exec(`CREATE TABLE IF NOT EXISTS ws_scheduled (
+		id BIGSERIAL PRIMARY KEY,
+		app_id TEXT NOT NULL,
+		notification TEXT NOT NULL,
+		deliver_at TIMESTAMPTZ NOT NULL,
+		created_at TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+		attempts INT NOT NULL DEFAULT 0,
+		last_error TEXT
+	)`)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := dbConn.Exec(`ALTER TABLE ws_scheduled
+		ADD COLUMN IF NOT EXISTS attempts INT NOT NULL DEFAULT 0,
+		ADD COLUMN IF NOT EXISTS last_error TEXT`); err != nil {
+		return nil, err
+	}
+
+	// Earlier versions stored times without a zone, dropping the offset of deliver_at
+	var dataType string
+	err = dbConn.QueryRow(`SELECT data_type FROM information_schema.columns
+		WHERE table_schema = current_schema() AND table_name = 'ws_scheduled' AND column_name = 'deliver_at'`).Scan(&dataType)
+	if err != nil {
+		return nil, err
+	}
+	if dataType == "timestamp without time zone" {
+		if _, err := dbConn.Exec(`ALTER TABLE ws_scheduled
+			ALTER COLUMN deliver_at TYPE TIMESTAMPTZ,
+			ALTER COLUMN created_at TYPE TIMESTAMPTZ`); err != nil {
+			return nil, err
+		}
+	}
+	return &dbScheduleStore{}, nil
+}
+
+func (s *dbScheduleStore) add(item scheduledNotification) (scheduledNotification, error) {
+	payload, err := json.Marshal(item.Notification)
+	if err != nil {
+		return item, err
+	}
+	err = dbConn.QueryRow(`INSERT INTO ws_scheduled (app_id, notification, deliver_at, created_at) VALUES ($1, $2, $3, $4) RETURNING id`,
+		item.AppID, string(payload), item.DeliverAt, item.CreatedAt).Scan(&item.ID)
+	return item, err
+}
+
+func (s *dbScheduleStore) list(appID string) ([]scheduledNotification, error) {
+	rows, err := dbConn.Query(`SELECT id, app_id, notification, deliver_at, created_at, attempts, last_error FROM ws_scheduled
+		WHERE app_id = $1 ORDER BY deliver_at, id`, appID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	return scanSchedule(rows)
+}
+
+func (s *dbScheduleStore) cancel(appID string, id int64) (bool, error) {
+	result, err := dbConn.Exec(`DELETE FROM ws_scheduled WHERE app_id = $1 AND id = $2`, appID, id)
+	if err != nil {
+		return false, err
+	}
+	deleted, _ := result.RowsAffected()
+	return deleted > 0, nil
+}
+
+// due locks the due rows so other instances skip them. Rows are deleted in the
+// same transaction, so an instance that dies mid-way leaves them for the next run.
+func (s *dbScheduleStore) due(now time.Time, limit int, deliver func(scheduledNotification) error) error {
+	tx, err := dbConn.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	rows, err := tx.Query(`SELECT id, app_id, notification, deliver_at, created_at, attempts, last_error FROM ws_scheduled
+		WHERE deliver_at <= $1 ORDER BY deliver_at, id LIMIT $2 FOR UPDATE SKIP LOCKED`, now, limit)
+	if err != nil {
+		return err
+	}
+	items, err := scanSchedule(rows)
+	rows.Close()
+	if err != nil {
+		return err
+	}
+
+	var deliverErr error
+	for _, item := range items {
+		if err := deliver(item); err != nil {
+			deliverErr = err
+			if item.retryLater(now, err) {
+				if _, err := tx.Exec(`UPDATE ws_scheduled SET attempts = $2, last_error = $3, deliver_at = $4 WHERE id = $1`,
+					item.ID, item.Attempts, item.LastError, item.DeliverAt); err != nil {
+					return err
+				}
+				continue
+			}
+		}
+		if _, err := tx.Exec(`DELETE FROM ws_scheduled WHERE id = $1`, item.ID); err != nil {
+			return err
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+	return deliverErr
+}
+
+func scanSchedule(rows *sql.Rows) ([]scheduledNotification, error) {
+	items := []scheduledNotification{}
+	for rows.Next() {
+		var item scheduledNotification
+		var payload string
+		var lastError sql.NullString
+		if err := rows.Scan(&item.ID, &item.AppID, &payload, &item.DeliverAt, &item.CreatedAt, &item.Attempts, &lastError); err != nil {
+			return nil, err
+		}
+		item.LastError = lastError.String
+		if err := json.Unmarshal([]byte(payload), &item.Notification); err != nil {
+			return nil, err
+		}
+		items = append(items, item)
+	}
+	return items, rows.Err()
+}
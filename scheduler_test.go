@@ -0,0 +1,198 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func withScheduleStore(t *testing.T) {
+	previous := schedules
+	schedules = newMemoryScheduleStore()
+	t.Cleanup(func() { schedules = previous })
+}
+
+// Test deliver_at and delay parsing
+func TestScheduledTime(t *testing.T) {
+	now := time.Now()
+	later := now.Add(time.Hour)
+	past := now.Add(-time.Minute)
+
+	at, err := scheduledTime(Notification{DeliverAt: &later}, now)
+	assert.NoError(t, err)
+	assert.Equal(t, later, at)
+
+	at, err = scheduledTime(Notification{Delay: "15m"}, now)
+	assert.NoError(t, err)
+	assert.Equal(t, now.Add(15*time.Minute), at)
+
+	at, err = scheduledTime(Notification{DeliverAt: &past}, now)
+	assert.NoError(t, err)
+	assert.True(t, at.IsZero())
+
+	_, err = scheduledTime(Notification{Delay: "soon"}, now)
+	assert.Error(t, err)
+	_, err = scheduledTime(Notification{DeliverAt: &later, Delay: "1m"}, now)
+	assert.Error(t, err)
+	_, err = scheduledTime(Notification{Delay: "10000h"}, now)
+	assert.Error(t, err)
+}
+
+// Test that a delayed notification is held until the scheduler runs after its time
+func TestScheduledNotification(t *testing.T) {
+	withScheduleStore(t)
+	router := setupTestRouter()
+	server := httptest.NewServer(router)
+	defer server.Close()
+
+	conn, _ := dialTestWebSocket(t, server)
+	defer conn.Close()
+	var ack map[string]interface{}
+	assert.NoError(t, conn.WriteJSON(ControlFrame{Action: "subscribe", Channel: "scheduled_channel"}))
+	assert.NoError(t, conn.ReadJSON(&ack))
+
+	w := publishIdempotent(router, "", Notification{Channel: "scheduled_channel", Event: "reminder", Delay: "15m"})
+	assert.Equal(t, http.StatusAccepted, w.Code)
+	var resp struct {
+		ScheduleID int64     `json:"schedule_id"`
+		DeliverAt  time.Time `json:"deliver_at"`
+	}
+	assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &resp))
+	assert.NotZero(t, resp.ScheduleID)
+
+	// Not due yet
+	runScheduler(time.Now())
+	broadcastToApp(defaultAppID, Notification{Channel: "scheduled_channel", Event: "marker"}, nil, "")
+	var received Notification
+	assert.NoError(t, conn.ReadJSON(&received))
+	assert.Equal(t, "marker", received.Event)
+
+	runScheduler(resp.DeliverAt.Add(time.Second))
+	assert.NoError(t, conn.ReadJSON(&received))
+	assert.Equal(t, "reminder", received.Event)
+	assert.NotZero(t, received.ID)
+	assert.Nil(t, received.DeliverAt)
+	assert.Empty(t, received.Delay)
+
+	items, _ := schedules.list(defaultAppID)
+	assert.Empty(t, items)
+}
+
+// Test listing and cancelling scheduled notifications
+func TestListAndCancelScheduled(t *testing.T) {
+	withScheduleStore(t)
+	router := setupTestRouter()
+
+	later := time.Now().Add(time.Hour)
+	publishIdempotent(router, "", Notification{Channel: "scheduled_a", Event: "one", DeliverAt: &later})
+	publishIdempotent(router, "", Notification{Channel: "scheduled_b", Event: "two", Delay: "30m"})
+
+	request := func(method, uri string) *httptest.ResponseRecorder {
+		req, _ := http.NewRequest(method, uri, nil)
+		req.Header.Set("key", "key")
+		req.Header.Set("secret", "secret")
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+		return w
+	}
+
+	var list struct {
+		Data []scheduledNotification `json:"data"`
+	}
+	w := request("GET", "/scheduled")
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &list))
+	if !assert.Len(t, list.Data, 2) {
+		return
+	}
+	// Ordered by delivery time
+	assert.Equal(t, "two", list.Data[0].Notification.Event)
+
+	json.Unmarshal(request("GET", "/scheduled?channel=scheduled_a").Body.Bytes(), &list)
+	assert.Len(t, list.Data, 1)
+
+	id := strconv.FormatInt(list.Data[0].ID, 10)
+	assert.Equal(t, http.StatusOK, request("DELETE", "/scheduled/"+id).Code)
+	assert.Equal(t, http.StatusNotFound, request("DELETE", "/scheduled/"+id).Code)
+
+	json.Unmarshal(request("GET", "/scheduled").Body.Bytes(), &list)
+	assert.Len(t, list.Data, 1)
+}
+
+// Test that the Postgres store keeps the offset of deliver_at
+func TestDBScheduleStoreZone(t *testing.T) {
+	withTestPostgres(t)
+	store, err := newDBScheduleStore()
+	if !assert.NoError(t, err) {
+		return
+	}
+
+	now := time.Now()
+	farZone := time.FixedZone("UTC+14", 14*60*60)
+	_, err = store.add(scheduledNotification{AppID: defaultAppID, DeliverAt: now.Add(time.Minute).In(farZone), CreatedAt: now})
+	assert.NoError(t, err)
+
+	delivered := 0
+	deliver := func(scheduledNotification) error { delivered++; return nil }
+	assert.NoError(t, store.due(now, 10, deliver))
+	assert.Equal(t, 0, delivered)
+	assert.NoError(t, store.due(now.Add(2*time.Minute), 10, deliver))
+	assert.Equal(t, 1, delivered)
+}
+
+// Test that a failing notification is retried later without blocking the others
+func TestScheduleRetries(t *testing.T) {
+	defer func(attempts int) { scheduleMaxAttempts = attempts }(scheduleMaxAttempts)
+	scheduleMaxAttempts = 2
+	store := newMemoryScheduleStore()
+	now := time.Now()
+	store.add(scheduledNotification{AppID: defaultAppID, DeliverAt: now, Notification: Notification{Event: "broken"}})
+	store.add(scheduledNotification{AppID: defaultAppID, DeliverAt: now, Notification: Notification{Event: "fine"}})
+
+	delivered := []string{}
+	deliver := func(item scheduledNotification) error {
+		if item.Notification.Event == "broken" {
+			return errors.New("cannot publish")
+		}
+		delivered = append(delivered, item.Notification.Event)
+		return nil
+	}
+
+	assert.Error(t, store.due(now, 10, deliver))
+	assert.Equal(t, []string{"fine"}, delivered)
+	items, _ := store.list(defaultAppID)
+	if assert.Len(t, items, 1) {
+		assert.Equal(t, 1, items[0].Attempts)
+		assert.Equal(t, "cannot publish", items[0].LastError)
+		assert.Equal(t, now.Add(scheduleRetryDelay), items[0].DeliverAt)
+	}
+
+	// Not due again before the retry delay, dropped after the last attempt
+	assert.NoError(t, store.due(now, 10, deliver))
+	assert.Error(t, store.due(now.Add(scheduleRetryDelay), 10, deliver))
+	items, _ = store.list(defaultAppID)
+	assert.Empty(t, items)
+}
+
+// Test that a scheduled notification is not stored again when only the broadcast failed
+func TestScheduledStoredOnce(t *testing.T) {
+	withScheduleStore(t)
+	withFailingBackplane(t)
+	now := time.Now()
+	schedules.add(scheduledNotification{AppID: defaultAppID, DeliverAt: now, Notification: Notification{Channel: "scheduled_once", Event: "once"}})
+
+	runScheduler(now)
+	runScheduler(now.Add(time.Hour))
+
+	items, _ := schedules.list(defaultAppID)
+	assert.Empty(t, items)
+	history, err := loadHistory(defaultAppID, "scheduled_once", 0, time.Time{}, 10)
+	assert.NoError(t, err)
+	assert.Len(t, history, 1)
+}
@@ -0,0 +1,84 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func signedRequest(method, uri string, body []byte, timestamp time.Time, nonce string) *http.Request {
+	req, _ := http.NewRequest(method, uri, bytes.NewBuffer(body))
+	ts := strconv.FormatInt(timestamp.Unix(), 10)
+	req.Header.Set("key", "key")
+	req.Header.Set("timestamp", ts)
+	req.Header.Set("nonce", nonce)
+	req.Header.Set("signature", requestSignature("secret", method, uri, ts, nonce, body))
+	return req
+}
+
+// Test publishing with a signed request and rejecting replays
+func TestSignedRequest(t *testing.T) {
+	router := setupTestRouter()
+	body, _ := json.Marshal(Notification{Channel: "signed_channel", Event: "created"})
+
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, signedRequest("POST", "/notification", body, time.Now(), "nonce-1"))
+	assert.Equal(t, http.StatusOK, w.Code)
+
+	// Same nonce again
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, signedRequest("POST", "/notification", body, time.Now(), "nonce-1"))
+	assert.Equal(t, http.StatusUnauthorized, w.Code)
+
+	// Timestamp outside the allowed skew
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, signedRequest("POST", "/notification", body, time.Now().Add(-time.Hour), "nonce-2"))
+	assert.Equal(t, http.StatusUnauthorized, w.Code)
+
+	// Body changed after signing
+	req := signedRequest("POST", "/notification", body, time.Now(), "nonce-3")
+	req.Body = http.NoBody
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusUnauthorized, w.Code)
+
+	// Query string is part of the signature
+	req = signedRequest("GET", "/notifications?channel=signed_channel", nil, time.Now(), "nonce-4")
+	req.URL.RawQuery = "channel=other_channel"
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusUnauthorized, w.Code)
+}
+
+// Test that signature mode rejects the legacy secret header
+func TestAuthModeSignature(t *testing.T) {
+	defer func(mode string) { authMode = mode }(authMode)
+	authMode = authModeSignature
+	router := setupTestRouter()
+
+	req, _ := http.NewRequest("GET", "/notifications?channel=test_channel", nil)
+	req.Header.Set("key", "key")
+	req.Header.Set("secret", "secret")
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusUnauthorized, w.Code)
+
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, signedRequest("GET", "/notifications?channel=test_channel", nil, time.Now(), "nonce-mode"))
+	assert.NotEqual(t, http.StatusUnauthorized, w.Code)
+}
+
+// Test nonce expiry
+func TestNonceCache(t *testing.T) {
+	cache := newNonceCache()
+	now := time.Now()
+	assert.True(t, cache.add("a", now.Add(time.Minute), now))
+	assert.False(t, cache.add("a", now.Add(time.Minute), now))
+	assert.True(t, cache.add("a", now.Add(3*time.Minute), now.Add(2*time.Minute)))
+}
@@ -0,0 +1,201 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	_ "github.com/mattn/go-sqlite3"
+)
+
+// sqliteStore keeps notifications in an embedded SQLite database, laid out
+// like ws_notifications with data as JSON text. It gives small installs and
+// tests history and search without Postgres.
+type sqliteStore struct {
+	sqlWriter
+}
+
+// newSQLiteStore opens or creates the database at path, ":memory:" for a
+// database that lives as long as the process.
+func newSQLiteStore(path string) (*sqliteStore, error) {
+	conn, err := sql.Open("sqlite3", path+"?_busy_timeout=5000&_journal_mode=WAL&_case_sensitive_like=1")
+	if err != nil {
+		return nil, err
+	}
+	// SQLite allows one writer at a time; one connection also keeps ":memory:" a single database
+	conn.SetMaxOpenConns(1)
+
+	statements := []string{
+		`CREATE TABLE IF NOT EXISTS notifications (
+			id INTEGER PRIMARY KEY AUTOINCREMENT,
+			channel TEXT NOT NULL,
+			"event" TEXT,
+			data TEXT NOT NULL DEFAULT '{}',
+			created_at TIMESTAMP NOT NULL,
+			expires_at TIMESTAMP
+		)`,
+		`CREATE INDEX IF NOT EXISTS notifications_channel_idx ON notifications (channel, id)`,
+		`CREATE INDEX IF NOT EXISTS notifications_expires_at_idx ON notifications (expires_at) WHERE expires_at IS NOT NULL`,
+	}
+	for _, statement := range statements {
+		if _, err := conn.Exec(statement); err != nil {
+			conn.Close()
+			return nil, err
+		}
+	}
+	s := &sqliteStore{}
+	s.sqlWriter = sqlWriter{conn: conn, insertRow: s.insert}
+	return s, nil
+}
+
+// builder starts a query on the notifications of one channel. Times are
+// stored in UTC, so they compare correctly as text.
+func (s *sqliteStore) builder(channel string) *queryBuilder {
+	q := &queryBuilder{placeholder: "?", zone: time.UTC}
+	q.where("channel = " + q.arg(channel))
+	return q
+}
+
+func (s *sqliteStore) insert(q queryer, channel string, notif Notification) (int64, error) {
+	data, err := encodeData(notif.Data)
+	if err != nil {
+		return 0, err
+	}
+	var expiresAt interface{}
+	if notif.ExpiresAt != nil {
+		expiresAt = notif.ExpiresAt.UTC()
+	}
+
+	result, err := q.Exec(`INSERT INTO notifications (channel, "event", data, created_at, expires_at) VALUES (?, ?, ?, ?, ?)`,
+		channel, notif.Event, data, notif.Timestamp.UTC(), expiresAt)
+	if err != nil {
+		return 0, err
+	}
+	return result.LastInsertId()
+}
+
+func (s *sqliteStore) query(channel string, filters []queryFilter, limit int) ([]map[string]interface{}, error) {
+	q := s.builder(channel)
+	q.notExpired(time.Now())
+	for _, f := range filters {
+		if err := sqliteFilter(q, f); err != nil {
+			return nil, err
+		}
+	}
+	return s.rows(q, "DESC", limit)
+}
+
+func (s *sqliteStore) history(channel string, sinceID int64, since time.Time, limit int) ([]Notification, error) {
+	q := s.builder(channel)
+	q.where("id > " + q.arg(sinceID))
+	q.notExpired(time.Now())
+	if !since.IsZero() {
+		q.where("created_at > " + q.arg(since))
+	}
+	rows, err := s.rows(q, "ASC", limit)
+	if err != nil {
+		return nil, err
+	}
+
+	history := []Notification{}
+	for _, row := range rows {
+		history = append(history, rowToNotification(channelFromStorageName(channel), row))
+	}
+	return history, nil
+}
+
+// rows runs the query and returns up to limit rows ordered by id, "ASC" or "DESC".
+func (s *sqliteStore) rows(q *queryBuilder, order string, limit int) ([]map[string]interface{}, error) {
+	rows, err := s.conn.Query(`SELECT id, "event", data, created_at, expires_at FROM notifications
+		WHERE `+q.whereClause()+`
+		ORDER BY id `+order+` LIMIT `+strconv.Itoa(limit), q.args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	result, err := scanDataRows(rows)
+	if err != nil {
+		return nil, err
+	}
+	// Report times like the Postgres stores
+	for _, row := range result {
+		for _, col := range []string{"created_at", "expires_at"} {
+			if t, ok := row[col].(time.Time); ok {
+				row[col] = t.Local()
+			}
+		}
+	}
+	return result, nil
+}
+
+func (s *sqliteStore) channels() ([]string, error) {
+	return queryStrings(s.conn, `SELECT DISTINCT channel FROM notifications`)
+}
+
+func (s *sqliteStore) prune(channel string, now time.Time, maxAge time.Duration, maxRows int) (int, error) {
+	scope := func() *queryBuilder { return s.builder(channel) }
+	return pruneRows(s.conn, "notifications", "rowid", scope, now, maxAge, maxRows)
+}
+
+func (s *sqliteStore) purgeExpired(now time.Time) (int64, error) {
+	result, err := s.conn.Exec(`DELETE FROM notifications WHERE expires_at <= ?`, now.UTC())
+	if err != nil {
+		return 0, err
+	}
+	return result.RowsAffected()
+}
+
+// sqliteFilter is jsonbFilter for SQLite. Values are compared with the JSON
+// type of the stored field, so numbers never match strings.
+func sqliteFilter(q *queryBuilder, f queryFilter) error {
+	op := allowedOperators[f.Op]
+	if notificationColumns[f.Field] {
+		q.where(`"` + f.Field + `" ` + op + " " + q.arg(f.Value))
+		return nil
+	}
+	p := q.arg(`$."` + strings.Join(strings.Split(f.Field, "."), `"."`) + `"`)
+	value := "json_extract(data, " + p + ")"
+	valueType := "json_type(data, " + p + ")"
+
+	if f.Text || op == "LIKE" || op == "ILIKE" {
+		// The text Postgres returns for the value, true and false rather than 1 and 0
+		text := "CASE " + valueType + " WHEN 'true' THEN 'true' WHEN 'false' THEN 'false' ELSE CAST(" + value + " AS TEXT) END"
+		target := q.arg(fmt.Sprint(f.Value))
+		if op == "ILIKE" {
+			q.where("LOWER(" + text + ") LIKE LOWER(" + target + ")")
+		} else {
+			q.where(text + " " + op + " " + target)
+		}
+		return nil
+	}
+
+	switch v := f.Value.(type) {
+	case nil:
+		if op == "=" {
+			q.where(valueType + " = 'null'")
+		} else {
+			q.where("FALSE")
+		}
+	case bool:
+		flag := 0
+		if v {
+			flag = 1
+		}
+		q.where(valueType + " IN ('true', 'false') AND " + value + " " + op + " " + q.arg(flag))
+	case string:
+		q.where(valueType + " = 'text' AND " + value + " " + op + " " + q.arg(v))
+	case map[string]interface{}, []interface{}:
+		encoded, err := json.Marshal(v)
+		if err != nil {
+			return fmt.Errorf("Invalid value for %s", f.Field)
+		}
+		q.where(valueType + " IN ('object', 'array') AND " + value + " " + op + " " + q.arg(string(encoded)))
+	default:
+		q.where(valueType + " IN ('integer', 'real') AND " + value + " " + op + " " + q.arg(v))
+	}
+	return nil
+}
@@ -0,0 +1,182 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func withSQLiteStorage(t *testing.T) *sqliteStore {
+	store, err := newSQLiteStore(filepath.Join(t.TempDir(), "notifications.db"))
+	if !assert.NoError(t, err) {
+		t.FailNow()
+	}
+	previous := storage
+	storage = store
+	t.Cleanup(func() {
+		storage = previous
+		store.conn.Close()
+	})
+	return store
+}
+
+func searchSQLite(t *testing.T, router http.Handler, channel string, filters ...map[string]interface{}) []map[string]interface{} {
+	body, _ := json.Marshal(map[string]interface{}{"channel": channel, "filters": filters})
+	req, _ := http.NewRequest("GET", "/search", bytes.NewBuffer(body))
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("key", "key")
+	req.Header.Set("secret", "secret")
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusOK, w.Code, w.Body.String())
+
+	var resp struct {
+		Data []map[string]interface{} `json:"data"`
+	}
+	assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &resp))
+	return resp.Data
+}
+
+// Test publishing, listing and searching with typed JSON filters
+func TestSQLiteSearch(t *testing.T) {
+	withSQLiteStorage(t)
+	router := setupTestRouter()
+
+	for _, data := range []map[string]interface{}{
+		{"amount": 5, "sender": "Alice", "customer": map[string]interface{}{"name": "Alice"}},
+		{"amount": 20, "sender": "bob", "customer": map[string]interface{}{"name": "Bob"}},
+		{"amount": "100", "sender": "alice"},
+	} {
+		w := publishIdempotent(router, "", Notification{Channel: "orders", Event: "created", Data: data})
+		assert.Equal(t, http.StatusOK, w.Code)
+	}
+
+	rows := searchSQLite(t, router, "orders")
+	if assert.Len(t, rows, 3) {
+		// Newest first, with the JSON types kept
+		assert.Equal(t, float64(3), rows[0]["id"])
+		assert.Equal(t, "100", rows[0]["amount"])
+		assert.Equal(t, float64(20), rows[1]["amount"])
+		assert.Equal(t, "created", rows[1]["event"])
+	}
+
+	rows = searchSQLite(t, router, "orders", map[string]interface{}{"field": "amount", "op": ">", "value": 9})
+	if assert.Len(t, rows, 1) {
+		assert.Equal(t, "bob", rows[0]["sender"])
+	}
+	assert.Len(t, searchSQLite(t, router, "orders", map[string]interface{}{"field": "amount", "op": ">", "value": "0"}), 1)
+	assert.Len(t, searchSQLite(t, router, "orders", map[string]interface{}{"field": "customer.name", "op": "==", "value": "Bob"}), 1)
+	assert.Len(t, searchSQLite(t, router, "orders", map[string]interface{}{"field": "sender", "op": "like", "value": "ali%"}), 1)
+	assert.Len(t, searchSQLite(t, router, "orders", map[string]interface{}{"field": "sender", "op": "ilike", "value": "ali%"}), 2)
+
+	// Query string filters compare text, so numbers match too
+	req, _ := http.NewRequest("GET", "/notifications?channel=orders&amount=20", nil)
+	req.Header.Set("key", "key")
+	req.Header.Set("secret", "secret")
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusOK, w.Code)
+	var resp struct {
+		Data []map[string]interface{} `json:"data"`
+	}
+	assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &resp))
+	assert.Len(t, resp.Data, 1)
+}
+
+// Test that a notification published to several channels is stored once per channel
+func TestSQLiteMultiChannelPublish(t *testing.T) {
+	withSQLiteStorage(t)
+	router := setupTestRouter()
+
+	w := publishIdempotent(router, "", Notification{Channels: []string{"alerts", "audit"}, Event: "login"})
+	assert.Equal(t, http.StatusOK, w.Code)
+	var resp struct {
+		IDs map[string]int64 `json:"ids"`
+	}
+	assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &resp))
+	assert.Len(t, resp.IDs, 2)
+
+	history, err := loadHistory(defaultAppID, "audit", 0, time.Time{}, 10)
+	assert.NoError(t, err)
+	if assert.Len(t, history, 1) {
+		assert.Equal(t, "audit", history[0].Channel)
+		assert.Equal(t, resp.IDs["audit"], history[0].ID)
+	}
+}
+
+// Test that published notifications are replayed from SQLite on subscribe
+func TestSQLiteHistoryReplay(t *testing.T) {
+	withSQLiteStorage(t)
+	router := setupTestRouter()
+	server := httptest.NewServer(router)
+	defer server.Close()
+
+	for _, message := range []string{"first", "second"} {
+		w := publishIdempotent(router, "", Notification{Channel: "sqlite_replay", Event: "chat", Data: map[string]interface{}{"message": message}})
+		assert.Equal(t, http.StatusOK, w.Code)
+	}
+
+	conn, _ := dialTestWebSocket(t, server)
+	defer conn.Close()
+	assert.NoError(t, conn.WriteJSON(ControlFrame{Channel: "sqlite_replay", SinceID: 1}))
+
+	var ack map[string]interface{}
+	assert.NoError(t, conn.ReadJSON(&ack))
+	assert.Equal(t, "Subscribed to channel", ack["message"])
+
+	var replayed Notification
+	assert.NoError(t, conn.ReadJSON(&replayed))
+	assert.True(t, replayed.Replayed)
+	assert.Equal(t, int64(2), replayed.ID)
+	assert.Equal(t, "second", replayed.Data["message"])
+
+	assert.NoError(t, conn.ReadJSON(&ack))
+	assert.Equal(t, "History replayed", ack["message"])
+}
+
+// Test expiry and retention pruning in SQLite
+func TestSQLitePrune(t *testing.T) {
+	store := withSQLiteStorage(t)
+	defer func(size int) { retentionBatchSize = size }(retentionBatchSize)
+	retentionBatchSize = 2
+
+	now := time.Now()
+	past := now.Add(-time.Second)
+	for i := 0; i < 6; i++ {
+		notif := Notification{Event: "tick", Timestamp: now.Add(time.Duration(i-6) * time.Hour), Data: map[string]interface{}{"n": i}}
+		if i == 5 {
+			notif.ExpiresAt = &past
+		}
+		_, err := store.save("ticks", notif)
+		assert.NoError(t, err)
+	}
+
+	rows, err := store.query("ticks", nil, 100)
+	assert.NoError(t, err)
+	assert.Len(t, rows, 5)
+	purged, err := store.purgeExpired(now)
+	assert.NoError(t, err)
+	assert.Equal(t, int64(1), purged)
+
+	// Rows 0 and 1 are older than 4h30m, then only the newest two are kept
+	pruned, err := store.prune("ticks", now, 4*time.Hour+30*time.Minute, 2)
+	assert.NoError(t, err)
+	assert.Equal(t, 3, pruned)
+
+	history, err := store.history("ticks", 0, time.Time{}, 100)
+	assert.NoError(t, err)
+	if assert.Len(t, history, 2) {
+		assert.Equal(t, float64(3), history[0].Data["n"])
+		assert.Equal(t, "ticks", history[0].Channel)
+	}
+
+	channels, err := store.channels()
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"ticks"}, channels)
+}
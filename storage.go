@@ -0,0 +1,301 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"log"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// notificationStore persists the notifications of every channel, addressed by
+// storage name (see storageName).
+type notificationStore interface {
+	// save stores a notification and returns its id, which increases within the channel
+	save(channel string, notif Notification) (int64, error)
+	// saveCopies stores the notification once per target channel of the app, all
+	// or nothing, and sets notif.ID to the id of the copy in notif.Channel
+	saveCopies(appID string, notif *Notification) (map[string]int64, error)
+	// saveBatch is saveCopies for several notifications at once. A failing item
+	// is reported in errs without dropping the others; err means nothing was
+	// stored, and errs still tells which items failed on their own.
+	saveBatch(appID string, batch []*Notification) (ids []map[string]int64, errs []error, err error)
+	// query returns up to limit unexpired rows matching every filter, newest first
+	query(channel string, filters []queryFilter, limit int) ([]map[string]interface{}, error)
+	// history returns up to limit unexpired notifications after sinceID and since, oldest first
+	history(channel string, sinceID int64, since time.Time, limit int) ([]Notification, error)
+	channels() ([]string, error)
+	// prune deletes the rows of a channel older than maxAge and beyond the newest maxRows
+	prune(channel string, now time.Time, maxAge time.Duration, maxRows int) (int, error)
+	purgeExpired(now time.Time) (int64, error)
+}
+
+// Storage backends. By default notifications are stored in Postgres when it is
+// configured and in memory otherwise.
+const (
+	storageBackendPostgres = "postgres"
+	storageBackendSQLite   = "sqlite"
+	storageBackendMemory   = "memory"
+)
+
+// Postgres storage modes. "tables" keeps a table per channel with a TEXT column
+// per data field, "jsonb" keeps every notification in ws_notifications with its data as JSONB.
+const (
+	storageModeTables = "tables"
+	storageModeJSONB  = "jsonb"
+)
+
+var (
+	storage     notificationStore = memoryHistory
+	storageMode                   = storageModeTables
+	sqlitePath                    = "notifications.db"
+)
+
+func loadStorageConfig() {
+	switch mode := envString("STORAGE_MODE", storageMode); mode {
+	case storageModeTables, storageModeJSONB:
+		storageMode = mode
+	default:
+		log.Println("Unknown STORAGE_MODE, using", storageMode+":", mode)
+	}
+
+	backend := storageBackendMemory
+	if useDB {
+		backend = storageBackendPostgres
+	}
+	switch value := envString("STORAGE_BACKEND", backend); value {
+	case storageBackendPostgres:
+		if !useDB {
+			log.Println("STORAGE_BACKEND=postgres needs a database, keeping notifications in memory")
+			return
+		}
+		backend = value
+	case storageBackendSQLite, storageBackendMemory:
+		backend = value
+	default:
+		log.Println("Unknown STORAGE_BACKEND, using", backend+":", value)
+	}
+
+	switch backend {
+	case storageBackendPostgres:
+		if storageMode == storageModeJSONB {
+			store, err := newJSONBStore(dbConn)
+			if err != nil {
+				log.Fatal("Failed to create "+notificationsTable+": ", err)
+			}
+			storage = store
+		} else {
+			store, err := newTableStore(dbConn)
+			if err != nil {
+				log.Fatal("Failed to create ws_channel_tables: ", err)
+			}
+			storage = store
+		}
+	case storageBackendSQLite:
+		store, err := newSQLiteStore(envString("SQLITE_PATH", sqlitePath))
+		if err != nil {
+			log.Fatal("Failed to open SQLite database: ", err)
+		}
+		storage = store
+	}
+}
+
+// queryer is implemented by both *sql.DB and *sql.Tx
+type queryer interface {
+	Exec(query string, args ...interface{}) (sql.Result, error)
+	QueryRow(query string, args ...interface{}) *sql.Row
+}
+
+// sqlWriter implements the writes of the SQL stores with insertRow, which
+// stores one row through the connection or transaction it is given.
+type sqlWriter struct {
+	conn      *sql.DB
+	insertRow func(q queryer, channel string, notif Notification) (int64, error)
+}
+
+func (w sqlWriter) save(channel string, notif Notification) (int64, error) {
+	return w.insertRow(w.conn, channel, notif)
+}
+
+func (w sqlWriter) saveCopies(appID string, notif *Notification) (map[string]int64, error) {
+	tx, err := w.conn.Begin()
+	if err != nil {
+		return nil, err
+	}
+	ids, err := w.insertCopies(tx, appID, notif)
+	if err != nil {
+		tx.Rollback()
+		return nil, err
+	}
+	if err := tx.Commit(); err != nil {
+		return nil, err
+	}
+	return ids, nil
+}
+
+func (w sqlWriter) insertCopies(q queryer, appID string, notif *Notification) (map[string]int64, error) {
+	ids := map[string]int64{}
+	for _, channel := range notificationTargets(*notif) {
+		id, err := w.insertRow(q, storageName(appID, channel), *notif)
+		if err != nil {
+			return nil, err
+		}
+		ids[channel] = id
+	}
+	notif.ID = ids[notif.Channel]
+	return ids, nil
+}
+
+// saveBatch inserts the batch in a single transaction. Each item runs under a
+// savepoint, so one failing row is reported without aborting the rest.
+func (w sqlWriter) saveBatch(appID string, batch []*Notification) ([]map[string]int64, []error, error) {
+	ids := make([]map[string]int64, len(batch))
+	errs := make([]error, len(batch))
+	tx, err := w.conn.Begin()
+	if err != nil {
+		return nil, errs, err
+	}
+
+	for i, notif := range batch {
+		if _, err := tx.Exec("SAVEPOINT batch_item"); err != nil {
+			tx.Rollback()
+			return nil, errs, err
+		}
+		itemIDs, err := w.insertCopies(tx, appID, notif)
+		if err == nil {
+			_, err = tx.Exec("RELEASE SAVEPOINT batch_item")
+		}
+		if err != nil {
+			errs[i] = err
+			if _, err := tx.Exec("ROLLBACK TO SAVEPOINT batch_item"); err != nil {
+				tx.Rollback()
+				return nil, errs, err
+			}
+			continue
+		}
+		ids[i] = itemIDs
+	}
+
+	if err := tx.Commit(); err != nil {
+		return nil, errs, err
+	}
+	return ids, errs, nil
+}
+
+// queryFilter is a single condition on a stored field.
+type queryFilter struct {
+	Field string
+	Op    string // one of the allowedOperators keys
+	Value interface{}
+	// Compare the text of the stored value, like the TEXT columns of the tables mode
+	Text bool
+}
+
+// validateFilters rejects filters that no store can run.
+func validateFilters(filters []queryFilter) error {
+	for _, f := range filters {
+		if _, ok := allowedOperators[f.Op]; !ok {
+			return fmt.Errorf("Invalid operator: %s", f.Op)
+		}
+		if strings.Contains(f.Field, `"`) {
+			return fmt.Errorf("Invalid field: %s", f.Field)
+		}
+		for _, segment := range strings.Split(f.Field, ".") {
+			if segment == "" {
+				return fmt.Errorf("Invalid field: %s", f.Field)
+			}
+		}
+	}
+	return nil
+}
+
+// queryBuilder collects the conditions of a query and binds their arguments.
+type queryBuilder struct {
+	placeholder string // "$" for Postgres, "?" for SQLite
+	// Times are stored without a zone: local time in Postgres, UTC in SQLite
+	zone       *time.Location
+	conditions []string
+	args       []interface{}
+}
+
+// arg binds a value and returns its placeholder.
+func (q *queryBuilder) arg(value interface{}) string {
+	if t, ok := value.(time.Time); ok {
+		value = t.In(q.zone)
+	}
+	q.args = append(q.args, value)
+	return q.placeholder + strconv.Itoa(len(q.args))
+}
+
+func (q *queryBuilder) where(condition string) {
+	q.conditions = append(q.conditions, condition)
+}
+
+func (q *queryBuilder) notExpired(now time.Time) {
+	q.where("(expires_at IS NULL OR expires_at > " + q.arg(now) + ")")
+}
+
+func (q *queryBuilder) whereClause() string {
+	if len(q.conditions) == 0 {
+		return "TRUE"
+	}
+	return strings.Join(q.conditions, " AND ")
+}
+
+// pruneRows deletes the rows of table selected by scope that are older than
+// maxAge or beyond the newest maxRows. rowRef names the physical row, ctid in
+// Postgres and rowid in SQLite.
+func pruneRows(db *sql.DB, table, rowRef string, scope func() *queryBuilder, now time.Time, maxAge time.Duration, maxRows int) (int, error) {
+	pruned := 0
+	if maxAge > 0 {
+		q := scope()
+		q.where("created_at < " + q.arg(now.Add(-maxAge)))
+		n, err := deleteInBatches(db, table, rowRef, q)
+		pruned += n
+		if err != nil {
+			return pruned, err
+		}
+	}
+	if maxRows > 0 {
+		q := scope()
+		var cutoff int64
+		err := db.QueryRow(`SELECT id FROM `+table+` WHERE `+q.whereClause()+` ORDER BY id DESC LIMIT 1 OFFSET `+q.arg(maxRows), q.args...).Scan(&cutoff)
+		if err == sql.ErrNoRows {
+			return pruned, nil
+		}
+		if err != nil {
+			return pruned, err
+		}
+		q = scope()
+		q.where("id <= " + q.arg(cutoff))
+		n, err := deleteInBatches(db, table, rowRef, q)
+		pruned += n
+		if err != nil {
+			return pruned, err
+		}
+	}
+	return pruned, nil
+}
+
+// deleteInBatches deletes the matching rows retentionBatchSize at a time, so
+// pruning a large backlog never holds long locks on a busy channel.
+func deleteInBatches(db *sql.DB, table, rowRef string, q *queryBuilder) (int, error) {
+	query := `DELETE FROM ` + table + ` WHERE ` + rowRef + ` IN (
+		SELECT ` + rowRef + ` FROM ` + table + ` WHERE ` + q.whereClause() + ` ORDER BY id LIMIT ` + q.arg(retentionBatchSize) + `)`
+	deleted := 0
+	for {
+		result, err := db.Exec(query, q.args...)
+		if err != nil {
+			return deleted, err
+		}
+		n, err := result.RowsAffected()
+		if err != nil {
+			return deleted, err
+		}
+		deleted += int(n)
+		if int(n) < retentionBatchSize {
+			return deleted, nil
+		}
+	}
+}
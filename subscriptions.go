@@ -0,0 +1,240 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+// Channel names are split into segments on ".". In a subscription pattern "*"
+// matches exactly one segment and "#" matches any number of trailing segments,
+// so "orders.*.created" and "orders.#" both match "orders.store-12.created".
+const (
+	segmentSeparator    = "."
+	singleLevelWildcard = "*"
+	multiLevelWildcard  = "#"
+)
+
+// appSubscriptions indexes the client subscriptions of each app. Guarded by msgLock.
+var appSubscriptions = make(map[string]*subscriptionTrie)
+
+// subscriptionsFor returns the subscription index of an app. msgLock must be held.
+func subscriptionsFor(appID string) *subscriptionTrie {
+	trie, ok := appSubscriptions[appID]
+	if !ok {
+		trie = newSubscriptionTrie()
+		appSubscriptions[appID] = trie
+	}
+	return trie
+}
+
+// subscriptionTrie stores subscription patterns segment by segment, so finding
+// the subscribers of a channel costs O(segments) instead of O(patterns).
+type subscriptionTrie struct {
+	root *trieNode
+}
+
+type trieNode struct {
+	children    map[string]*trieNode
+	subscribers map[*Client]bool
+}
+
+func newSubscriptionTrie() *subscriptionTrie {
+	return &subscriptionTrie{root: newTrieNode()}
+}
+
+func newTrieNode() *trieNode {
+	return &trieNode{
+		children:    make(map[string]*trieNode),
+		subscribers: make(map[*Client]bool),
+	}
+}
+
+// Channel segments and app ids are limited to these characters, so storage
+// names are always plain table names.
+var validName = regexp.MustCompile(`^[A-Za-z0-9_-]+$`)
+
+// Tables of the server itself start with this prefix, channels cannot.
+const internalTablePrefix = "ws_"
+
+// Postgres truncates identifiers longer than this, so two long storage names
+// could end up in the same table.
+const maxStorageName = 63
+
+// validatePattern checks that wildcards only appear as whole segments, that
+// "#" is the last segment and that the other segments only use validName
+// characters.
+func validatePattern(pattern string) error {
+	if pattern == "" {
+		return errors.New("Channel required")
+	}
+	if strings.HasPrefix(strings.ToLower(pattern), internalTablePrefix) {
+		return errors.New("Channel names cannot start with " + internalTablePrefix)
+	}
+	if len(pattern) > maxStorageName {
+		return fmt.Errorf("Channel names cannot be longer than %d bytes", maxStorageName)
+	}
+	segments := strings.Split(pattern, segmentSeparator)
+	for i, segment := range segments {
+		if segment == multiLevelWildcard && i != len(segments)-1 {
+			return errors.New("Wildcard # must be the last segment")
+		}
+		if segment == singleLevelWildcard || segment == multiLevelWildcard {
+			continue
+		}
+		if strings.ContainsAny(segment, "*#") {
+			return errors.New("Wildcards must be a whole segment")
+		}
+		if !validName.MatchString(segment) {
+			return errors.New("Channel names may only contain letters, digits, '_', '-' and '.'")
+		}
+	}
+	return nil
+}
+
+// validateChannel checks an exact channel name, as used for publishing and stored history.
+func validateChannel(channel string) error {
+	if err := validatePattern(channel); err != nil {
+		return err
+	}
+	if isPattern(channel) {
+		return errors.New("Wildcards are not allowed here")
+	}
+	return nil
+}
+
+// validateStorageName checks that the channel still fits an identifier once
+// prefixed with its app id.
+func validateStorageName(appID, channel string) error {
+	if len(storageName(appID, channel)) > maxStorageName {
+		return fmt.Errorf("App id and channel name cannot be longer than %d bytes together", maxStorageName-1)
+	}
+	return nil
+}
+
+// validateAppChannel checks an exact channel name of an app.
+func validateAppChannel(appID, channel string) error {
+	if err := validateChannel(channel); err != nil {
+		return err
+	}
+	return validateStorageName(appID, channel)
+}
+
+// isPattern reports whether a channel name contains wildcard segments.
+func isPattern(channel string) bool {
+	for _, segment := range strings.Split(channel, segmentSeparator) {
+		if segment == singleLevelWildcard || segment == multiLevelWildcard {
+			return true
+		}
+	}
+	return false
+}
+
+// patternCovers reports whether every channel matched by pattern is also
+// matched by allowed. For exact channels this is the usual wildcard match.
+func patternCovers(allowed, pattern string) bool {
+	a := strings.Split(allowed, segmentSeparator)
+	p := strings.Split(pattern, segmentSeparator)
+	for i, segment := range a {
+		if segment == multiLevelWildcard {
+			return true
+		}
+		if i >= len(p) || p[i] == multiLevelWildcard {
+			return false
+		}
+		if segment != singleLevelWildcard && segment != p[i] {
+			return false
+		}
+	}
+	return len(a) == len(p)
+}
+
+// patternsOverlap reports whether some channel is matched by both patterns.
+func patternsOverlap(a, b string) bool {
+	return segmentsOverlap(strings.Split(a, segmentSeparator), strings.Split(b, segmentSeparator))
+}
+
+func segmentsOverlap(a, b []string) bool {
+	for len(a) > 0 && len(b) > 0 {
+		if a[0] == multiLevelWildcard || b[0] == multiLevelWildcard {
+			return true
+		}
+		if a[0] != b[0] && a[0] != singleLevelWildcard && b[0] != singleLevelWildcard {
+			return false
+		}
+		a, b = a[1:], b[1:]
+	}
+	// "#" also matches no segments at all
+	return (len(a) == 0 || a[0] == multiLevelWildcard) && (len(b) == 0 || b[0] == multiLevelWildcard)
+}
+
+func (t *subscriptionTrie) add(pattern string, client *Client) {
+	node := t.root
+	for _, segment := range strings.Split(pattern, segmentSeparator) {
+		child, ok := node.children[segment]
+		if !ok {
+			child = newTrieNode()
+			node.children[segment] = child
+		}
+		node = child
+	}
+	node.subscribers[client] = true
+}
+
+func (t *subscriptionTrie) remove(pattern string, client *Client) {
+	t.root.remove(strings.Split(pattern, segmentSeparator), client)
+}
+
+// remove deletes the subscription and prunes nodes left empty.
+func (n *trieNode) remove(segments []string, client *Client) {
+	if len(segments) == 0 {
+		delete(n.subscribers, client)
+		return
+	}
+	child, ok := n.children[segments[0]]
+	if !ok {
+		return
+	}
+	child.remove(segments[1:], client)
+	if len(child.subscribers) == 0 && len(child.children) == 0 {
+		delete(n.children, segments[0])
+	}
+}
+
+// match returns every client subscribed to a pattern matching the channel.
+// A client appears once even if several of its patterns match.
+// Private and presence channels are never matched by a leading wildcard, since
+// such a subscription was not signed for them.
+func (t *subscriptionTrie) match(channel string) map[*Client]bool {
+	matched := make(map[*Client]bool)
+	segments := strings.Split(channel, segmentSeparator)
+	if requiresChannelAuth(channel) {
+		if child, ok := t.root.children[segments[0]]; ok {
+			child.match(segments[1:], matched)
+		}
+		return matched
+	}
+	t.root.match(segments, matched)
+	return matched
+}
+
+func (n *trieNode) match(segments []string, matched map[*Client]bool) {
+	if hash, ok := n.children[multiLevelWildcard]; ok {
+		for client := range hash.subscribers {
+			matched[client] = true
+		}
+	}
+	if len(segments) == 0 {
+		for client := range n.subscribers {
+			matched[client] = true
+		}
+		return
+	}
+	if child, ok := n.children[segments[0]]; ok {
+		child.match(segments[1:], matched)
+	}
+	if star, ok := n.children[singleLevelWildcard]; ok {
+		star.match(segments[1:], matched)
+	}
+}
@@ -0,0 +1,74 @@
+package main
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// Test wildcard pattern validation
+func TestValidatePattern(t *testing.T) {
+	for _, pattern := range []string{"orders", "orders.*", "orders.#", "orders.*.created", "#", "chat-room-1"} {
+		assert.NoError(t, validatePattern(pattern), pattern)
+	}
+	for _, pattern := range []string{"", "orders.#.created", "orders.store*", "orders.#x", "a:b", `x"; DROP TABLE orders; --`, "orders..x", "ws_apps", "WS_apps.#"} {
+		assert.Error(t, validatePattern(pattern), pattern)
+	}
+	assert.NoError(t, validateChannel("orders.store-12"))
+	assert.Error(t, validateChannel("orders.*"))
+}
+
+// Test that storage names never exceed the Postgres identifier length
+func TestValidateStorageNameLength(t *testing.T) {
+	assert.NoError(t, validateChannel(strings.Repeat("a", maxStorageName)))
+	assert.Error(t, validateChannel(strings.Repeat("a", maxStorageName+1)))
+	assert.Error(t, validatePattern(strings.Repeat("a", maxStorageName)+".#"))
+
+	assert.NoError(t, validateAppChannel(defaultAppID, strings.Repeat("a", maxStorageName)))
+	assert.NoError(t, validateAppChannel("shop", strings.Repeat("a", maxStorageName-5)))
+	assert.Error(t, validateAppChannel("shop", strings.Repeat("a", maxStorageName-4)))
+	assert.Error(t, validateApps([]*App{{ID: strings.Repeat("a", maxStorageName-1), Key: "k", Secret: "s"}}))
+}
+
+// Test whether two patterns can match a common channel
+func TestPatternsOverlap(t *testing.T) {
+	for _, pair := range [][2]string{{"#", "user.43.x"}, {"user.#", "user.43.*"}, {"user.*.orders", "user.43.*"}, {"a.#", "a"}, {"a.*", "*.b"}, {"a", "a"}} {
+		assert.True(t, patternsOverlap(pair[0], pair[1]), pair)
+		assert.True(t, patternsOverlap(pair[1], pair[0]), pair)
+	}
+	for _, pair := range [][2]string{{"user.42.*", "user.43.*"}, {"a.*", "a"}, {"a.b", "a.b.c"}, {"*", "a.b"}} {
+		assert.False(t, patternsOverlap(pair[0], pair[1]), pair)
+		assert.False(t, patternsOverlap(pair[1], pair[0]), pair)
+	}
+}
+
+// Test single and multi-level wildcard matching
+func TestSubscriptionTrieMatch(t *testing.T) {
+	trie := newSubscriptionTrie()
+	exact, star, hash, other := &Client{}, &Client{}, &Client{}, &Client{}
+	trie.add("orders.store-12.created", exact)
+	trie.add("orders.*.created", star)
+	trie.add("orders.#", hash)
+	trie.add("billing.*", other)
+
+	matched := trie.match("orders.store-12.created")
+	assert.Equal(t, map[*Client]bool{exact: true, star: true, hash: true}, matched)
+
+	matched = trie.match("orders.store-12.cancelled")
+	assert.Equal(t, map[*Client]bool{hash: true}, matched)
+
+	matched = trie.match("billing.invoice.paid")
+	assert.Empty(t, matched)
+
+	// A client with several matching patterns is returned once
+	trie.add("orders.#", exact)
+	assert.Len(t, trie.match("orders.store-12.created"), 3)
+
+	trie.remove("orders.#", hash)
+	trie.remove("orders.#", exact)
+	assert.Equal(t, map[*Client]bool{other: true}, trie.match("billing.invoice"))
+	assert.Empty(t, trie.match("orders.store-12.cancelled"))
+	_, ok := trie.root.children["orders"].children[multiLevelWildcard]
+	assert.False(t, ok, "empty nodes should be pruned")
+}
@@ -247,7 +247,7 @@ check_server() {
     else
         echo -e "${RED}❌ Server is not running on localhost:3000${NC}"
         echo "Please start the Go server first:"
-        echo "go run main.go"
+        echo "go run ."
         echo ""
         exit 1
     fi
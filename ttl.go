@@ -0,0 +1,132 @@
+package main
+
+import (
+	"errors"
+	"log"
+	"strings"
+	"time"
+)
+
+// channelTTL gives channels matching a pattern a default time to live. A ttl
+// on the notification itself takes precedence.
+type channelTTL struct {
+	Pattern string
+	TTL     time.Duration
+}
+
+var (
+	channelTTLs      []channelTTL
+	ttlPurgeInterval = time.Minute
+)
+
+func loadExpiryConfig() {
+	ttls, err := parseChannelTTLs(envString("CHANNEL_TTLS", ""))
+	if err != nil {
+		log.Println("Invalid CHANNEL_TTLS, notifications only expire with a ttl:", err)
+	}
+	channelTTLs = ttls
+	ttlPurgeInterval = envDuration("TTL_PURGE_INTERVAL", ttlPurgeInterval)
+}
+
+// parseChannelTTLs reads a list such as "alerts.*=5m,chat.#=24h". The first
+// matching pattern wins.
+func parseChannelTTLs(value string) ([]channelTTL, error) {
+	ttls := []channelTTL{}
+	err := parsePatternList(value, func(pattern, value string) error {
+		ttl, err := time.ParseDuration(value)
+		if err != nil || ttl <= 0 {
+			return errors.New("invalid ttl for " + pattern)
+		}
+		ttls = append(ttls, channelTTL{Pattern: pattern, TTL: ttl})
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return ttls, nil
+}
+
+// parsePatternList calls fn for every pattern=value entry of a comma separated list.
+func parsePatternList(list string, fn func(pattern, value string) error) error {
+	for _, entry := range strings.Split(list, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		parts := strings.SplitN(entry, "=", 2)
+		if len(parts) != 2 {
+			return errors.New("expected pattern=value: " + entry)
+		}
+		pattern := strings.TrimSpace(parts[0])
+		if err := validatePattern(pattern); err != nil {
+			return err
+		}
+		if err := fn(pattern, strings.TrimSpace(parts[1])); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// ttlForChannel returns the configured TTL of a channel, zero if it never expires.
+func ttlForChannel(channel string) time.Duration {
+	for _, rule := range channelTTLs {
+		if patternCovers(rule.Pattern, channel) {
+			return rule.TTL
+		}
+	}
+	return 0
+}
+
+// notificationExpiry returns when a notification published at now expires, or
+// nil if it does not. Published to several channels, the shortest channel TTL applies.
+func notificationExpiry(notif Notification, now time.Time) (*time.Time, error) {
+	var ttl time.Duration
+	if notif.TTL != "" {
+		d, err := time.ParseDuration(notif.TTL)
+		if err != nil || d <= 0 {
+			return nil, errors.New("Invalid ttl")
+		}
+		ttl = d
+	} else {
+		for _, channel := range notificationTargets(notif) {
+			if d := ttlForChannel(channel); d > 0 && (ttl == 0 || d < ttl) {
+				ttl = d
+			}
+		}
+	}
+	if ttl == 0 {
+		return nil, nil
+	}
+	expiresAt := now.Add(ttl)
+	return &expiresAt, nil
+}
+
+// startExpiryPurger periodically deletes expired notifications.
+func startExpiryPurger() {
+	go func() {
+		ticker := time.NewTicker(ttlPurgeInterval)
+		defer ticker.Stop()
+		for now := range ticker.C {
+			purgeExpired(now)
+		}
+	}()
+}
+
+// purgeExpired removes expired notifications from storage and returns how many were deleted.
+func purgeExpired(now time.Time) int64 {
+	purged, err := storage.purgeExpired(now)
+	if err != nil {
+		log.Println("Failed to purge expired notifications:", err)
+	}
+	if _, err := deliveries.purge(now); err != nil {
+		log.Println("Failed to purge deliveries:", err)
+	}
+
+	if purged > 0 {
+		metricsLock.Lock()
+		metrics.ServerStats.NotificationsExpired += purged
+		metricsLock.Unlock()
+	}
+	return purged
+}
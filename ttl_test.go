@@ -0,0 +1,115 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func withChannelTTLs(t *testing.T, value string) {
+	previous := channelTTLs
+	ttls, err := parseChannelTTLs(value)
+	assert.NoError(t, err)
+	channelTTLs = ttls
+	t.Cleanup(func() { channelTTLs = previous })
+}
+
+// Test per-notification and per-channel TTLs
+func TestNotificationExpiry(t *testing.T) {
+	withChannelTTLs(t, "alerts.*=5m, alerts.#=1h")
+	now := time.Now()
+
+	expiresAt, err := notificationExpiry(Notification{Channel: "alerts.cpu"}, now)
+	assert.NoError(t, err)
+	if assert.NotNil(t, expiresAt) {
+		assert.Equal(t, now.Add(5*time.Minute), *expiresAt)
+	}
+
+	expiresAt, _ = notificationExpiry(Notification{Channel: "alerts.cpu.high"}, now)
+	if assert.NotNil(t, expiresAt) {
+		assert.Equal(t, now.Add(time.Hour), *expiresAt)
+	}
+
+	// The notification's own ttl wins, across channels the shortest applies
+	expiresAt, _ = notificationExpiry(Notification{Channel: "alerts.cpu", TTL: "30s"}, now)
+	assert.Equal(t, now.Add(30*time.Second), *expiresAt)
+	expiresAt, _ = notificationExpiry(Notification{Channels: []string{"news", "alerts.cpu.high", "alerts.disk"}}, now)
+	assert.Equal(t, now.Add(5*time.Minute), *expiresAt)
+
+	expiresAt, err = notificationExpiry(Notification{Channel: "news"}, now)
+	assert.NoError(t, err)
+	assert.Nil(t, expiresAt)
+
+	_, err = notificationExpiry(Notification{Channel: "news", TTL: "-1m"}, now)
+	assert.Error(t, err)
+	_, err = parseChannelTTLs("alerts.*")
+	assert.Error(t, err)
+}
+
+// Test that expired notifications are hidden and purged from memory
+func TestMemoryStoreExpiry(t *testing.T) {
+	store := newMemoryStore()
+	past := time.Now().Add(-time.Second)
+	future := time.Now().Add(time.Hour)
+	store.append("expiry", Notification{Channel: "expiry", Event: "gone", ExpiresAt: &past})
+	store.append("expiry", Notification{Channel: "expiry", Event: "kept", ExpiresAt: &future})
+	store.append("expiry", Notification{Channel: "expiry", Event: "forever"})
+
+	history, _ := store.history("expiry", 0, time.Time{}, 10)
+	if assert.Len(t, history, 2) {
+		assert.Equal(t, "kept", history[0].Event)
+	}
+	rows, _ := store.query("expiry", nil, 100)
+	if assert.Len(t, rows, 2) {
+		assert.Nil(t, rows[0]["expires_at"])
+		assert.Equal(t, future, rows[1]["expires_at"])
+	}
+
+	purged, _ := store.purgeExpired(time.Now())
+	assert.Equal(t, int64(1), purged)
+	assert.Equal(t, 2, store.buffers["expiry"].count)
+	purged, _ = store.purgeExpired(future)
+	assert.Equal(t, int64(1), purged)
+
+	// Ids keep increasing after a purge
+	notif := store.append("expiry", Notification{Channel: "expiry", Event: "next"})
+	assert.Equal(t, int64(4), notif.ID)
+}
+
+// Test that a notification published with a ttl is not returned once expired
+func TestPublishWithTTL(t *testing.T) {
+	if useDB {
+		t.Skip("in-memory history is only used without a database")
+	}
+	router := setupTestRouter()
+
+	w := publishIdempotent(router, "", Notification{Channel: "ttl_channel", Event: "flash", TTL: "50ms"})
+	assert.Equal(t, http.StatusOK, w.Code)
+
+	list := func() []map[string]interface{} {
+		req, _ := http.NewRequest("GET", "/notifications?channel=ttl_channel", nil)
+		req.Header.Set("key", "key")
+		req.Header.Set("secret", "secret")
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+		assert.Equal(t, http.StatusOK, w.Code)
+		var resp struct {
+			Data []map[string]interface{} `json:"data"`
+		}
+		assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &resp))
+		return resp.Data
+	}
+	if rows := list(); assert.Len(t, rows, 1) {
+		assert.NotNil(t, rows[0]["expires_at"])
+	}
+
+	time.Sleep(60 * time.Millisecond)
+	assert.Empty(t, list())
+
+	w = publishIdempotent(router, "", Notification{Channel: "ttl_channel", TTL: "soon"})
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+}
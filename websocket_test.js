@@ -46,6 +46,12 @@ class WebSocketTestClient {
     }
     
     handleMessage(data) {
+        // Skip the connection handshake
+        if (data.event === 'connection_established') {
+            console.log(`🔌 Connected with socket ID: ${data.socket_id}`);
+            return;
+        }
+
         // Skip subscription confirmation messages
         if (data.message && data.message === 'Subscribed to channel') {
             console.log(`✅ ${data.message}: ${data.channel}`);